@@ -2,6 +2,9 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -11,7 +14,9 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
-var jwtKey []byte = nil
+// Access tokens are short-lived, the session is kept alive by rotating refresh tokens
+const AccessTokenTtl = 15 * time.Minute
+const SessionTtl = 30 * 24 * time.Hour
 
 func generateHmacKey() ([]byte, error) {
 
@@ -22,89 +27,237 @@ func generateHmacKey() ([]byte, error) {
 	return key, nil
 }
 
-func CreateJWTToken(hmacKey []byte, login string) (string, error) {
+// Creates an access token with the standard claims; sid names the session the token belongs to
+func CreateJWTToken(signingKey *store.JwtKey, login string, sessionId string) (string, error) {
+	config, err := util.GetConfig()
+	if err != nil {
+		return "", err
+	}
+
+	signingMethod, err := getSigningMethod(signingKey.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := getSigningKey(*signingKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
+		signingMethod,
 		jwt.MapClaims{
-			"login":  login,
-			"expire": time.Now().Add(24 * time.Hour).Unix(),
+			"sub": login,
+			"sid": sessionId,
+			"iss": getJwtIssuer(config),
+			"aud": getJwtAudience(config),
+			"exp": now.Add(AccessTokenTtl).Unix(),
+			"iat": now.Unix(),
 		},
 	)
-	return token.SignedString([]byte(hmacKey))
+	token.Header["kid"] = signingKey.Kid
+	return token.SignedString(key)
 }
 
-func VerifyJWTToken(tokenString, hmacKey []byte) (*jwt.Token, error) {
-	return jwt.Parse(string(tokenString), func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return hmacKey, nil
-	})
+// Generates a random refresh token and returns it along with the hash to be stored
+func CreateRefreshToken() (string, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+
+	token := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(key)
+	return token, HashToken(token), nil
 }
 
-func GetJwtKey() ([]byte, error) {
-	if jwtKey != nil {
-		return jwtKey, nil
-	}
+// Random tokens carry enough entropy to be stored as a plain SHA-256 hash
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
 
-	config, err := util.GetConfig()
-	if err != nil {
-		return nil, err
-	}
+// Verifies the token with the key named by its kid header. The algorithm of the key is enforced,
+// so a token cannot pick a weaker one
+func VerifyJWTToken(tokenString string) (*jwt.Token, error) {
+	var token *jwt.Token
+	err := errors.New("no key to verify the token")
 
-	db, err := store.OpenDb(config.DbPath)
-	if err != nil {
-		return nil, err
+	kid, _ := getUnverifiedKid(tokenString)
+	jwtKeys, keysErr := getVerificationKeys(kid)
+	if keysErr != nil {
+		return nil, keysErr
 	}
 
-	isEmpty, err := store.IsEmptyjwt(db)
-	if err != nil {
-		return nil, err
-	}
-	if isEmpty {
-		key, err := generateHmacKey()
-		if err != nil {
-			return nil, err
-		}
-		err = store.InsertJwt(db, string(key))
-		if err != nil {
-			return nil, err
+	for _, jwtKey := range jwtKeys {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if token.Method.Alg() != jwtKey.Algorithm {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return getVerificationKey(jwtKey)
+		})
+		if err == nil {
+			return token, nil
 		}
 	}
+	return token, err
+}
 
-	jwtKey, err = store.GetJwtKey(db)
-	return []byte(jwtKey), err
+func getUnverifiedKid(tokenString string) (string, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return "", err
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid, nil
 }
 
 func VerifyJwtAndGetLogin(tokenString string) (string, error) {
-	jwtkey, err := GetJwtKey()
+	login, _, err := VerifyJwtAndGetSession(tokenString)
+	return login, err
+}
+
+// Verifies the JWT and returns the login and the id of the session the token was issued for
+func VerifyJwtAndGetSession(tokenString string) (string, string, error) {
+	login, sessionId, _, err := verifyJwtSession(tokenString)
+	return login, sessionId, err
+}
+
+// Returns the login, the session and the expiry of the JWT in UnixMilli
+func verifyJwtSession(tokenString string) (string, string, int64, error) {
+	login, sessionId, err := verifyJwtClaims(tokenString)
 	if err != nil {
-		return "", errors.New("failed to retrieve JWT signing key")
+		return "", "", 0, err
 	}
+	expire, err := getTokenExpire(tokenString)
+	return login, sessionId, expire, err
+}
 
-	token, err := VerifyJWTToken([]byte(tokenString), jwtkey)
+func verifyJwtClaims(tokenString string) (string, string, error) {
+	token, err := VerifyJWTToken(tokenString)
 	if err != nil {
-		return "", errors.New("JWT verification failed")
+		return "", "", errors.New("JWT verification failed")
 	}
 
 	if !token.Valid {
-		return "", errors.New("the provided JWT is invalid")
+		return "", "", errors.New("the provided JWT is invalid")
 	}
 
 	var login string
+	var sessionId string
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		if login, ok = claims["login"].(string); !ok {
-			return "", errors.New("the provided JWT is invalid: login claim not provided")
+		login, err = getTokenSubject(claims)
+		if err != nil {
+			return "", "", err
+		}
+
+		if sessionId, ok = claims["sid"].(string); !ok {
+			return "", "", errors.New("the provided JWT is invalid: sid claim not provided")
+		}
+
+		// tokens issued before a password change or for a revoked session are rejected
+		issuedAt, _ := claims["iat"].(float64)
+		err = checkTokenNotRevoked(login, sessionId, int64(issuedAt))
+		if err != nil {
+			return "", "", err
 		}
+	} else {
+		return "", "", errors.New("the provided JWT is invalid: claims not found")
+	}
+	return login, sessionId, nil
+}
 
+// Returns the expiry of an already verified token in UnixMilli
+func getTokenExpire(tokenString string) (int64, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return 0, err
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	expire, ok := claims["exp"].(float64)
+	if !ok {
+		// tokens issued before the standard claims
+		expire, ok = claims["expire"].(float64)
+	}
+	if !ok {
+		return 0, errors.New("the provided JWT is invalid: exp claim not provided")
+	}
+	return int64(expire) * 1000, nil
+}
+
+// Checks the standard claims and returns the login. Tokens issued before the standard claims
+// carry login and expire instead and are accepted until they expire
+func getTokenSubject(claims jwt.MapClaims) (string, error) {
+	if _, ok := claims["sub"]; !ok {
+		login, ok := claims["login"].(string)
+		if !ok {
+			return "", errors.New("the provided JWT is invalid: sub claim not provided")
+		}
 		if expire, ok := claims["expire"].(float64); !ok {
-			return "", errors.New("the provided JWT is invalid: expire claim not provided")
+			return "", errors.New("the provided JWT is invalid: exp claim not provided")
 		} else if time.Now().Unix() > int64(expire) {
 			return "", errors.New("the provided JWT is invalid: expired")
 		}
-	} else {
-		return "", errors.New("the provided JWT is invalid: claims not found")
+		return login, nil
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		return "", err
+	}
+
+	login, ok := claims["sub"].(string)
+	if !ok || login == "" {
+		return "", errors.New("the provided JWT is invalid: sub claim not provided")
+	}
+
+	// jwt.Parse checks exp only if it is present
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", errors.New("the provided JWT is invalid: expired")
+	}
+
+	if !claims.VerifyIssuer(getJwtIssuer(config), true) {
+		return "", errors.New("the provided JWT is invalid: issued by another issuer")
+	}
+
+	if !claims.VerifyAudience(getJwtAudience(config), true) {
+		return "", errors.New("the provided JWT is invalid: issued for another audience")
 	}
 	return login, nil
 }
+
+func checkTokenNotRevoked(login string, sessionId string, issuedAt int64) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tokenValidAfter, err := store.GetUserTokenValidAfter(db, login)
+	if err != nil {
+		return errors.New("the provided JWT is invalid: user not found")
+	}
+
+	if !store.IsUserExistsAndActive(db, login) {
+		return errors.New("the provided JWT is invalid: user not active")
+	}
+
+	if issuedAt < tokenValidAfter {
+		return errors.New("the provided JWT is invalid: revoked")
+	}
+
+	isActive, err := store.IsSessionActive(db, sessionId, login, time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if !isActive {
+		return errors.New("the provided JWT is invalid: session revoked")
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"todopp/store"
+	"todopp/util"
+)
+
+const defaultJwtKeyGraceMinutes = 60
+
+// keys are reloaded this often, so rotations from the command line reach a running server
+const jwtKeysReloadInterval = time.Minute
+
+var jwtKeys []store.JwtKey
+var jwtKeysLoadTime time.Time
+var jwtKeysMutex sync.Mutex
+
+func generateKid() (string, error) {
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(kid), nil
+}
+
+func isJwtKeyActive(jwtKey store.JwtKey, utcTime int64) bool {
+	return jwtKey.RetireAt == 0 || jwtKey.RetireAt > utcTime
+}
+
+// How long the previous keys keep verifying after a rotation
+func getJwtKeyGrace(config *util.Config) time.Duration {
+	minutes := config.JwtKeyGraceMinutes
+	if minutes <= 0 {
+		minutes = defaultJwtKeyGraceMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Returns the keys which still verify, newest first. A signing key is created if there is none
+func getActiveJwtKeys(forceReload bool) ([]store.JwtKey, error) {
+	jwtKeysMutex.Lock()
+	defer jwtKeysMutex.Unlock()
+
+	now := time.Now().UTC()
+	if forceReload || jwtKeys == nil || now.Sub(jwtKeysLoadTime) > jwtKeysReloadInterval {
+		config, err := util.GetConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := store.OpenDb(config.DbPath)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		allKeys, err := store.GetJwtKeys(db)
+		if err != nil {
+			return nil, err
+		}
+
+		algorithm, err := getJwtAlgorithm(config)
+		if err != nil {
+			return nil, err
+		}
+
+		// a changed algorithm takes effect with a new signing key, tokens of the old one stay valid for the grace period
+		if len(allKeys) == 0 || !isJwtKeyActive(allKeys[0], now.UnixMilli()) || allKeys[0].Algorithm != algorithm {
+			_, err = rotateJwtKey(db, algorithm, getJwtKeyGrace(config))
+			if err != nil {
+				return nil, err
+			}
+			allKeys, err = store.GetJwtKeys(db)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		jwtKeys = allKeys
+		jwtKeysLoadTime = now
+	}
+
+	activeKeys := []store.JwtKey{}
+	for _, jwtKey := range jwtKeys {
+		if isJwtKeyActive(jwtKey, now.UnixMilli()) {
+			activeKeys = append(activeKeys, jwtKey)
+		}
+	}
+	if len(activeKeys) == 0 {
+		return nil, errors.New("jwt key not defined")
+	}
+	return activeKeys, nil
+}
+
+// Returns the key new tokens are signed with
+func GetJwtKey() (*store.JwtKey, error) {
+	activeKeys, err := getActiveJwtKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	return &activeKeys[0], nil
+}
+
+// Returns the keys a token with the key id may be verified with. Tokens issued before key ids
+// were introduced have no kid and are checked against all active HMAC keys
+func getVerificationKeys(kid string) ([]store.JwtKey, error) {
+	activeKeys, err := getActiveJwtKeys(false)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []store.JwtKey{}
+	for _, jwtKey := range activeKeys {
+		if jwtKey.Kid == kid || (kid == "" && jwtKey.Algorithm == JwtAlgorithmHs256) {
+			keys = append(keys, jwtKey)
+		}
+	}
+	return keys, nil
+}
+
+func rotateJwtKey(db *sql.DB, algorithm string, grace time.Duration) (*store.JwtKey, error) {
+	kid, err := generateKid()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generateJwtKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	jwtKey := store.JwtKey{Kid: kid, Algorithm: algorithm, Key: key, Created: now.UnixMilli()}
+
+	err = store.InsertJwtKey(db, jwtKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens signed with the previous keys stay valid until they expire
+	err = store.RetireOtherJwtKeys(db, kid, now.Add(grace).UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	// retired keys are kept for a while to be listed
+	err = store.DeleteRetiredJwtKeys(db, now.Add(-30*24*time.Hour).UnixMilli())
+	return &jwtKey, err
+}
+
+// Creates a new signing key. The previous keys keep verifying for the configured grace period
+func RotateJwtKey(db *sql.DB) (*store.JwtKey, error) {
+	config, err := util.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := getJwtAlgorithm(config)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKey, err := rotateJwtKey(db, algorithm, getJwtKeyGrace(config))
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKeysMutex.Lock()
+	jwtKeys = nil
+	jwtKeysMutex.Unlock()
+	return jwtKey, nil
+}
+
+// Stops accepting tokens signed with the key immediately. Retiring the signing key makes the next login create a new one
+func RetireJwtKey(db *sql.DB, kid string) error {
+	err := store.RetireJwtKey(db, kid, time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	jwtKeysMutex.Lock()
+	jwtKeys = nil
+	jwtKeysMutex.Unlock()
+	return nil
+}
+
+// Starts a background loop which rotates the signing key every jwtKeyRotationDays
+func StartJwtKeyRotationScheduler() {
+	go func() {
+		for {
+			err := rotateExpiredJwtKey()
+			if err != nil {
+				fmt.Println("Error rotating jwt key: ", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func rotateExpiredJwtKey() error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+	if config.JwtKeyRotationDays <= 0 {
+		return nil
+	}
+
+	signingKey, err := GetJwtKey()
+	if err != nil {
+		return err
+	}
+
+	rotationTime := time.UnixMilli(signingKey.Created).Add(time.Duration(config.JwtKeyRotationDays) * 24 * time.Hour)
+	if time.Now().Before(rotationTime) {
+		return nil
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = RotateJwtKey(db)
+	return err
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"todopp/store"
+	"todopp/util"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	JwtAlgorithmHs256 = "HS256"
+	JwtAlgorithmEs256 = "ES256"
+	JwtAlgorithmEdDsa = "EdDSA"
+)
+
+const defaultJwtAudience = "todopp"
+
+// Public keys of the asymmetric signing keys, published for services verifying todopp tokens
+type JsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Returns the algorithm new signing keys are created for, set by the jwtAlgorithm setting
+func getJwtAlgorithm(config *util.Config) (string, error) {
+	switch config.JwtAlgorithm {
+	case "":
+		return JwtAlgorithmHs256, nil
+	case JwtAlgorithmHs256, JwtAlgorithmEs256, JwtAlgorithmEdDsa:
+		return config.JwtAlgorithm, nil
+	}
+	return "", errors.New("unsupported jwt algorithm '" + config.JwtAlgorithm + "'")
+}
+
+func getJwtIssuer(config *util.Config) string {
+	if config.JwtIssuer != "" {
+		return config.JwtIssuer
+	}
+	return "https://" + config.Domain
+}
+
+func getJwtAudience(config *util.Config) string {
+	if config.JwtAudience != "" {
+		return config.JwtAudience
+	}
+	return defaultJwtAudience
+}
+
+// Generates an HMAC secret or a PKCS #8 encoded private key
+func generateJwtKey(algorithm string) ([]byte, error) {
+	switch algorithm {
+	case JwtAlgorithmHs256:
+		return generateHmacKey()
+	case JwtAlgorithmEs256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	case JwtAlgorithmEdDsa:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	}
+	return nil, errors.New("unsupported jwt algorithm '" + algorithm + "'")
+}
+
+func getSigningMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case JwtAlgorithmHs256:
+		return jwt.SigningMethodHS256, nil
+	case JwtAlgorithmEs256:
+		return jwt.SigningMethodES256, nil
+	case JwtAlgorithmEdDsa:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, errors.New("unsupported jwt algorithm '" + algorithm + "'")
+}
+
+// Returns the key to sign with: the HMAC secret or the private key
+func getSigningKey(jwtKey store.JwtKey) (any, error) {
+	if jwtKey.Algorithm == JwtAlgorithmHs256 {
+		return jwtKey.Key, nil
+	}
+	return x509.ParsePKCS8PrivateKey(jwtKey.Key)
+}
+
+// Returns the key to verify with: the HMAC secret or the public key
+func getVerificationKey(jwtKey store.JwtKey) (any, error) {
+	if jwtKey.Algorithm == JwtAlgorithmHs256 {
+		return jwtKey.Key, nil
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(jwtKey.Key)
+	if err != nil {
+		return nil, err
+	}
+	switch privateKey := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return &privateKey.PublicKey, nil
+	case ed25519.PrivateKey:
+		return privateKey.Public(), nil
+	}
+	return nil, errors.New("unsupported private key of jwt key '" + jwtKey.Kid + "'")
+}
+
+// Returns the public keys which still verify tokens. HMAC keys are secret and never published
+func GetJsonWebKeySet() (*JsonWebKeySet, error) {
+	activeKeys, err := getActiveJwtKeys(false)
+	if err != nil {
+		return nil, err
+	}
+
+	keySet := JsonWebKeySet{Keys: []jsonWebKey{}}
+	for _, jwtKey := range activeKeys {
+		if jwtKey.Algorithm == JwtAlgorithmHs256 {
+			continue
+		}
+
+		publicKey, err := getVerificationKey(jwtKey)
+		if err != nil {
+			return nil, err
+		}
+
+		webKey := jsonWebKey{Kid: jwtKey.Kid, Use: "sig", Alg: jwtKey.Algorithm}
+		switch publicKey := publicKey.(type) {
+		case *ecdsa.PublicKey:
+			webKey.Kty = "EC"
+			webKey.Crv = "P-256"
+			webKey.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32)))
+			webKey.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32)))
+		case ed25519.PublicKey:
+			webKey.Kty = "OKP"
+			webKey.Crv = "Ed25519"
+			webKey.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		}
+		keySet.Keys = append(keySet.Keys, webKey)
+	}
+	return &keySet, nil
+}
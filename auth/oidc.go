@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// OpenID Connect relying party: authorization code flow with PKCE against a single identity provider
+type OidcProvider struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string
+
+	metadata      *oidcMetadata
+	keys          map[string]any
+	keysFetchTime time.Time
+	mutex         sync.Mutex
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Read from identity providers and published for the todopp signing keys
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Identity claims of a verified ID token
+type OidcIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// keys are refetched at most this often when an ID token is signed with an unknown key
+const oidcKeysRefetchInterval = time.Minute
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// Generates a random value for the state, nonce and PKCE verifier parameters
+func GenerateOidcRandom() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func getCodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func getOidcJson(requestUrl string, value any) error {
+	response, err := oidcClient.Get(requestUrl)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", response.StatusCode, requestUrl)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(value)
+}
+
+func (provider *OidcProvider) getMetadata() (*oidcMetadata, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.metadata != nil {
+		return provider.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	err := getOidcJson(strings.TrimSuffix(provider.Issuer, "/")+"/.well-known/openid-configuration", &metadata)
+	if err != nil {
+		return nil, errors.New("failed to read the OpenID provider configuration: " + err.Error())
+	}
+	if metadata.Issuer != provider.Issuer {
+		return nil, errors.New("the OpenID provider configuration is issued for '" + metadata.Issuer + "'")
+	}
+
+	provider.metadata = &metadata
+	return provider.metadata, nil
+}
+
+// Returns the URL of the identity provider the browser has to be redirected to
+func (provider *OidcProvider) GetAuthorizationUrl(state string, nonce string, codeVerifier string) (string, error) {
+	metadata, err := provider.getMetadata()
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.ClientId)
+	params.Set("redirect_uri", provider.RedirectUrl)
+	params.Set("scope", strings.Join(provider.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", getCodeChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchanges the authorization code for an ID token and returns its verified claims
+func (provider *OidcProvider) Exchange(code string, codeVerifier string, nonce string) (*OidcIdentity, error) {
+	metadata, err := provider.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", provider.RedirectUrl)
+	params.Set("client_id", provider.ClientId)
+	params.Set("code_verifier", codeVerifier)
+	if provider.ClientSecret != "" {
+		params.Set("client_secret", provider.ClientSecret)
+	}
+
+	response, err := oidcClient.PostForm(metadata.TokenEndpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var tokenResponse struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokenResponse)
+	if err != nil {
+		return nil, errors.New("failed to parse the token response: " + err.Error())
+	}
+	if response.StatusCode != http.StatusOK || tokenResponse.Error != "" {
+		return nil, errors.New("token request failed: " + tokenResponse.Error + " " + tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.IdToken == "" {
+		return nil, errors.New("the token response does not contain an ID token")
+	}
+
+	return provider.verifyIdToken(tokenResponse.IdToken, nonce)
+}
+
+func (provider *OidcProvider) verifyIdToken(idToken string, nonce string) (*OidcIdentity, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return provider.getKey(kid)
+	})
+	if err != nil {
+		return nil, errors.New("ID token verification failed: " + err.Error())
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("the ID token is invalid")
+	}
+
+	if issuer, _ := claims["iss"].(string); issuer != provider.Issuer {
+		return nil, errors.New("the ID token is issued by '" + issuer + "'")
+	}
+
+	if !isAudienceMatch(claims["aud"], provider.ClientId) {
+		return nil, errors.New("the ID token is issued for another client")
+	}
+
+	// jwt.Parse checks exp only if it is present
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("the ID token has no expiry")
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("the ID token nonce does not match")
+	}
+
+	var identity OidcIdentity
+	identity.Issuer = provider.Issuer
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+
+	// some providers send email_verified as a string
+	switch emailVerified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = emailVerified
+	case string:
+		identity.EmailVerified = emailVerified == "true"
+	}
+
+	if identity.Subject == "" {
+		return nil, errors.New("the ID token has no subject")
+	}
+	return &identity, nil
+}
+
+func isAudienceMatch(audience any, clientId string) bool {
+	switch audience := audience.(type) {
+	case string:
+		return audience == clientId
+	case []any:
+		return slices.Contains(audience, any(clientId))
+	}
+	return false
+}
+
+// Returns the signing key with the id, refetching the key set if the key is unknown
+func (provider *OidcProvider) getKey(kid string) (any, error) {
+	metadata, err := provider.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	key, ok := provider.keys[kid]
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(provider.keysFetchTime) < oidcKeysRefetchInterval {
+		return nil, errors.New("unknown signing key '" + kid + "'")
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = getOidcJson(metadata.JwksUri, &keySet)
+	if err != nil {
+		return nil, errors.New("failed to read the provider signing keys: " + err.Error())
+	}
+
+	provider.keys = make(map[string]any)
+	provider.keysFetchTime = time.Now()
+	for _, webKey := range keySet.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		publicKey, err := webKey.getPublicKey()
+		if err != nil {
+			continue // keys of unsupported types are skipped
+		}
+		provider.keys[webKey.Kid] = publicKey
+	}
+
+	key, ok = provider.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key '" + kid + "'")
+	}
+	return key, nil
+}
+
+func (webKey jsonWebKey) getPublicKey() (any, error) {
+	switch webKey.Kty {
+	case "RSA":
+		modulus, err := base64.RawURLEncoding.DecodeString(webKey.N)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := base64.RawURLEncoding.DecodeString(webKey.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch webKey.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + webKey.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(webKey.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(webKey.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.New("unsupported key type " + webKey.Kty)
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Identity provider issuing ID tokens for a single authorization code
+type mockIdp struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	code          string
+	codeChallenge string
+	// claims of the issued ID token, overriding the valid defaults
+	claims jwt.MapClaims
+	// issuer announced by the discovery document, the server URL if empty
+	metadataIssuer string
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdp{key: key, code: "test-code", claims: jwt.MapClaims{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(responseWriter http.ResponseWriter, request *http.Request) {
+		issuer := idp.metadataIssuer
+		if issuer == "" {
+			issuer = idp.server.URL
+		}
+		json.NewEncoder(responseWriter).Encode(oidcMetadata{
+			Issuer:                issuer,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JwksUri:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(responseWriter http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(responseWriter).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kid: "idp-key",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(responseWriter http.ResponseWriter, request *http.Request) {
+		request.ParseForm()
+		if request.Form.Get("code") != idp.code || getCodeChallenge(request.Form.Get("code_verifier")) != idp.codeChallenge {
+			responseWriter.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(responseWriter).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"sub":            "subject-1",
+			"aud":            "todopp",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "user@example.com",
+			"email_verified": true,
+		}
+		for name, value := range idp.claims {
+			claims[name] = value
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "idp-key"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(responseWriter).Encode(map[string]string{"id_token": idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// Starts a login like the browser would and returns the nonce and the code verifier
+func (idp *mockIdp) authorize(t *testing.T, provider *OidcProvider) (string, string) {
+	nonce, _ := GenerateOidcRandom()
+	codeVerifier, _ := GenerateOidcRandom()
+	authorizationUrl, err := provider.GetAuthorizationUrl("state", nonce, codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedUrl, err := url.Parse(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorizationUrl, idp.server.URL+"/authorize?") {
+		t.Fatalf("unexpected authorization endpoint %s", authorizationUrl)
+	}
+	query := parsedUrl.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("nonce") != nonce || query.Get("client_id") != "todopp" {
+		t.Fatalf("unexpected authorization parameters %v", query)
+	}
+	idp.codeChallenge = query.Get("code_challenge")
+	if _, ok := idp.claims["nonce"]; !ok {
+		idp.claims["nonce"] = nonce
+	}
+	return nonce, codeVerifier
+}
+
+func newTestProvider(idp *mockIdp) *OidcProvider {
+	return &OidcProvider{
+		Issuer:      idp.server.URL,
+		ClientId:    "todopp",
+		RedirectUrl: "https://todopp.test/api/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	}
+}
+
+func TestOidcExchange(t *testing.T) {
+	idp := newMockIdp(t)
+	provider := newTestProvider(idp)
+
+	nonce, codeVerifier := idp.authorize(t, provider)
+	identity, err := provider.Exchange(idp.code, codeVerifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Issuer != idp.server.URL || identity.Subject != "subject-1" || identity.Email != "user@example.com" || !identity.EmailVerified {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestOidcExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		codeVerifier string // replaces the verifier of the login if set
+	}{
+		{name: "wrong code verifier", codeVerifier: "another-verifier"},
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "another-nonce"}},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://attacker.test"}},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "another-client"}},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idp := newMockIdp(t)
+			for name, value := range test.claims {
+				idp.claims[name] = value
+			}
+			provider := newTestProvider(idp)
+
+			nonce, codeVerifier := idp.authorize(t, provider)
+			if test.codeVerifier != "" {
+				codeVerifier = test.codeVerifier
+			}
+			identity, err := provider.Exchange(idp.code, codeVerifier, nonce)
+			if err == nil {
+				t.Fatalf("the login was accepted: %+v", identity)
+			}
+			t.Log(err)
+		})
+	}
+}
+
+func TestOidcDiscoveryRejectsOtherIssuer(t *testing.T) {
+	idp := newMockIdp(t)
+	idp.metadataIssuer = "https://attacker.test"
+	provider := newTestProvider(idp)
+
+	_, err := provider.GetAuthorizationUrl("state", "nonce", "verifier")
+	if err == nil {
+		t.Fatal("the configuration of another issuer was accepted")
+	}
+}
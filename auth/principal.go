@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"todopp/store"
+	"todopp/util"
+)
+
+const AccessTokenPrefix = "tpp_"
+
+// Scopes of personal access tokens. Browser sessions are not limited by scopes
+const (
+	ScopeRead       = "read"        // GET requests only
+	ScopeTasksWrite = "tasks:write" // read plus task events and attachments
+	ScopeAdmin      = "admin"       // everything a browser session can do
+)
+
+var Scopes = []string{ScopeRead, ScopeTasksWrite, ScopeAdmin}
+
+// The authenticated caller of a request: a browser session or a personal access token
+type Principal struct {
+	Login     string
+	SessionId string   // set for browser sessions
+	TokenId   string   // set for personal access tokens
+	Scopes    []string // scopes of the personal access token
+	Expire    int64    // expiry of the token in UnixMilli, 0 if it doesn't expire
+}
+
+func (principal Principal) IsAccessToken() bool {
+	return principal.TokenId != ""
+}
+
+// Reports whether the principal has the scope. Browser sessions have all scopes,
+// "admin" implies all other scopes and "tasks:write" implies "read"
+func (principal Principal) HasScope(scope string) bool {
+	if !principal.IsAccessToken() || slices.Contains(principal.Scopes, ScopeAdmin) {
+		return true
+	}
+	if scope == ScopeRead && slices.Contains(principal.Scopes, ScopeTasksWrite) {
+		return true
+	}
+	return slices.Contains(principal.Scopes, scope)
+}
+
+// Reports whether the principal may send the websocket event type
+func (principal Principal) CanSendEvent(eventType string) bool {
+	if principal.HasScope(ScopeAdmin) {
+		return true
+	}
+	return strings.HasPrefix(eventType, "task-") && principal.HasScope(ScopeTasksWrite)
+}
+
+// Generates a personal access token and returns it along with the hash to be stored
+func CreateAccessToken() (string, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+
+	token := AccessTokenPrefix + base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(key)
+	return token, HashToken(token), nil
+}
+
+// Parses a comma separated list of scopes and checks that all of them are known
+func ParseScopes(scopes string) ([]string, error) {
+	var parsedScopes []string
+	for _, scope := range strings.Split(scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(Scopes, scope) {
+			return nil, errors.New("unknown scope '" + scope + "'")
+		}
+		if !slices.Contains(parsedScopes, scope) {
+			parsedScopes = append(parsedScopes, scope)
+		}
+	}
+	if len(parsedScopes) == 0 {
+		return nil, errors.New("at least one scope must be defined")
+	}
+	return parsedScopes, nil
+}
+
+// Verifies a bearer token, which is either a session JWT or a personal access token
+func Authenticate(tokenString string) (*Principal, error) {
+	if !strings.HasPrefix(tokenString, AccessTokenPrefix) {
+		login, sessionId, expire, err := verifyJwtSession(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{Login: login, SessionId: sessionId, Expire: expire}, nil
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	accessToken, err := store.GetAccessTokenByHash(db, HashToken(tokenString))
+	if err != nil {
+		return nil, err
+	}
+	if accessToken == nil || accessToken.IsRevoked != 0 {
+		return nil, errors.New("the provided access token is invalid")
+	}
+
+	now := time.Now().UTC().UnixMilli()
+	if accessToken.Expire != 0 && accessToken.Expire <= now {
+		return nil, errors.New("the provided access token is expired")
+	}
+
+	login, err := store.GetUserLoginById(db, accessToken.UserId)
+	if err != nil || !store.IsUserExistsAndActive(db, login) {
+		return nil, errors.New("the provided access token is invalid: user not active")
+	}
+
+	err = store.SetAccessTokenLastUsed(db, accessToken.TokenId, now)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := ParseScopes(accessToken.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{Login: login, TokenId: accessToken.TokenId, Scopes: scopes, Expire: accessToken.Expire}, nil
+}
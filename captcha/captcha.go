@@ -0,0 +1,128 @@
+package captcha
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"todopp/util"
+)
+
+const (
+	ProviderHcaptcha = "hcaptcha"
+	ProviderPow      = "pow"
+	ProviderDisabled = "disabled"
+)
+
+// site key used before it became configurable
+const defaultHcaptchaSiteKey = "f1d8ae8c-549a-43dc-a636-8a82ae0aaed8"
+
+// What the client needs to solve a captcha
+type Challenge struct {
+	Provider   string `json:"provider"`
+	SiteKey    string `json:"sitekey,omitempty"`    // hcaptcha
+	Challenge  string `json:"challenge,omitempty"`  // pow
+	Difficulty int    `json:"difficulty,omitempty"` // pow
+}
+
+type Provider interface {
+	// Returns the data the client needs to solve a captcha
+	NewChallenge() (*Challenge, error)
+	// Reports whether the client response is a solved captcha
+	Verify(response string, remoteIp string) (bool, error)
+}
+
+var provider Provider
+var providerMutex sync.Mutex
+
+// Returns the provider selected by the captchaProvider setting
+func GetProvider() (Provider, error) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+
+	if provider != nil {
+		return provider, nil
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.CaptchaProvider {
+	case ProviderDisabled:
+		provider = Disabled{}
+	case ProviderPow:
+		provider, err = NewProofOfWork(config.CaptchaPowDifficulty)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		siteKey := config.HcaptchaSiteKey
+		if siteKey == "" {
+			siteKey = defaultHcaptchaSiteKey
+		}
+		provider = Hcaptcha{Secret: config.CaptchaSecret, SiteKey: siteKey}
+	}
+	return provider, nil
+}
+
+// Accepts any response, for installations without captcha
+type Disabled struct{}
+
+func (Disabled) NewChallenge() (*Challenge, error) {
+	return &Challenge{Provider: ProviderDisabled}, nil
+}
+
+func (Disabled) Verify(response string, remoteIp string) (bool, error) {
+	return true, nil
+}
+
+// Verifies responses with the hCaptcha service
+type Hcaptcha struct {
+	Secret  string
+	SiteKey string
+}
+
+type hCaptchaResponse struct {
+	Success     bool     `json:"success"`
+	ChallengeTS string   `json:"challenge_ts"` // timestamp
+	Hostname    string   `json:"hostname"`     // site's domain
+	ErrorCodes  []string `json:"error-codes"`  // optional errors
+}
+
+var hcaptchaClient = &http.Client{Timeout: 10 * time.Second}
+
+func (hcaptcha Hcaptcha) NewChallenge() (*Challenge, error) {
+	return &Challenge{Provider: ProviderHcaptcha, SiteKey: hcaptcha.SiteKey}, nil
+}
+
+func (hcaptcha Hcaptcha) Verify(response string, remoteIp string) (bool, error) {
+	values := url.Values{
+		"secret":   {hcaptcha.Secret},
+		"response": {response},
+	}
+	if remoteIp != "" {
+		values.Set("remoteip", remoteIp)
+	}
+
+	resp, err := hcaptchaClient.PostForm("https://hcaptcha.com/siteverify", values)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	var hCaptcha hCaptchaResponse
+	if err := json.Unmarshal(body, &hCaptcha); err != nil {
+		return false, err
+	}
+
+	return hCaptcha.Success, nil
+}
@@ -0,0 +1,124 @@
+package captcha
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPowDifficulty = 16
+const maxPowDifficulty = 32
+const powChallengeTtl = 5 * time.Minute
+
+// Self-hosted captcha: the client has to find a counter such that SHA-256("<challenge>:<counter>")
+// starts with the given number of zero bits. Challenges are signed, so the server keeps no state
+// except the solved challenges which must not be accepted twice
+type ProofOfWork struct {
+	Difficulty int
+
+	key   []byte
+	used  map[string]time.Time // solved challenges by expiry
+	mutex sync.Mutex
+}
+
+func NewProofOfWork(difficulty int) (*ProofOfWork, error) {
+	if difficulty <= 0 {
+		difficulty = defaultPowDifficulty
+	}
+	if difficulty > maxPowDifficulty {
+		difficulty = maxPowDifficulty
+	}
+
+	// outstanding challenges become invalid on restart, which only costs the client a new challenge
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &ProofOfWork{Difficulty: difficulty, key: key, used: make(map[string]time.Time)}, nil
+}
+
+func (pow *ProofOfWork) sign(payload string) string {
+	mac := hmac.New(sha256.New, pow.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The challenge is "<random>.<expire>.<difficulty>.<signature>"
+func (pow *ProofOfWork) NewChallenge() (*Challenge, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(nonce) + "." +
+		strconv.FormatInt(time.Now().Add(powChallengeTtl).Unix(), 10) + "." +
+		strconv.Itoa(pow.Difficulty)
+
+	return &Challenge{Provider: ProviderPow, Challenge: payload + "." + pow.sign(payload), Difficulty: pow.Difficulty}, nil
+}
+
+// The response is "<challenge>:<counter>"
+func (pow *ProofOfWork) Verify(response string, remoteIp string) (bool, error) {
+	challenge, counter, ok := strings.Cut(response, ":")
+	if !ok {
+		return false, nil
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return false, nil
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(pow.sign(payload)), []byte(parts[3])) {
+		return false, nil
+	}
+
+	expire, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return false, nil
+	}
+
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil || !hasLeadingZeroBits(sha256.Sum256([]byte(challenge+":"+counter)), difficulty) {
+		return false, nil
+	}
+
+	pow.mutex.Lock()
+	defer pow.mutex.Unlock()
+
+	now := time.Now()
+	for usedChallenge, usedExpire := range pow.used {
+		if now.After(usedExpire) {
+			delete(pow.used, usedChallenge)
+		}
+	}
+
+	if _, isUsed := pow.used[challenge]; isUsed {
+		return false, nil
+	}
+	pow.used[challenge] = time.Unix(expire, 0)
+	return true, nil
+}
+
+func hasLeadingZeroBits(hash [32]byte, difficulty int) bool {
+	for offset := 0; difficulty > 0; offset += 8 {
+		value := binary.BigEndian.Uint64(hash[offset : offset+8])
+		if difficulty < 64 {
+			return bits.LeadingZeros64(value) >= difficulty
+		}
+		if value != 0 {
+			return false
+		}
+		difficulty -= 64
+	}
+	return true
+}
@@ -0,0 +1,396 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"todopp/event"
+	"todopp/store"
+	"todopp/util"
+)
+
+const usage = `Usage:
+  todopp task add -login <login> (-group <group> | -project <project>) [-after <task>] <text>
+  todopp task list -login <login> [-project <project>]
+  todopp task done -login <login> <task id>
+  todopp task rm -login <login> <task id>
+  todopp project ls -login <login>
+  todopp group mv -login <login> -project <project> [-after <group>] <group>
+  todopp user activate -login <login>
+  todopp user deactivate -login <login>
+  todopp key ls
+  todopp key rotate
+  todopp key retire <key id>
+
+Projects and groups may be referenced by id or by name.
+The login may also be provided with the TODOPP_LOGIN environment variable.
+Open browser sessions pick up the changes on the next reload.
+Connections of deactivated users are closed within a minute.
+Rotated keys keep verifying tokens for jwtKeyGraceMinutes, retired keys are rejected within a minute.`
+
+var taskStatusNames = map[int]string{
+	1: "to do",
+	2: "in progress",
+	3: "done",
+	4: "cancelled",
+	5: "deleted",
+}
+
+// Reports whether the command line argument is a cli subcommand
+func IsCommand(command string) bool {
+	return command == "task" || command == "project" || command == "group" || command == "key" || command == "user"
+}
+
+// Runs a subcommand such as "task add" directly against the database
+func Run(config *util.Config, args []string) error {
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+
+	if args[0] == "key" {
+		return runKeyCommand(config, args)
+	}
+
+	flags := flag.NewFlagSet(args[0]+" "+args[1], flag.ContinueOnError)
+	login := flags.String("login", os.Getenv("TODOPP_LOGIN"), "User login")
+	projectRef := flags.String("project", "", "Project id or name")
+	groupRef := flags.String("group", "", "Group id or name")
+	after := flags.String("after", "", "Id or name of the item to place the new one after")
+	flags.Usage = func() { fmt.Fprintln(flags.Output(), usage) }
+
+	err := flags.Parse(args[2:])
+	if err != nil {
+		return err
+	}
+
+	if *login == "" {
+		return errors.New("user login must be defined")
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, *login)
+	if err != nil {
+		return err
+	}
+	if userId == "" {
+		return errors.New("login '" + *login + "' is not registered")
+	}
+
+	command := args[0] + " " + args[1]
+	switch command {
+	case "task add":
+		return addTask(db, userId, *projectRef, *groupRef, *after, strings.Join(flags.Args(), " "))
+	case "task list", "task ls":
+		return listTasks(db, userId, *projectRef)
+	case "task done":
+		return setTaskStatus(db, userId, flags.Arg(0), 3)
+	case "task rm":
+		return deleteTask(db, userId, flags.Arg(0))
+	case "project ls", "project list":
+		return listProjects(db, userId)
+	case "group mv":
+		return moveGroup(db, userId, flags.Arg(0), *projectRef, *after)
+	case "user activate":
+		err = store.ActivateUser(db, userId)
+		if err != nil {
+			return err
+		}
+		return store.ReactivateUser(db, userId)
+	case "user deactivate":
+		return store.DeactivateUser(db, userId)
+	default:
+		return errors.New("unknown command '" + command + "'\n" + usage)
+	}
+}
+
+func addTask(db *sql.DB, userId string, projectRef string, groupRef string, after string, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("task text must be defined")
+	}
+
+	var group *store.TaskGroup
+	var err error
+
+	switch {
+	case groupRef != "":
+		group, err = findGroup(db, userId, projectRef, groupRef)
+	case projectRef != "":
+		project, err := findProject(db, userId, projectRef)
+		if err != nil {
+			return err
+		}
+		groups, err := store.GetTaskGroups(db, project.ProjectId)
+		if err != nil {
+			return err
+		}
+		if len(groups) == 0 {
+			return errors.New("project '" + project.Name + "' has no groups")
+		}
+		group = &groups[0]
+	default:
+		return errors.New("group or project must be defined")
+	}
+	if err != nil {
+		return err
+	}
+
+	afterTaskId := ""
+	if after != "" {
+		for _, task := range group.Tasks {
+			if task.TaskId == after || task.Name == after {
+				afterTaskId = task.TaskId
+			}
+		}
+		if afterTaskId == "" {
+			return errors.New("task '" + after + "' not found in group '" + group.Name + "'")
+		}
+	}
+
+	taskId := util.Uuid()
+	err = processEvent(db, userId, "task-add", event.TaskPayload{
+		Id:     taskId,
+		Text:   text,
+		Group:  group.TaskGroupId,
+		Status: "1",
+		After:  afterTaskId,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(taskId)
+	return nil
+}
+
+func listTasks(db *sql.DB, userId string, projectRef string) error {
+	var projects []store.Project
+
+	if projectRef != "" {
+		project, err := findProject(db, userId, projectRef)
+		if err != nil {
+			return err
+		}
+		projects = append(projects, *project)
+	} else {
+		var err error
+		projects, err = store.GetProjects(db, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tPROJECT\tGROUP\tSTATUS\tTEXT")
+	for _, project := range projects {
+		groups, err := store.GetTaskGroups(db, project.ProjectId)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			for _, task := range group.Tasks {
+				text := strings.ReplaceAll(task.Name, "\n", " ")
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", task.TaskId, project.Name, group.Name, taskStatusNames[task.TaskStatusId], text)
+			}
+		}
+	}
+	return writer.Flush()
+}
+
+func setTaskStatus(db *sql.DB, userId string, taskId string, taskStatusId int) error {
+	task, err := findTask(db, userId, taskId)
+	if err != nil {
+		return err
+	}
+
+	afterTaskId, err := getPreviousTaskId(db, *task)
+	if err != nil {
+		return err
+	}
+
+	return processEvent(db, userId, "task-update", event.TaskPayload{
+		Id:     task.TaskId,
+		Text:   task.Name,
+		Group:  task.TaskGroupId,
+		Status: strconv.Itoa(taskStatusId),
+		After:  afterTaskId,
+	})
+}
+
+func deleteTask(db *sql.DB, userId string, taskId string) error {
+	task, err := findTask(db, userId, taskId)
+	if err != nil {
+		return err
+	}
+
+	return processEvent(db, userId, "task-delete", event.TaskPayload{Id: task.TaskId, Group: task.TaskGroupId})
+}
+
+func listProjects(db *sql.DB, userId string) error {
+	projects, err := store.GetProjects(db, userId)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tGROUPS")
+	for _, project := range projects {
+		groups, err := store.GetTaskGroups(db, project.ProjectId)
+		if err != nil {
+			return err
+		}
+		var groupNames []string
+		for _, group := range groups {
+			groupNames = append(groupNames, group.Name)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", project.ProjectId, project.Name, strings.Join(groupNames, ", "))
+	}
+	return writer.Flush()
+}
+
+func moveGroup(db *sql.DB, userId string, groupRef string, projectRef string, after string) error {
+	if groupRef == "" || projectRef == "" {
+		return errors.New("group and target project must be defined")
+	}
+
+	group, err := findGroup(db, userId, "", groupRef)
+	if err != nil {
+		return err
+	}
+
+	project, err := findProject(db, userId, projectRef)
+	if err != nil {
+		return err
+	}
+
+	afterGroupId := ""
+	if after != "" {
+		afterGroup, err := findGroup(db, userId, project.ProjectId, after)
+		if err != nil {
+			return err
+		}
+		afterGroupId = afterGroup.TaskGroupId
+	}
+
+	return processEvent(db, userId, "group-update", event.GroupPayload{
+		Id:        group.TaskGroupId,
+		Name:      group.Name,
+		ProjectId: project.ProjectId,
+		After:     afterGroupId,
+	})
+}
+
+// Processes the event like the server does and records it in the event log
+func processEvent(db *sql.DB, userId string, eventType string, payload any) error {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	appEvent := event.Event{Type: eventType, Payload: payloadJson}
+	err = event.ProcessUserEvent(db, userId, appEvent)
+	if err != nil {
+		return err
+	}
+
+	responce, err := json.Marshal(appEvent)
+	if err != nil {
+		return err
+	}
+
+	var eventStore store.Event
+	eventStore.EventId = util.Uuid()
+	eventStore.Payload = string(payloadJson)
+	eventStore.UserId = userId
+	eventStore.UtcTime = time.Now().UTC().UnixMilli()
+	eventStore.IsError = 0
+	eventStore.Responce = string(responce)
+	return store.InsertEvent(db, eventStore)
+}
+
+func findProject(db *sql.DB, userId string, projectRef string) (*store.Project, error) {
+	projects, err := store.GetProjects(db, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, project := range projects {
+		if project.ProjectId == projectRef || project.Name == projectRef {
+			return &project, nil
+		}
+	}
+	return nil, errors.New("project '" + projectRef + "' not found")
+}
+
+// Looks for the group in the given project, or in all projects of the user if projectRef is empty
+func findGroup(db *sql.DB, userId string, projectRef string, groupRef string) (*store.TaskGroup, error) {
+	var projects []store.Project
+
+	if projectRef != "" {
+		project, err := findProject(db, userId, projectRef)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, *project)
+	} else {
+		var err error
+		projects, err = store.GetProjects(db, userId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, project := range projects {
+		groups, err := store.GetTaskGroups(db, project.ProjectId)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			if group.TaskGroupId == groupRef || group.Name == groupRef {
+				return &group, nil
+			}
+		}
+	}
+	return nil, errors.New("group '" + groupRef + "' not found")
+}
+
+func findTask(db *sql.DB, userId string, taskId string) (*store.Task, error) {
+	if taskId == "" {
+		return nil, errors.New("task id must be defined")
+	}
+
+	taskUserId, err := store.GetTaskUserId(db, taskId)
+	if err != nil || taskUserId != userId {
+		return nil, errors.New("task '" + taskId + "' not found")
+	}
+
+	return store.GetTask(db, taskId)
+}
+
+// Returns the id of the task placed before the given one, so updates keep the task position
+func getPreviousTaskId(db *sql.DB, task store.Task) (string, error) {
+	tasks, err := store.GetTasksByGroup(db, task.TaskGroupId)
+	if err != nil {
+		return "", err
+	}
+
+	previousTaskId := ""
+	for _, task_i := range tasks {
+		if task_i.TaskId == task.TaskId {
+			break
+		}
+		previousTaskId = task_i.TaskId
+	}
+	return previousTaskId, nil
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"todopp/auth"
+	"todopp/store"
+	"todopp/util"
+)
+
+// Runs the jwt signing key subcommands, which act on the whole installation rather than a user
+func runKeyCommand(config *util.Config, args []string) error {
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	command := args[0] + " " + args[1]
+	switch command {
+	case "key ls", "key list":
+		return listJwtKeys(db)
+	case "key rotate":
+		jwtKey, err := auth.RotateJwtKey(db)
+		if err != nil {
+			return err
+		}
+		fmt.Println("New signing key " + jwtKey.Kid + ", the previous keys are retired after the grace period")
+		return nil
+	case "key retire":
+		if len(args) < 3 || args[2] == "" {
+			return errors.New("key id must be defined")
+		}
+		err = auth.RetireJwtKey(db, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Println("Key " + args[2] + " is retired, tokens signed with it are rejected")
+		return nil
+	default:
+		return errors.New("unknown command '" + command + "'\n" + usage)
+	}
+}
+
+func listJwtKeys(db *sql.DB) error {
+	jwtKeys, err := store.GetJwtKeys(db)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "KID\tALGORITHM\tCREATED\tSTATUS")
+	for index, jwtKey := range jwtKeys {
+		status := "verifying"
+		if index == 0 && jwtKey.RetireAt == 0 {
+			status = "signing"
+		} else if jwtKey.RetireAt != 0 && jwtKey.RetireAt <= now.UnixMilli() {
+			status = "retired " + formatKeyTime(jwtKey.RetireAt)
+		} else if jwtKey.RetireAt != 0 {
+			status = "retires " + formatKeyTime(jwtKey.RetireAt)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", jwtKey.Kid, jwtKey.Algorithm, formatKeyTime(jwtKey.Created), status)
+	}
+	return writer.Flush()
+}
+
+func formatKeyTime(utcTime int64) string {
+	if utcTime == 0 {
+		return "-"
+	}
+	return time.UnixMilli(utcTime).Local().Format("2006-01-02 15:04")
+}
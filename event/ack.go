@@ -0,0 +1,123 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Machine-readable codes of rejected events
+const (
+	ErrorCodeInvalidEvent   = "invalid_event"
+	ErrorCodeUnauthorized   = "unauthorized"
+	ErrorCodeForbidden      = "forbidden"
+	ErrorCodeUnknownType    = "unknown_type"
+	ErrorCodeInvalidPayload = "invalid_payload"
+	ErrorCodeTooLarge       = "too_large"
+	ErrorCodeNotFound       = "not_found" // a referenced entity doesn't exist or belongs to another user
+	ErrorCodeRejected       = "rejected"  // the change could not be stored
+)
+
+// Error of an event carrying the code sent to the client in the nack
+type EventError struct {
+	Code    string
+	Message string
+	Entity  *Entity // set if the error concerns another entity than the one of the event, e.g. in a batch
+}
+
+func (err *EventError) Error() string {
+	return err.Message
+}
+
+func NewEventError(code string, message string) error {
+	return &EventError{Code: code, Message: message}
+}
+
+// Returns the code of the error, errors without one are storage failures
+func GetErrorCode(err error) string {
+	var eventError *EventError
+	if errors.As(err, &eventError) {
+		return eventError.Code
+	}
+	return ErrorCodeRejected
+}
+
+// The project, group, task or attachment an event is about
+type Entity struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type AckPayload struct {
+	EventType string `json:"eventtype"`
+	Entity    Entity `json:"entity"`
+}
+
+type NackPayload struct {
+	EventType string `json:"eventtype"`
+	Entity    Entity `json:"entity"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// Reply to the client which sent an event with a request id
+type AckEvent struct {
+	Type      string `json:"type"` // "ack" or "nack"
+	RequestId string `json:"requestid"`
+	Instance  string `json:"instance"`
+	Payload   any    `json:"payload"`
+}
+
+func GetEntity(event Event) Entity {
+	entityType, _, _ := strings.Cut(event.Type, "-")
+
+	var payload struct {
+		Id string `json:"id"`
+	}
+	json.Unmarshal(event.Payload, &payload)
+	return Entity{Type: entityType, Id: payload.Id}
+}
+
+func GetAckMessage(event Event) ([]byte, error) {
+	return json.Marshal(AckEvent{
+		Type:      "ack",
+		RequestId: event.RequestId,
+		Instance:  event.Instance,
+		Payload:   AckPayload{EventType: event.Type, Entity: GetEntity(event)},
+	})
+}
+
+func GetNackMessage(event Event, err error) ([]byte, error) {
+	entity := GetEntity(event)
+	var eventError *EventError
+	if errors.As(err, &eventError) && eventError.Entity != nil {
+		entity = *eventError.Entity
+	}
+
+	return json.Marshal(AckEvent{
+		Type:      "nack",
+		RequestId: event.RequestId,
+		Instance:  event.Instance,
+		Payload: NackPayload{
+			EventType: event.Type,
+			Entity:    entity,
+			Code:      GetErrorCode(err),
+			Message:   err.Error(),
+		},
+	})
+}
+
+// Returns the error event describing why the event was rejected
+func GetRejectionMessage(event Event, err error) ([]byte, error) {
+	errorPayload := ErrorPayload{Code: GetErrorCode(err), Message: err.Error()}
+	errorEvent := ErrorEvent{Type: "error", Instance: event.Instance, Jwt: "", Payload: errorPayload}
+	return json.Marshal(errorEvent)
+}
+
+func unmarshalPayload(payload json.RawMessage, value any) error {
+	err := json.Unmarshal(payload, value)
+	if err != nil {
+		return NewEventError(ErrorCodeInvalidPayload, "invalid payload: "+err.Error())
+	}
+	return nil
+}
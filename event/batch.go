@@ -0,0 +1,110 @@
+package event
+
+import (
+	"encoding/json"
+	"strconv"
+	"todopp/store"
+	"todopp/util"
+)
+
+const BatchEventType = "batch"
+
+// Limits of a batch, its events have the limits of their own types as well
+const (
+	maxBatchEvents      = 500
+	maxBatchPayloadSize = 1 << 20
+)
+
+// Events applied together: all of them in order, or none
+type BatchPayload struct {
+	Events []Event `json:"events"`
+}
+
+// Applies the events of the batch in order in one transaction. The first failing event rolls all of them back
+func applyBatch(ctx *Context, batch BatchPayload) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for index, batchEvent := range batch.Events {
+		err = process(&Context{Db: tx, UserId: ctx.UserId, Event: batchEvent})
+		if err != nil {
+			tx.Rollback()
+			return getBatchError(index, batchEvent, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func validateBatch(ctx *Context, batch BatchPayload) error {
+	if len(batch.Events) == 0 {
+		return invalidPayload("events are required")
+	}
+	if len(batch.Events) > maxBatchEvents {
+		return NewEventError(ErrorCodeTooLarge, "a batch must not contain more than "+strconv.Itoa(maxBatchEvents)+" events")
+	}
+	for index, batchEvent := range batch.Events {
+		if batchEvent.Type == BatchEventType {
+			return getBatchError(index, batchEvent, invalidPayload("batches can't be nested"))
+		}
+		if !IsEventType(batchEvent.Type) {
+			return getBatchError(index, batchEvent, NewEventError(ErrorCodeUnknownType, "unknown event type '"+batchEvent.Type+"'"))
+		}
+	}
+	return nil
+}
+
+// Points the error at the event of the batch which caused it
+func getBatchError(index int, batchEvent Event, err error) error {
+	entity := GetEntity(batchEvent)
+	return &EventError{
+		Code:    GetErrorCode(err),
+		Message: "event " + strconv.Itoa(index) + " (" + batchEvent.Type + "): " + err.Error(),
+		Entity:  &entity,
+	}
+}
+
+// Returns the events of a batch, or the event itself if it is not a batch
+func GetBatchEvents(event Event) ([]Event, error) {
+	if event.Type != BatchEventType {
+		return []Event{event}, nil
+	}
+	var batch BatchPayload
+	err := unmarshalPayload(event.Payload, &batch)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Events, nil
+}
+
+// Returns the event as it is stored and sent to the clients, without tokens and request ids
+func GetBroadcastEvent(event Event) (Event, error) {
+	event.Jwt = ""
+	event.RequestId = ""
+	if event.Type != BatchEventType {
+		return event, nil
+	}
+
+	batchEvents, err := GetBatchEvents(event)
+	if err != nil {
+		return event, err
+	}
+	for index := range batchEvents {
+		batchEvents[index].Jwt = ""
+		batchEvents[index].RequestId = ""
+	}
+	event.Payload, err = json.Marshal(BatchPayload{Events: batchEvents})
+	return event, err
+}
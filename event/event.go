@@ -2,16 +2,15 @@ package event
 
 import (
 	"encoding/json"
-	"todopp/auth"
 	"todopp/store"
-	"todopp/util"
 )
 
 type Event struct {
-	Type     string          `json:"type"`
-	Instance string          `json:"instance"`
-	Jwt      string          `json:"jwt"`
-	Payload  json.RawMessage `json:"payload"`
+	Type      string          `json:"type"`
+	Instance  string          `json:"instance"`
+	RequestId string          `json:"requestid,omitempty"` // generated by the client to match the ack or nack
+	Jwt       string          `json:"jwt"`
+	Payload   json.RawMessage `json:"payload"`
 }
 
 type ErrorEvent struct {
@@ -22,6 +21,7 @@ type ErrorEvent struct {
 }
 
 type ErrorPayload struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
@@ -31,6 +31,7 @@ type TaskPayload struct {
 	Group  string `json:"group"`
 	Status string `json:"status"`
 	After  string `json:"after"`
+	Due    *int64 `json:"due,omitempty"`
 }
 
 type ProjectPayload struct {
@@ -45,6 +46,14 @@ type GroupPayload struct {
 	After     string `json:"after"`
 }
 
+type AttachmentPayload struct {
+	Id          string `json:"id"`
+	Task        string `json:"task"`
+	Name        string `json:"name"`
+	ContentType string `json:"contenttype"`
+	Size        int64  `json:"size"`
+}
+
 func GetErrorMessage(message string, instance string) ([]byte, error) {
 	errorPayload := ErrorPayload{Message: message}
 	errorEvent := ErrorEvent{Type: "error", Instance: instance, Jwt: "", Payload: errorPayload}
@@ -52,119 +61,37 @@ func GetErrorMessage(message string, instance string) ([]byte, error) {
 	return responce, err
 }
 
-func ProcessEvent(event Event) error {
+func init() {
+	Use(measureEvents)
+	Use(logEvents)
+	Use(limitPayloadSize)
 
-	login, err := auth.VerifyJwtAndGetLogin(event.Jwt)
-	if err != nil {
-		return err
-	}
+	Register("project-add", saveProject)
+	Before("project-add", validateProjectAdd)
+	Register("project-update", saveProject)
+	Before("project-update", validateProjectUpdate)
+	Register("project-delete", removeProject)
+	Before("project-delete", validateProjectDelete)
 
-	config, err := util.GetConfig()
-	if err != nil {
-		return err
-	}
+	Register("group-add", saveGroup)
+	Before("group-add", validateGroupAdd)
+	Register("group-update", saveGroup)
+	Before("group-update", validateGroupUpdate)
+	Register("group-delete", removeGroup)
+	Before("group-delete", validateGroupDelete)
 
-	db, err := store.OpenDb(config.DbPath)
-	if err != nil {
-		return err
-	}
+	Register("task-add", saveTask)
+	Before("task-add", validateTaskAdd)
+	Register("task-update", saveTask)
+	Before("task-update", validateTaskUpdate)
+	Register("task-delete", removeTask)
+	Before("task-delete", validateTaskDelete)
 
-	userId, err := store.GetUserIdByLogin(db, login)
-	if err != nil {
-		return err
-	}
+	Register(BatchEventType, applyBatch)
+	Before(BatchEventType, validateBatch)
+}
 
-	switch event.Type {
-	case "project-add":
-		var projectPayload ProjectPayload
-		err := json.Unmarshal(event.Payload, &projectPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertProject(db, projectPayload, userId)
-		if err != nil {
-			return err
-		}
-	case "project-delete":
-		var projectPayload ProjectPayload
-		err := json.Unmarshal(event.Payload, &projectPayload)
-		if err != nil {
-			return err
-		}
-		err = deleteProject(db, projectPayload)
-		if err != nil {
-			return err
-		}
-	case "project-update":
-		var projectPayload ProjectPayload
-		err := json.Unmarshal(event.Payload, &projectPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertProject(db, projectPayload, userId)
-		if err != nil {
-			return err
-		}
-	case "group-add":
-		var groupPayload GroupPayload
-		err := json.Unmarshal(event.Payload, &groupPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertGroup(db, groupPayload)
-		if err != nil {
-			return err
-		}
-	case "group-delete":
-		var groupPayload GroupPayload
-		err := json.Unmarshal(event.Payload, &groupPayload)
-		if err != nil {
-			return err
-		}
-		err = deleteGroup(db, groupPayload)
-		if err != nil {
-			return err
-		}
-	case "group-update":
-		var groupPayload GroupPayload
-		err := json.Unmarshal(event.Payload, &groupPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertGroup(db, groupPayload)
-		if err != nil {
-			return err
-		}
-	case "task-add":
-		var taskPayload TaskPayload
-		err := json.Unmarshal(event.Payload, &taskPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertTask(db, taskPayload)
-		if err != nil {
-			return err
-		}
-	case "task-delete":
-		var taskPayload TaskPayload
-		err := json.Unmarshal(event.Payload, &taskPayload)
-		if err != nil {
-			return err
-		}
-		err = deleteTask(db, taskPayload)
-		if err != nil {
-			return err
-		}
-	case "task-update":
-		var taskPayload TaskPayload
-		err := json.Unmarshal(event.Payload, &taskPayload)
-		if err != nil {
-			return err
-		}
-		err = upsertTask(db, taskPayload)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// Processes an event on behalf of an already authenticated user
+func ProcessUserEvent(db store.Querier, userId string, event Event) error {
+	return process(&Context{Db: db, UserId: userId, Event: event})
 }
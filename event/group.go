@@ -1,11 +1,10 @@
 package event
 
 import (
-	"database/sql"
 	"todopp/store"
 )
 
-func upsertGroup(db *sql.DB, group GroupPayload) error {
+func upsertGroup(db store.Querier, group GroupPayload) error {
 	var storeGroup store.TaskGroup
 
 	storeGroup.TaskGroupId = group.Id
@@ -60,7 +59,15 @@ func upsertGroup(db *sql.DB, group GroupPayload) error {
 	return nil
 }
 
-func deleteGroup(db *sql.DB, group GroupPayload) error {
+func deleteGroup(db store.Querier, group GroupPayload) error {
 	err := store.DeleteTaskGroup(db, group.Id)
 	return err
 }
+
+func saveGroup(ctx *Context, group GroupPayload) error {
+	return upsertGroup(ctx.Db, group)
+}
+
+func removeGroup(ctx *Context, group GroupPayload) error {
+	return deleteGroup(ctx.Db, group)
+}
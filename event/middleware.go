@@ -0,0 +1,100 @@
+package event
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"todopp/util"
+)
+
+type EventTypeMetrics struct {
+	Type          string  `json:"type"`
+	Processed     int64   `json:"processed"`
+	Failed        int64   `json:"failed"`
+	AverageTimeMs float64 `json:"averagetimems"`
+}
+
+type eventTypeCounters struct {
+	processed int64
+	failed    int64
+	nanos     int64
+}
+
+var metricsLock sync.Mutex
+var eventTypeCounts = map[string]*eventTypeCounters{}
+
+// Counts the events of each registered type with their failures and processing time
+func measureEvents(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) error {
+		start := time.Now()
+		err := next(ctx)
+		if !IsEventType(ctx.Event.Type) {
+			return err // unknown types would let clients grow the map
+		}
+
+		metricsLock.Lock()
+		counters, ok := eventTypeCounts[ctx.Event.Type]
+		if !ok {
+			counters = &eventTypeCounters{}
+			eventTypeCounts[ctx.Event.Type] = counters
+		}
+		counters.processed++
+		if err != nil {
+			counters.failed++
+		}
+		counters.nanos += int64(time.Since(start))
+		metricsLock.Unlock()
+		return err
+	}
+}
+
+func GetEventTypeMetrics() []EventTypeMetrics {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	metrics := []EventTypeMetrics{}
+	for eventType, counters := range eventTypeCounts {
+		metrics = append(metrics, EventTypeMetrics{
+			Type:          eventType,
+			Processed:     counters.processed,
+			Failed:        counters.failed,
+			AverageTimeMs: float64(counters.nanos) / float64(counters.processed) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Type < metrics[j].Type })
+	return metrics
+}
+
+// Prints every event with its result if enabled in the config
+func logEvents(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) error {
+		config, err := util.GetConfig()
+		if err != nil || !config.LogEvents {
+			return next(ctx)
+		}
+
+		start := time.Now()
+		err = next(ctx)
+		if err != nil {
+			fmt.Println("Event", ctx.Event.Type, "of user", ctx.UserId, "rejected after", time.Since(start), "("+GetErrorCode(err)+"):", err)
+		} else {
+			fmt.Println("Event", ctx.Event.Type, "of user", ctx.UserId, "processed in", time.Since(start))
+		}
+		return err
+	}
+}
+
+func limitPayloadSize(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context) error {
+		limit := maxPayloadSize
+		if ctx.Event.Type == BatchEventType {
+			limit = maxBatchPayloadSize
+		}
+		if len(ctx.Event.Payload) > limit {
+			return NewEventError(ErrorCodeTooLarge, "payload exceeds "+strconv.Itoa(limit)+" bytes")
+		}
+		return next(ctx)
+	}
+}
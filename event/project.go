@@ -1,11 +1,10 @@
 package event
 
 import (
-	"database/sql"
 	"todopp/store"
 )
 
-func upsertProject(db *sql.DB, project ProjectPayload, userId string) error {
+func upsertProject(db store.Querier, project ProjectPayload, userId string) error {
 	var storeProject store.Project
 
 	storeProject.ProjectId = project.Id
@@ -59,7 +58,15 @@ func upsertProject(db *sql.DB, project ProjectPayload, userId string) error {
 	return nil
 }
 
-func deleteProject(db *sql.DB, project ProjectPayload) error {
+func deleteProject(db store.Querier, project ProjectPayload) error {
 	err := store.DeleteProject(db, project.Id)
 	return err
 }
+
+func saveProject(ctx *Context, project ProjectPayload) error {
+	return upsertProject(ctx.Db, project, ctx.UserId)
+}
+
+func removeProject(ctx *Context, project ProjectPayload) error {
+	return deleteProject(ctx.Db, project)
+}
@@ -0,0 +1,153 @@
+package event
+
+import (
+	"encoding/json"
+	"sync"
+	"todopp/store"
+)
+
+// An event on its way through the middlewares to the handler of its type
+type Context struct {
+	Db      store.Querier
+	UserId  string // empty until the event has been authenticated
+	Event   Event
+	Payload any // the payload decoded to the type the handler was registered with
+}
+
+type HandlerFunc func(ctx *Context) error
+
+// Wraps the processing of every event, e.g. to authenticate, log or measure it
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Handler of an event type with its hooks. Before hooks run in registration order and stop the
+// event on the first error, after hooks run once the handler has succeeded
+type registration struct {
+	newPayload func() any
+	decode     func(payload json.RawMessage) (any, error)
+	handle     HandlerFunc
+	before     []HandlerFunc
+	after      []HandlerFunc
+}
+
+var registryLock sync.RWMutex
+var registrations = map[string]*registration{}
+var middlewares []Middleware
+
+// Registers the handler of an event type. The payload is decoded to P before the hooks and the handler run.
+// Registering a type twice panics, as it would silently replace the first handler
+func Register[P any](eventType string, handle func(ctx *Context, payload P) error) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exists := registrations[eventType]; exists {
+		panic("event type '" + eventType + "' is already registered")
+	}
+	registrations[eventType] = &registration{
+		newPayload: func() any { return *new(P) },
+		decode: func(rawPayload json.RawMessage) (any, error) {
+			var payload P
+			err := unmarshalPayload(rawPayload, &payload)
+			return payload, err
+		},
+		handle: func(ctx *Context) error {
+			return handle(ctx, ctx.Payload.(P))
+		},
+	}
+}
+
+// Adds a hook which runs before the handler of the event type, e.g. to validate the payload
+func Before[P any](eventType string, hook func(ctx *Context, payload P) error) {
+	addHook(eventType, hook, func(registration *registration, hookFunc HandlerFunc) {
+		registration.before = append(registration.before, hookFunc)
+	})
+}
+
+// Adds a hook which runs after the handler of the event type has succeeded
+func After[P any](eventType string, hook func(ctx *Context, payload P) error) {
+	addHook(eventType, hook, func(registration *registration, hookFunc HandlerFunc) {
+		registration.after = append(registration.after, hookFunc)
+	})
+}
+
+func addHook[P any](eventType string, hook func(ctx *Context, payload P) error, add func(*registration, HandlerFunc)) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	registration, exists := registrations[eventType]
+	if !exists {
+		panic("event type '" + eventType + "' is not registered")
+	}
+	if _, ok := registration.newPayload().(P); !ok {
+		panic("hook payload type does not match the handler of event type '" + eventType + "'")
+	}
+	add(registration, func(ctx *Context) error {
+		return hook(ctx, ctx.Payload.(P))
+	})
+}
+
+// Adds a middleware around the processing of all events. The first middleware added is the outermost
+func Use(middleware Middleware) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	middlewares = append(middlewares, middleware)
+}
+
+func IsEventType(name string) bool {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	_, ok := registrations[name]
+	return ok
+}
+
+// Runs the event through the middlewares to the handler of its type
+func process(ctx *Context) error {
+	registryLock.RLock()
+	handler := HandlerFunc(dispatch)
+	for index := len(middlewares) - 1; index >= 0; index-- {
+		handler = middlewares[index](handler)
+	}
+	registryLock.RUnlock()
+
+	return handler(ctx)
+}
+
+func dispatch(ctx *Context) error {
+	registryLock.RLock()
+	registration, ok := registrations[ctx.Event.Type]
+	var before, after []HandlerFunc
+	if ok {
+		before, after = registration.before, registration.after
+	}
+	registryLock.RUnlock()
+	if !ok {
+		return NewEventError(ErrorCodeUnknownType, "unknown event type '"+ctx.Event.Type+"'")
+	}
+
+	payload, err := registration.decode(ctx.Event.Payload)
+	if err != nil {
+		return err
+	}
+	ctx.Payload = payload
+
+	for _, hook := range before {
+		err = hook(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = registration.handle(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range after {
+		err = hook(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
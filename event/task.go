@@ -6,7 +6,7 @@ import (
 	"todopp/store"
 )
 
-func upsertTask(db *sql.DB, task TaskPayload) error {
+func upsertTask(db store.Querier, task TaskPayload) error {
 	var storeTask store.Task
 
 	storeTask.TaskId = task.Id
@@ -15,10 +15,19 @@ func upsertTask(db *sql.DB, task TaskPayload) error {
 	storeTask.Sequence = -2
 	taskStatusId, err := strconv.ParseInt(task.Status, 10, 32)
 	if err != nil {
-		return err
+		return NewEventError(ErrorCodeInvalidPayload, "invalid task status '"+task.Status+"'")
 	}
 	storeTask.TaskStatusId = int(taskStatusId)
 
+	// keep the stored due date when the client doesn't send one
+	if task.Due != nil {
+		storeTask.Due = *task.Due
+	} else if savedTask, err := store.GetTask(db, task.Id); err == nil {
+		storeTask.Due = savedTask.Due
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
 	err = store.UpsertTask(db, storeTask)
 	if err != nil {
 		return err
@@ -54,15 +63,25 @@ func upsertTask(db *sql.DB, task TaskPayload) error {
 	}
 
 	for sequence, task_i := range tasks {
-		task_i.Sequence = sequence
-		err = store.UpsertTask(db, task_i)
-		if err != nil {
-			return err
+		if task_i.Sequence != sequence {
+			task_i.Sequence = sequence
+			err = store.UpsertTask(db, task_i)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func deleteTask(db *sql.DB, task TaskPayload) error {
+func deleteTask(db store.Querier, task TaskPayload) error {
 	return store.DeleteTask(db, task.Id)
 }
+
+func saveTask(ctx *Context, task TaskPayload) error {
+	return upsertTask(ctx.Db, task)
+}
+
+func removeTask(ctx *Context, task TaskPayload) error {
+	return deleteTask(ctx.Db, task)
+}
@@ -0,0 +1,204 @@
+package event
+
+import (
+	"strconv"
+	"strings"
+	"todopp/store"
+	"unicode/utf8"
+)
+
+// Limits of the event payloads
+const (
+	maxPayloadSize    = 64 << 10
+	maxIdLength       = 64
+	maxNameLength     = 256
+	maxTaskTextLength = 16 << 10
+)
+
+func validateProjectAdd(ctx *Context, project ProjectPayload) error {
+	err := validateProjectFields(project)
+	if err != nil {
+		return err
+	}
+	// an add may be resent after a reconnect, so the project may exist already
+	return validateNewId(ctx.Db, ctx.UserId, store.GetProjectUserId, project.Id)
+}
+
+func validateProjectUpdate(ctx *Context, project ProjectPayload) error {
+	err := validateProjectFields(project)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "project", store.GetProjectUserId, project.Id)
+}
+
+func validateProjectDelete(ctx *Context, project ProjectPayload) error {
+	err := validateId("id", project.Id)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "project", store.GetProjectUserId, project.Id)
+}
+
+func validateProjectFields(project ProjectPayload) error {
+	err := validateId("id", project.Id)
+	if err != nil {
+		return err
+	}
+	err = validateName("name", project.Name, maxNameLength)
+	if err != nil {
+		return err
+	}
+	return validateOptionalId("after", project.After)
+}
+
+func validateGroupAdd(ctx *Context, group GroupPayload) error {
+	err := validateGroupFields(ctx.Db, ctx.UserId, group)
+	if err != nil {
+		return err
+	}
+	return validateNewId(ctx.Db, ctx.UserId, store.GetTaskGroupUserId, group.Id)
+}
+
+func validateGroupUpdate(ctx *Context, group GroupPayload) error {
+	err := validateGroupFields(ctx.Db, ctx.UserId, group)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "group", store.GetTaskGroupUserId, group.Id)
+}
+
+func validateGroupDelete(ctx *Context, group GroupPayload) error {
+	err := validateId("id", group.Id)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "group", store.GetTaskGroupUserId, group.Id)
+}
+
+func validateGroupFields(db store.Querier, userId string, group GroupPayload) error {
+	err := validateId("id", group.Id)
+	if err != nil {
+		return err
+	}
+	err = validateName("name", group.Name, maxNameLength)
+	if err != nil {
+		return err
+	}
+	err = validateOptionalId("after", group.After)
+	if err != nil {
+		return err
+	}
+	err = validateId("projectid", group.ProjectId)
+	if err != nil {
+		return err
+	}
+	return validateOwner(db, userId, "project", store.GetProjectUserId, group.ProjectId)
+}
+
+func validateTaskAdd(ctx *Context, task TaskPayload) error {
+	err := validateTaskFields(ctx.Db, ctx.UserId, task)
+	if err != nil {
+		return err
+	}
+	return validateNewId(ctx.Db, ctx.UserId, store.GetTaskUserId, task.Id)
+}
+
+func validateTaskUpdate(ctx *Context, task TaskPayload) error {
+	err := validateTaskFields(ctx.Db, ctx.UserId, task)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "task", store.GetTaskUserId, task.Id)
+}
+
+func validateTaskDelete(ctx *Context, task TaskPayload) error {
+	err := validateId("id", task.Id)
+	if err != nil {
+		return err
+	}
+	return validateOwner(ctx.Db, ctx.UserId, "task", store.GetTaskUserId, task.Id)
+}
+
+func validateTaskFields(db store.Querier, userId string, task TaskPayload) error {
+	err := validateId("id", task.Id)
+	if err != nil {
+		return err
+	}
+	err = validateName("text", task.Text, maxTaskTextLength)
+	if err != nil {
+		return err
+	}
+	err = validateOptionalId("after", task.After)
+	if err != nil {
+		return err
+	}
+	if task.Due != nil && *task.Due < 0 {
+		return invalidPayload("due must not be negative")
+	}
+
+	taskStatusId, err := strconv.Atoi(task.Status)
+	if err != nil {
+		return invalidPayload("invalid task status '" + task.Status + "'")
+	}
+	exists, err := store.IsTaskStatusExists(db, taskStatusId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return invalidPayload("unknown task status '" + task.Status + "'")
+	}
+
+	err = validateId("group", task.Group)
+	if err != nil {
+		return err
+	}
+	return validateOwner(db, userId, "group", store.GetTaskGroupUserId, task.Group)
+}
+
+func invalidPayload(message string) error {
+	return NewEventError(ErrorCodeInvalidPayload, message)
+}
+
+func validateId(field string, id string) error {
+	if strings.TrimSpace(id) == "" {
+		return invalidPayload(field + " is required")
+	}
+	return validateOptionalId(field, id)
+}
+
+func validateOptionalId(field string, id string) error {
+	if len(id) > maxIdLength {
+		return invalidPayload(field + " must not be longer than " + strconv.Itoa(maxIdLength) + " characters")
+	}
+	return nil
+}
+
+func validateName(field string, name string, maxLength int) error {
+	if strings.TrimSpace(name) == "" {
+		return invalidPayload(field + " is required")
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return invalidPayload(field + " must not be longer than " + strconv.Itoa(maxLength) + " characters")
+	}
+	return nil
+}
+
+// Checks that the entity exists and belongs to the user. Entities of other users are reported as
+// not found, so their ids can't be probed
+func validateOwner(db store.Querier, userId string, entity string, getUserId func(store.Querier, string) (string, error), id string) error {
+	ownerId, err := getUserId(db, id)
+	if err != nil || ownerId != userId {
+		return NewEventError(ErrorCodeNotFound, entity+" '"+id+"' is not registered")
+	}
+	return nil
+}
+
+// Checks that an id of a new entity is not taken by an entity of another user
+func validateNewId(db store.Querier, userId string, getUserId func(store.Querier, string) (string, error), id string) error {
+	ownerId, err := getUserId(db, id)
+	if err == nil && ownerId != userId {
+		return invalidPayload("id '" + id + "' is already in use")
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 class AppEvent {
     eventSocket;
+    eventStream;
     
     isLogEvents;
 
     onConnect;
     onDisconnect;
+    onNack;
 
     onProjectAdd;
     onProjectDelete;
@@ -15,13 +17,36 @@ class AppEvent {
     onTaskAdd;
     onTaskDelete;
     onTaskUpdate;
+    onAttachmentAdd;
+    onAttachmentDelete;
+    onPresenceState;
+    onPresenceJoin;
+    onPresenceLeave;
+    onPresenceEdit;
 
     reconnectIntervalId;
     store;
+    // sent events waiting for their ack or nack by request id
+    pending = new Map();
+    // viewed project and edited task, announced again on every heartbeat and reconnect
+    presenceProject = "";
+    presenceTask = "";
+    // "websocket", "sse" once the WebSocket failed to open, e.g. behind a proxy dropping the upgrade,
+    // or "poll" once the event stream failed to open as well
+    transport = "websocket";
+    socketOpened = false;
+    streamOpened = false;
+    failedConnects = 0;
+    // id of the last change received by long polling, null until polling has started
+    pollCursor = null;
+    // whether the event stream or long polling currently delivers the changes
+    fallbackConnected = false;
 
     constructor() {
         this.reconnect = this.reconnect.bind(this);
         this.connect();
+        // the server forgets viewers which stop sending heartbeats
+        setInterval(() => this.sendPresence("presence-view", {project: this.presenceProject}), 30000);
         this.store = new IndexedDBEventStore();
     }
 
@@ -31,7 +56,25 @@ class AppEvent {
         }
 
         var parsedEvent = JSON.parse(event.data);
+        this.handleEvent(parsedEvent);
+    }
+
+    handleEvent(parsedEvent) {
         switch(parsedEvent.type) {
+            case "batch":
+                // the events of a batch are applied in order, like single events
+                parsedEvent.payload.events.forEach(batchEvent => this.handleEvent(batchEvent));
+                break;
+            case "ack":
+                this.pending.delete(parsedEvent.requestid);
+                break;
+            case "nack":
+                // the server rejected the change, payload holds the code, message and affected entity
+                this.pending.delete(parsedEvent.requestid);
+                if (this.onNack != null){
+                    this.onNack(parsedEvent.payload, parsedEvent.requestid);
+                }
+                break;
             case "project-add":
                 if (this.onProjectAdd != null){
                     this.onProjectAdd(parsedEvent.payload);
@@ -77,15 +120,53 @@ class AppEvent {
                     this.onTaskUpdate(parsedEvent.payload);
                 }
                 break;
+            case "attachment-add":
+                if (this.onAttachmentAdd != null){
+                    this.onAttachmentAdd(parsedEvent.payload);
+                }
+                break;
+            case "attachment-delete":
+                if (this.onAttachmentDelete != null){
+                    this.onAttachmentDelete(parsedEvent.payload);
+                }
+                break;
+            case "presence-state":
+                if (this.onPresenceState != null){
+                    this.onPresenceState(parsedEvent.payload);
+                }
+                break;
+            case "presence-join":
+                if (this.onPresenceJoin != null){
+                    this.onPresenceJoin(parsedEvent.payload);
+                }
+                break;
+            case "presence-leave":
+                if (this.onPresenceLeave != null){
+                    this.onPresenceLeave(parsedEvent.payload);
+                }
+                break;
+            case "presence-edit":
+                if (this.onPresenceEdit != null){
+                    this.onPresenceEdit(parsedEvent.payload);
+                }
+                break;
         }
     }
 
     async send(data) {
+        // every event gets a request id, the server answers it with an ack or nack
+        const requestEvent = JSON.parse(data);
+        if (requestEvent.requestid == null) {
+            requestEvent.requestid = guid();
+        }
+        data = JSON.stringify(requestEvent);
+
         if (this.isConnected()){
-            this.eventSocket.send(data);
+            this.pending.set(requestEvent.requestid, data);
+            this.transmit(data);
         } else {
             await this.store.init();
-            const storeEvent = {eventId:guid(), utc_time:Date.now().toString(), data:data}
+            const storeEvent = {eventId:requestEvent.requestid, utc_time:Date.now().toString(), data:data}
             await this.store.saveEvents(storeEvent);  
             const eventData = JSON.parse(data);
             const receiveMessage = {data:JSON.stringify(eventData)};            
@@ -93,36 +174,262 @@ class AppEvent {
         }
     }
 
+    // Replaces the token of the open connection, the server closes connections once their token expires
+    refreshToken() {
+        if (this.transport == "websocket" && this.isConnected()) {
+            this.eventSocket.send(JSON.stringify({type: "auth", token: getCookieByName("jwtToken")}));
+        }
+    }
+
+    // Announces the viewed project to the other viewers
+    viewProject(projectId) {
+        this.presenceProject = projectId;
+        this.presenceTask = "";
+        this.sendPresence("presence-view", {project: projectId});
+    }
+
+    // Announces the edited task as a soft lock, an empty task id releases it
+    editTask(taskId) {
+        this.presenceTask = taskId;
+        this.sendPresence("presence-edit", {task: taskId});
+    }
+
+    // Presence is only meaningful while connected, so it is neither queued nor acknowledged.
+    // It needs the WebSocket, the fallback transport has no connection to be present on
+    sendPresence(type, payload) {
+        if (this.transport == "websocket" && this.isConnected() && this.presenceProject != "") {
+            this.eventSocket.send(JSON.stringify({type: type, instance: instanceGuid, payload: payload}));
+        }
+    }
+
+    // Sends the events as one batch, the server applies all of them or none
+    async sendBatch(events) {
+        const batchEvent = {
+            type: "batch",
+            instance: instanceGuid,
+            jwt: getCookieByName("jwtToken"),
+            payload: {
+                events: events.map(event => ({type: event.type, instance: instanceGuid, payload: event.payload})),
+            },
+        };
+        await this.send(JSON.stringify(batchEvent));
+    }
+
     async resendEvents() {
         await this.store.init();
         const events = await this.store.getEventsSince("0");
-        events.forEach(event => {this.eventSocket.send(event.data);});
+        // queued events may carry an access token which has expired in the meantime
+        events.forEach(event => {
+            const data = JSON.parse(event.data);
+            data.jwt = getCookieByName("jwtToken");
+            if (data.requestid == null) {
+                data.requestid = event.eventId;
+            }
+            const resendData = JSON.stringify(data);
+            this.pending.set(data.requestid, resendData);
+            this.transmit(resendData);
+        });
         await this.store.clearEventStore();
     }
 
+    // Keeps the events which were not answered before the connection closed, so they are resent on reconnect
+    async storePendingEvents() {
+        if (this.pending.size == 0) {
+            return;
+        }
+        const storeEvents = [];
+        this.pending.forEach((data, requestId) => {
+            storeEvents.push({eventId:requestId, utc_time:Date.now().toString(), data:data});
+        });
+        this.pending.clear();
+        await this.store.init();
+        await this.store.saveEvents(storeEvents);
+    }
+
+    // Sends the event over the current transport
+    transmit(data) {
+        if (this.transport == "websocket") {
+            this.eventSocket.send(data);
+        } else {
+            this.postEvent(data);
+        }
+    }
+
+    // Sends the event over plain HTTP, the reply is the ack or nack the WebSocket would have sent
+    async postEvent(data) {
+        try {
+            const response = await fetch("/api/events", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    Authorization: "Bearer " + getCookieByName("jwtToken"),
+                },
+                body: data,
+            });
+            if (response.headers.get("Content-Type") == "application/json") {
+                this.handleEvent(await response.json());
+            }
+        } catch (error) {
+            // the event stays pending and is resent once the transport has reconnected
+            logger.error(error);
+        }
+    }
+
+    // Switches to server-sent events and POST requests after the WebSocket failed to open repeatedly
+    startStream() {
+        if (this.transport != "websocket") {
+            return;
+        }
+        if (this.reconnectIntervalId != null) {
+            clearInterval(this.reconnectIntervalId);
+            this.reconnectIntervalId = null;
+        }
+        if (!("EventSource" in window)) {
+            this.startPolling();
+            return;
+        }
+        logger.log("WebSocket unavailable, falling back to server-sent events");
+        this.transport = "sse";
+        this.failedConnects = 0;
+        this.openStream();
+    }
+
+    // The stream authenticates with the token cookie, an EventSource can't send headers. The browser
+    // reconnects by itself, resuming after the last event id with the token the cookie holds by then
+    openStream() {
+        this.streamOpened = false;
+        this.eventStream = new EventSource("/api/events/stream");
+        this.eventStream.onopen = () => {
+            this.streamOpened = true;
+            this.failedConnects = 0;
+            this.fallbackOnConnect();
+        };
+        this.eventStream.onmessage = this.eventSocketOnMessage.bind(this);
+        // sent before the server ends the stream of an expired or revoked token, like the close frame of a WebSocket
+        this.eventStream.addEventListener("close", (event) => {
+            this.fallbackDisconnected(JSON.parse(event.data).code);
+        });
+        this.eventStream.onerror = () => {
+            this.fallbackDisconnected(1006);
+            // an EventSource gives up after an error reply, e.g. 401 or 410
+            if (this.eventStream.readyState != EventSource.CLOSED) {
+                return;
+            }
+            if (!this.streamOpened && ++this.failedConnects >= 3) {
+                this.startPolling();
+                return;
+            }
+            setTimeout(() => {
+                if (this.transport == "sse") {
+                    this.openStream();
+                }
+            }, 1000);
+        };
+    }
+
+    // Switches to long polling and POST requests when neither the WebSocket nor the event stream open
+    startPolling() {
+        if (this.transport == "poll") {
+            return;
+        }
+        logger.log("Event stream unavailable, falling back to long polling");
+        if (this.eventStream != null) {
+            this.eventStream.close();
+            this.eventStream = null;
+        }
+        this.transport = "poll";
+        this.poll();
+    }
+
+    // Polls the changes after the last one received. The first request only returns the cursor,
+    // the complete data is fetched on connect like for a new WebSocket connection
+    async poll() {
+        while (this.transport == "poll") {
+            const after = this.pollCursor == null ? "" : `?after=${encodeURIComponent(this.pollCursor)}`;
+            let response;
+            try {
+                response = await fetch(`/api/events/poll${after}`, {
+                    headers: {Authorization: "Bearer " + getCookieByName("jwtToken")},
+                });
+            } catch (error) {
+                response = null;
+            }
+
+            if (response == null || !response.ok) {
+                // 410: the cursor is unknown, polling starts again from the latest change
+                if (response != null && response.status == 410) {
+                    this.pollCursor = null;
+                }
+                this.fallbackDisconnected(response != null && response.status == 401 ? 4401 : 1006);
+                await new Promise(resolve => setTimeout(resolve, 1000));
+                continue;
+            }
+
+            const result = await response.json();
+            this.fallbackOnConnect();
+            result.events.forEach(event => this.eventSocketOnMessage({data: JSON.stringify(event)}));
+            this.pollCursor = result.last;
+        }
+    }
+
+    fallbackOnConnect() {
+        if (this.fallbackConnected) {
+            return;
+        }
+        this.fallbackConnected = true;
+        if (this.onConnect != null) {
+            this.onConnect(null);
+        }
+    }
+
+    fallbackDisconnected(code) {
+        if (!this.fallbackConnected) {
+            return;
+        }
+        this.fallbackConnected = false;
+        this.storePendingEvents().catch((error) => logger.error(error));
+        if (this.onDisconnect != null) {
+            this.onDisconnect({code: code});
+        }
+    }
+
     connect() {
         if (!("WebSocket" in window)) {
-            alert("Your browser does not support WebSocket. This site will not work correctly. Please consider updating your browser or using a different browser that supports WebSocket.")
+            this.startStream();
             return;
         }
-        const token = getCookieByName("jwtToken");
+        this.socketOpened = false;
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        this.eventSocket = new WebSocket(`${protocol}//${window.location.host}/ws?token=${token}`);
+        // the token is sent as the first message, so it does not end up in the logs of proxies
+        this.eventSocket = new WebSocket(`${protocol}//${window.location.host}/ws`, "todopp");
         this.eventSocket.onmessage = this.eventSocketOnMessage.bind(this);
         this.eventSocket.onclose = this.eventSocketOnClose.bind(this);
         this.eventSocket.onopen = this.eventSocketOnConnect.bind(this);
     }
 
     eventSocketOnClose(event) {
+        this.storePendingEvents().catch((error) => logger.error(error));
         if (this.onDisconnect!= null) {
             this.onDisconnect(event);
         }
+        if (!this.socketOpened && ++this.failedConnects >= 3) {
+            this.startStream();
+            return;
+        }
         if (this.reconnectIntervalId == null) {
             this.reconnectIntervalId = setInterval(this.reconnect, 1000);
         }
     }
 
     eventSocketOnConnect(event) {  
+        this.socketOpened = true;
+        this.failedConnects = 0;
+        this.eventSocket.send(JSON.stringify({type: "auth", token: getCookieByName("jwtToken")}));
+        // the presence of the previous connection has expired
+        this.sendPresence("presence-view", {project: this.presenceProject});
+        if (this.presenceTask != "") {
+            this.sendPresence("presence-edit", {task: this.presenceTask});
+        }
         if (this.onConnect!= null) {
             this.onConnect(event);
         }
@@ -143,6 +450,9 @@ class AppEvent {
     }
 
     isConnected() {
+        if (this.transport != "websocket") {
+            return this.fallbackConnected;
+        }
         return this.eventSocket.readyState == WebSocket.OPEN;
     }
 }
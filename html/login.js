@@ -1,12 +1,22 @@
 let action_type = 'login';
+let twoFactorChallenge = null;
 let email = ""
 const url = new URL(window.location.href);
 const secretToken = url.searchParams.get('secret_token');
+const resetToken = url.searchParams.get('reset_token');
+const ssoError = url.searchParams.get('sso_error');
+const isSsoLogin = url.searchParams.get('sso') === '1';
 
 logger.log("secretToken:", secretToken);
 
+// the next user may be another one, so the first sync after a login fetches the complete data
+localStorage.removeItem("sync-revision");
+
 document.getElementById("button-login").onclick = (event) => btnLoginOnClick(event);
 document.getElementById("button-register").onclick = (event) => btnRegisterOnClick(event);
+document.getElementById("button-two-factor").onclick = (event) => btnTwoFactorOnClick(event);
+document.getElementById("button-reset-request").onclick = (event) => btnResetRequestOnClick(event);
+document.getElementById("button-reset-confirm").onclick = (event) => btnResetConfirmOnClick(event);
 
 document.querySelector('#loginForm').addEventListener('submit', function(event) {
     event.preventDefault(); // This stops the page from reloading
@@ -14,6 +24,15 @@ document.querySelector('#loginForm').addEventListener('submit', function(event)
 document.querySelector('#registrationForm').addEventListener('submit', function(event) {
     event.preventDefault(); // This stops the page from reloading
   });
+document.querySelector('#twoFactorForm').addEventListener('submit', function(event) {
+    event.preventDefault(); // This stops the page from reloading
+  });
+document.querySelector('#resetRequestForm').addEventListener('submit', function(event) {
+    event.preventDefault(); // This stops the page from reloading
+  });
+document.querySelector('#resetConfirmForm').addEventListener('submit', function(event) {
+    event.preventDefault(); // This stops the page from reloading
+  });
 
 // Toggle between login and registration forms
 document.getElementById('register-link').addEventListener('click', function(e) {
@@ -28,18 +47,44 @@ document.getElementById('login-link').addEventListener('click', function(e) {
     document.getElementById('registration-container').style.display = 'none';
 });
 
+document.getElementById('forgot-password-link').addEventListener('click', function(e) {
+    e.preventDefault();
+    document.getElementById('auth-container').style.display = 'none';
+    document.getElementById('reset-request-container').style.display = 'block';
+});
+
+document.getElementById('reset-login-link').addEventListener('click', function(e) {
+    e.preventDefault();
+    document.getElementById('auth-container').style.display = 'block';
+    document.getElementById('reset-request-container').style.display = 'none';
+});
+
 if (secretToken) {
     validateSecretToken(secretToken)
 }
 
+if (ssoError) {
+    showDialog("Login error", ssoError);
+}
+
+if (isSsoLogin) {
+    ssoTokenFetch();
+}
+
+ssoConfigFetch();
+
+if (resetToken) {
+    document.getElementById('auth-container').style.display = 'none';
+    document.getElementById('reset-confirm-container').style.display = 'block';
+}
+
 function btnLoginOnClick(event) {
     const form = document.getElementById("loginForm")
     if (!form.reportValidity()) {
         return;
     }
     action_type = 'login'
-    hcaptcha.reset();
-    document.getElementById("captchaModal").style.display = "flex";
+    showCaptcha();
 }
 
 
@@ -49,10 +94,103 @@ function btnRegisterOnClick(event) {
         return;
     }
     action_type = 'register'
-    hcaptcha.reset();
+    showCaptcha();
+}
+
+
+function btnResetRequestOnClick(event) {
+    const form = document.getElementById("resetRequestForm")
+    if (!form.reportValidity()) {
+        return;
+    }
+    action_type = 'reset'
+    showCaptcha();
+}
+
+function btnResetConfirmOnClick(event) {
+    const form = document.getElementById("resetConfirmForm")
+    if (!form.reportValidity()) {
+        return;
+    }
+    resetConfirmFetch();
+}
+
+let hcaptchaWidgetId = null;
+
+// The server decides whether a captcha is needed and which kind: logins only need one after failed attempts
+function showCaptcha() {
+    let params = new URLSearchParams({action: action_type});
+    if (action_type == 'login') {
+        params.set('login', document.getElementById("input-login").value);
+    }
+
+    fetch('/api/captcha?' + params.toString())
+    .then(response => {
+        if (!response.ok) {
+            return response.text().then(text => { throw new Error(text); });
+        }
+        return response.json();
+    })
+    .then(captcha => {
+        if (!captcha.isrequired) {
+            submitAction("");
+        } else if (captcha.provider == 'pow') {
+            solveProofOfWork(captcha.challenge, captcha.difficulty);
+        } else {
+            showHcaptcha(captcha.sitekey);
+        }
+    })
+    .catch(error => {
+        showDialog("Error", error.message);
+    });
+}
+
+function showHcaptcha(siteKey) {
+    document.getElementById("h-captcha").style.display = "block";
+    document.getElementById("pow-captcha").style.display = "none";
     document.getElementById("captchaModal").style.display = "flex";
+
+    if (hcaptchaWidgetId !== null) {
+        hcaptcha.reset(hcaptchaWidgetId);
+        return;
+    }
+
+    // the hCaptcha script is only loaded when the server asks for it
+    window.onHcaptchaLoad = function() {
+        hcaptchaWidgetId = hcaptcha.render("h-captcha", {sitekey: siteKey, callback: onCaptchaSuccess});
+    };
+    const script = document.createElement("script");
+    script.src = "https://js.hcaptcha.com/1/api.js?render=explicit&onload=onHcaptchaLoad";
+    script.async = true;
+    document.head.appendChild(script);
 }
 
+// Finds a counter such that SHA-256("<challenge>:<counter>") starts with the given number of zero bits
+async function solveProofOfWork(challenge, difficulty) {
+    document.getElementById("h-captcha").style.display = "none";
+    document.getElementById("pow-captcha").style.display = "block";
+    document.getElementById("captchaModal").style.display = "flex";
+
+    const encoder = new TextEncoder();
+    for (let counter = 0; ; counter++) {
+        const response = challenge + ":" + counter;
+        const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(response)));
+        if (hasLeadingZeroBits(hash, difficulty)) {
+            onCaptchaSuccess(response);
+            return;
+        }
+    }
+}
+
+function hasLeadingZeroBits(hash, difficulty) {
+    let index = 0;
+    for (; difficulty >= 8; difficulty -= 8, index++) {
+        if (hash[index] != 0) {
+            return false;
+        }
+    }
+    return difficulty == 0 || (hash[index] >> (8 - difficulty)) == 0;
+}
 
 function onCaptchaSuccess(token) {
     if (!token) {
@@ -61,9 +199,14 @@ function onCaptchaSuccess(token) {
     }
 
     document.getElementById("captchaModal").style.display = "none";
+    submitAction(token);
+}
 
+function submitAction(token) {
     if (action_type == 'login') {
         loginFetch(token);
+    } else if (action_type == 'reset') {
+        resetRequestFetch(token);
     } else {
         registerFetch(token);
     }
@@ -81,6 +224,91 @@ function loginFetch(token) {
         credentials: 'include',
         body: jsonBody
     })
+    .then(response => {
+                if (!response.ok) {
+                    return response.text().then(text => {
+                        return Promise.reject(text); // Properly reject with the error text
+                    });
+                } else{
+                    return response;
+                }
+            }
+        )
+    .then(response => {
+        // accounts with two-factor authentication get a challenge instead of the token
+        if (response.headers.get("Content-Type").startsWith("application/json")) {
+            return response.json().then(challenge => {
+                twoFactorChallenge = challenge.challenge;
+                document.getElementById('auth-container').style.display = 'none';
+                document.getElementById('two-factor-container').style.display = 'block';
+                document.getElementById('input-two-factor-code').focus();
+            });
+        }
+        return response.text().then(tokenString => {
+            setCookie("jwtToken", tokenString, {})
+            window.location.href= "/";
+        });
+    })
+    .catch(error => {
+        logger.error(error);
+        showDialog("Login error", error);
+    });
+}
+
+// The single sign-on callback has started the session, the access token is taken from it like a renewed one
+function ssoTokenFetch() {
+    fetch('/api/token_renew', {
+        method: 'POST',
+        credentials: 'same-origin'
+    })
+    .then(response => response.ok ? response.text() : response.text().then(text => Promise.reject(text)))
+    .then(tokenString => {
+        setCookie("jwtToken", tokenString, {})
+        window.location.href= "/";
+    })
+    .catch(error => {
+        logger.error(error);
+        showDialog("Login error", error);
+    });
+}
+
+function ssoConfigFetch() {
+    fetch('/api/oidc/config', {
+        method: 'GET',
+        credentials: 'include'
+    })
+    .then(response => response.ok ? response.json() : Promise.reject(response.statusText))
+    .then(ssoConfig => {
+        if (!ssoConfig.isenabled) {
+            return;
+        }
+        const button = document.getElementById("button-sso");
+        button.textContent = ssoConfig.buttontext;
+        button.onclick = () => window.location.assign("/api/oidc/login");
+        document.getElementById("div-button-sso").style.display = "block";
+    })
+    .catch(error => logger.error(error));
+}
+
+function btnTwoFactorOnClick(event) {
+    const form = document.getElementById("twoFactorForm")
+    if (!form.reportValidity()) {
+        return;
+    }
+    twoFactorFetch();
+}
+
+function twoFactorFetch() {
+    const code = document.getElementById("input-two-factor-code").value;
+    const jsonBody = JSON.stringify({challenge: twoFactorChallenge, code: code});
+    fetch('/api/login/2fa', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        credentials: 'include',
+        body: jsonBody
+    })
     .then(response => {
                 if (!response.ok) {
                     return response.text().then(text => {
@@ -98,6 +326,7 @@ function loginFetch(token) {
     })
     .catch(error => {
         logger.error(error);
+        document.getElementById('input-two-factor-code').value = "";
         showDialog("Login error", error);
     });
 }
@@ -192,6 +421,93 @@ function registerFetch(token) {
     });
 }
 
+function resetRequestFetch(token) {
+    const login = document.getElementById("input-reset-login").value;
+    const jsonBody = JSON.stringify({login: login, captcha: token});
+    fetch('/api/password_reset/request', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        credentials: 'include',
+        body: jsonBody
+    })
+    .then(response => {
+                if (!response.ok) {
+                    return response.text().then(text => {
+                        return Promise.reject(text); // Properly reject with the error text
+                    });
+                } else{
+                    return response;
+                }
+            }
+        )
+    .then(response => response.text())
+    .then (message => {
+        showInformation("Check Your Email", message);
+        document.getElementById('resetRequestForm').reset();
+    })
+    .catch(error => {
+        logger.error(error);
+        showDialog("Password reset error", error);
+    });
+}
+
+function resetConfirmFetch() {
+    const password = document.getElementById("input-reset-password").value;
+    const confirmPassword = document.getElementById("input-reset-confirm-password").value;
+
+    if (password !== confirmPassword) {
+        showDialog("Validation Error", "Passwords do not match");
+        document.getElementById("input-reset-confirm-password").focus();
+        return;
+    }
+
+    const jsonBody = JSON.stringify({token: resetToken, password: password});
+    fetch('/api/password_reset/confirm', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        credentials: 'include',
+        body: jsonBody
+    })
+    .then(response => {
+                if (!response.ok) {
+                    return response.text().then(text => {
+                        return Promise.reject(text); // Properly reject with the error text
+                    });
+                } else{
+                    return response;
+                }
+            }
+        )
+    .then(response => response.text())
+    .then (message => {
+        showInformation("Password Changed", message);
+        document.getElementById('resetConfirmForm').reset();
+        window.history.replaceState(null, "", "/login.html");
+    })
+    .catch(error => {
+        logger.error(error);
+        showDialog("Password reset error", error);
+    });
+}
+
+function showInformation(header, message) {
+    document.getElementById('info-header').textContent = header;
+    document.getElementById('info-message').textContent = message;
+    document.getElementById('button-info').textContent = "Proceed to Login";
+
+    document.getElementById('button-info').onclick = (event) => {
+        document.getElementById('information-container').style.display = 'none';
+        document.getElementById('auth-container').style.display = 'block';
+    }
+
+    document.querySelectorAll('.auth-container').forEach(container => container.style.display = 'none');
+    document.getElementById('information-container').style.display = 'block';
+}
+
 function validateSecretToken(secretToken) {
 
     const params = new URLSearchParams({
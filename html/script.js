@@ -18,21 +18,28 @@ appEvent.onTaskUpdate = taskUpdateOnEvent;
 
 appEvent.onConnect = onConnect;
 appEvent.onDisconnect = onDisconnect;
+appEvent.onNack = onNack;
+appEvent.onPresenceState = presenceStateOnEvent;
+appEvent.onPresenceJoin = presenceJoinOnEvent;
+appEvent.onPresenceLeave = presenceLeaveOnEvent;
+appEvent.onPresenceEdit = presenceEditOnEvent;
+
+// other clients viewing the selected project by client id, with the task they are editing
+const presenceViewers = new Map();
 
 document
     .getElementById("input-search")
     .addEventListener("input", inputSearchOnInput);
 
-// rennew JWT token
-setInterval(() => renewToken(), 3600000); //hourly
+// rennew JWT token, access tokens expire after 15 minutes
+setInterval(() => renewToken(), 300000); //every 5 minutes
 
 //persist state
 setInterval(persistState, 1000);
 window.addEventListener("beforeunload", persistState);
 
-renewToken();
-// Fetch complete user data
-allUserDataFetch();
+// Fetch the changes since the last sync once the token is renewed
+renewToken().then(() => userDataSync());
 // apply fetched data
 userDataApply();
 
@@ -47,9 +54,8 @@ document.addEventListener("visibilitychange", () => {
     // Check if the tab is now visible
     if (document.visibilityState === "visible") {
         logger.log("tab is visible");
-        renewToken();
-        // Fetch complete user data
-        allUserDataFetch();
+        // Fetch the changes since the last sync once the token is renewed
+        renewToken().then(() => userDataSync());
         // apply fetched data
         userDataApply();
     }
@@ -89,6 +95,63 @@ function allUserDataFetch() {
             store.insertProjects(allData.projects);
             store.insertTaskGroups(allData.groups);
             store.insertTasks(allData.tasks);
+            localStorage.setItem("sync-revision", allData.revision);
+        })
+        .catch((error) => logger.error(error));
+}
+
+/**
+ * Fetches the changes since the last sync and applies them to IndexedDB.
+ *
+ * Requests "/api/changes" with the revision stored by the previous sync. Changed projects, groups and tasks
+ * replace the stored ones and the deleted ones are removed. Falls back to `allUserDataFetch()` if there is
+ * no revision yet or the server doesn't know it anymore.
+ * @returns {void}
+ */
+function userDataSync() {
+    const revision = localStorage.getItem("sync-revision");
+    if (revision == null) {
+        allUserDataFetch();
+        return;
+    }
+
+    fetch(`/api/changes?since=${encodeURIComponent(revision)}`, {
+        method: "GET",
+        headers: {
+            "Content-Type": "application/json",
+            Authorization: "Bearer " + getCookieByName("jwtToken"),
+        },
+    })
+        .then((response) => {
+            if (response.status === 401) {
+                logger.error("Unauthorized - Redirect to login");
+                window.location.href = "/login.html";
+                return Promise.reject("Unauthorized");
+            }
+            if (response.status === 410 || response.status === 400) {
+                return null;
+            }
+            if (!response.ok) {
+                return response.text().then((text) => {
+                    return Promise.reject(text);
+                });
+            } else {
+                return response.json();
+            }
+        })
+        .then(async (changes) => {
+            if (changes == null) {
+                allUserDataFetch();
+                return;
+            }
+            const objectStoreNames = {project: "project", group: "task_group", task: "task"};
+            await store.insertProjects(changes.projects);
+            await store.insertTaskGroups(changes.groups);
+            await store.insertTasks(changes.tasks);
+            for (const tombstone of changes.deleted) {
+                await store.delete(objectStoreNames[tombstone.type], tombstone.id);
+            }
+            localStorage.setItem("sync-revision", changes.revision);
         })
         .catch((error) => logger.error(error));
 }
@@ -108,6 +171,7 @@ function taskListApply(projectId) {
         .getTaskGroupsByProjectId(projectId)
         .then((taskList) => {
             taskListPopulate(taskList);
+            presenceApply();
         })
         .catch((error) => logger.error(error));
 
@@ -162,20 +226,18 @@ function taskListPopulate(taskList) {
 /**
  * Renews the JWT authentication token before expiration by requesting a new one from the server.
  *
- * - Sends a GET request to `/api/token_renew` with the current valid token in the `Authorization` header
+ * - Sends a GET request to `/api/token_renew`, the server reads the refresh token from its HTTP-only cookie
+ *   and rotates it
  * - On success:
- *   - Sets the new token in an HTTP-only cookie for subsequent requests
- * @returns {void}
+ *   - Sets the new token in a cookie for subsequent requests
+ * @returns {Promise} resolved once the token is renewed or the renewal failed
  * @sideeffects
  *   - Updates `jwtToken` cookie with new token
  */
 function renewToken() {
-    fetch("/api/token_renew", {
+    return fetch("/api/token_renew", {
         method: "GET",
-        headers: {
-            "Content-Type": "application/json",
-            Authorization: "Bearer " + getCookieByName("jwtToken"),
-        },
+        credentials: "same-origin",
     })
         .then((response) => {
             if (response.status === 401) {
@@ -194,6 +256,7 @@ function renewToken() {
         .then((tokenString) => {
             if (/^[a-zA-Z0-9.\-_]+$/.test(tokenString)) {
                 setCookie("jwtToken", tokenString, {});
+                appEvent.refreshToken();
             }
         })
         .catch((error) => logger.error(error));
@@ -395,6 +458,10 @@ function projectSelect(projectRegion, isSetCursorAtFirstPosition = false) {
     taskListApply(projectRegion.id);
     projectRegion.focus();
     setCursorAtEdge(projectRegion, isSetCursorAtFirstPosition);
+    if (appEvent.presenceProject != projectRegion.id) {
+        presenceViewers.clear();
+        appEvent.viewProject(projectRegion.id);
+    }
 }
 
 /**
@@ -1423,11 +1490,19 @@ function taskInlineInputActivate(taskRegion, isSetCursorFirstPosition = false) {
     );
     menu.addButton("▲", taskRegion.id, taskUpOnClick, "50px");
     menu.addButton("▼", taskRegion.id, taskDownOnClick, "50px");
+
+    // the lock is soft: editing is allowed, but the user is warned about overwriting the other edit
+    const editingViewer = Array.from(presenceViewers.values()).find((viewer) => viewer.task == taskRegion.id);
+    if (editingViewer != null) {
+        popup.showPopup(`${editingViewer.login} is editing this task`, "orange");
+    }
+    appEvent.editTask(taskRegion.id);
 }
 
 function taskInlineInputOnBlur(event) {
     const taskInlineInput = event.target;
     const taskRegion = taskInlineInput.parentElement;
+    appEvent.editTask("");
     if (taskRegion == null) {
         // detached from DOM (removed)
         return;
@@ -1998,25 +2073,105 @@ function applyPersistedState() {
 }
 
 function signout() {
-    deleteCookie("jwtToken");
-    window.location.assign("/login.html");
+    fetch("/api/logout", {
+        method: "POST",
+        credentials: "same-origin",
+    })
+        .catch((error) => logger.error(error))
+        .finally(() => {
+            deleteCookie("jwtToken");
+            localStorage.removeItem("sync-revision");
+            window.location.assign("/login.html");
+        });
 }
 
 function onConnect(event) {
     menu.setOnlineIndicator(true);
     popup.showPopup("Connected", "lightgreen");
     appEvent.resendEvents();
-    allUserDataFetch();
+    userDataSync();
     userDataApply();
 }
 
 function onDisconnect(event) {
     menu.setOnlineIndicator(false);
+    // 4401: the access token was rejected, reconnect with a renewed one
+    if (event.code === 4401) {
+        renewToken();
+    }
     if (popup.getText() != "Disconnected") {
         popup.showPopup("Disconnected", "red");
     }
 }
 
+/**
+ * Rolls back a change rejected by the server by reloading the user data
+ * @param {Object} payload - The nack payload with eventtype, entity, code and message
+ * @param {string} requestId - The request id of the rejected event
+ * @returns {void}
+ */
+function onNack(payload, requestId) {
+    logger.error(`Event ${requestId} rejected (${payload.code}): ${payload.message}`);
+    popup.showPopup(`Failed to save ${payload.entity.type}: ${payload.message}`, "red");
+    // the token has expired meanwhile, the data is reloaded with a renewed one
+    if (payload.code === "unauthorized") {
+        renewToken().then(() => allUserDataFetch());
+    } else {
+        allUserDataFetch();
+    }
+    userDataApply();
+}
+
+/**
+ * Receives the other viewers of the selected project after joining it
+ * @param {Object} state - The project and its viewers with login, clientid and task
+ * @returns {void}
+ */
+function presenceStateOnEvent(state) {
+    presenceViewers.clear();
+    state.viewers.forEach((viewer) => presenceViewers.set(viewer.clientid, viewer));
+    presenceApply();
+}
+
+function presenceJoinOnEvent(viewer) {
+    presenceViewers.set(viewer.clientid, viewer);
+    presenceApply();
+}
+
+function presenceLeaveOnEvent(viewer) {
+    presenceViewers.delete(viewer.clientid);
+    presenceApply();
+}
+
+function presenceEditOnEvent(viewer) {
+    presenceViewers.set(viewer.clientid, viewer);
+    presenceApply();
+}
+
+/**
+ * Shows the other viewers on the selected project and marks the tasks they are editing
+ * @returns {void}
+ */
+function presenceApply() {
+    const projectRegion = document.querySelector(".project-region-selected");
+    if (projectRegion != null) {
+        const logins = [...new Set(Array.from(presenceViewers.values()).map((viewer) => viewer.login))];
+        projectRegion.title = logins.length > 0 ? `Also viewing: ${logins.join(", ")}` : "";
+    }
+
+    document.querySelectorAll(".task-region.edited-elsewhere").forEach((taskRegion) => {
+        taskRegion.classList.remove("edited-elsewhere");
+        taskRegion.title = "";
+    });
+    presenceViewers.forEach((viewer) => {
+        const taskRegion = viewer.task ? document.getElementById(viewer.task) : null;
+        if (taskRegion != null) {
+            taskRegion.classList.add("edited-elsewhere");
+            taskRegion.title = `Being edited by ${viewer.login}`;
+        }
+    });
+}
+
 function checkConnection() {
     return appEvent.eventSocket.readyState == WebSocket.OPEN;
 }
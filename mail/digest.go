@@ -0,0 +1,165 @@
+package mail
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"todopp/store"
+	"todopp/util"
+
+	_ "time/tzdata"
+)
+
+// Starts a background loop which sends the scheduled task digests
+func StartDigestScheduler() {
+	go func() {
+		for {
+			err := sendScheduledDigests(time.Now())
+			if err != nil {
+				fmt.Println("Error sending digests: ", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func sendScheduledDigests(now time.Time) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	settingsList, err := store.GetActiveDigestSettings(db)
+	if err != nil {
+		return err
+	}
+
+	for _, settings := range settingsList {
+		scheduled, period := GetLastDigestTime(settings, now)
+		// last_sent survives restarts, so a digest is sent only once per scheduled time
+		if settings.LastSent >= scheduled.UnixMilli() {
+			continue
+		}
+
+		digestTasks, err := store.GetDigestTasks(db, settings.UserId, now.UnixMilli(), now.Add(period).UnixMilli(), scheduled.Add(-period).UnixMilli())
+		if err != nil {
+			fmt.Println("Error collecting digest tasks: ", err)
+			continue
+		}
+
+		err = SendDigestEmail(settings.Email, settings.Schedule, digestTasks, scheduled.Location())
+		if err != nil {
+			fmt.Println("Error sending digest: ", err)
+			continue
+		}
+
+		err = store.SetDigestLastSent(db, settings.UserId, now.UnixMilli())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the most recent scheduled digest time not after now and the digest period
+func GetLastDigestTime(settings store.DigestSettings, now time.Time) (time.Time, time.Duration) {
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+
+	days := 1
+	scheduled := time.Date(local.Year(), local.Month(), local.Day(), settings.Hour, 0, 0, 0, location)
+	if settings.Schedule == "weekly" {
+		days = 7
+		scheduled = scheduled.AddDate(0, 0, -((int(local.Weekday()) - settings.Weekday + 7) % 7))
+	}
+	if scheduled.After(local) {
+		scheduled = scheduled.AddDate(0, 0, -days)
+	}
+
+	return scheduled, time.Duration(days) * 24 * time.Hour
+}
+
+func SendDigestEmail(email string, schedule string, digestTasks store.DigestTasks, location *time.Location) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	sections := []struct {
+		title string
+		tasks []store.DigestTask
+	}{
+		{"Overdue", digestTasks.Overdue},
+		{"Due soon", digestTasks.DueSoon},
+		{"In progress", digestTasks.InProgress},
+		{"Completed", digestTasks.Completed},
+	}
+
+	var textBody strings.Builder
+	var htmlSections strings.Builder
+
+	for _, section := range sections {
+		if len(section.tasks) == 0 {
+			continue
+		}
+
+		textBody.WriteString(section.title + ":\n")
+		htmlSections.WriteString("<h3>" + section.title + "</h3><ul>")
+		for _, task := range section.tasks {
+			line := task.Project + " / " + task.Group + " / " + task.Name
+			due := ""
+			if task.Due > 0 {
+				due = " (due " + time.UnixMilli(task.Due).In(location).Format("2006-01-02 15:04") + ")"
+			}
+			textBody.WriteString("  - " + line + due + "\n")
+			htmlSections.WriteString("<li>" + html.EscapeString(line) + html.EscapeString(due) + "</li>")
+		}
+		textBody.WriteString("\n")
+		htmlSections.WriteString("</ul>")
+	}
+
+	if textBody.Len() == 0 {
+		textBody.WriteString("Nothing to report for this period.\n")
+		htmlSections.WriteString("<p>Nothing to report for this period.</p>")
+	}
+
+	appLink := "https://" + config.Domain + "/"
+	textBody.WriteString("Open ToDo++: " + appLink)
+
+	htmlBody := fmt.Sprintf(`
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<style>
+			.container {
+				max-width: 600px;
+				margin: 0 auto;
+				font-family: Arial, sans-serif;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<h2>Your %s task digest</h2>
+			%s
+			<p><a href="%s">Open ToDo++</a></p>
+		</div>
+	</body>
+	</html>
+	`, schedule, htmlSections.String(), appLink)
+
+	subject := "Your " + schedule + " ToDo++ digest"
+
+	return SendMail(email, subject, textBody.String(), htmlBody)
+}
@@ -0,0 +1,232 @@
+package mail
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+)
+
+const gatewayMaxMessageSize = 1 << 20
+const gatewayMaxRecipients = 10
+const gatewaySessionTimeout = 5 * time.Minute
+
+// Minimal SMTP listener which turns messages sent to "task+<token>@<domain>" into tasks
+type Gateway struct {
+	Domain string
+	// reports whether the recipient token belongs to a user with a configured default group
+	IsValidToken func(token string) bool
+	// receives the message for every accepted recipient token, an error rejects the message with a 554 reply
+	OnMessage func(token string, subject string, body string) error
+}
+
+func (gateway *Gateway) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go gateway.serve(conn)
+	}
+}
+
+func (gateway *Gateway) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(gatewaySessionTimeout))
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 %s ToDo++ mail gateway", gateway.Domain)
+
+	var tokens []string
+	hasSender := false
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		command, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "HELO", "EHLO":
+			text.PrintfLine("250 %s", gateway.Domain)
+		case "MAIL":
+			tokens = nil
+			hasSender = true
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if !hasSender {
+				text.PrintfLine("503 MAIL command required first")
+				continue
+			}
+			if len(tokens) >= gatewayMaxRecipients {
+				text.PrintfLine("452 Too many recipients")
+				continue
+			}
+			token, ok := gateway.parseRecipient(argument)
+			if !ok || !gateway.IsValidToken(token) {
+				text.PrintfLine("550 No such mailbox")
+				continue
+			}
+			// a repeated recipient adds the task once
+			if !slices.Contains(tokens, token) {
+				tokens = append(tokens, token)
+			}
+			text.PrintfLine("250 OK")
+		case "DATA":
+			if len(tokens) == 0 {
+				text.PrintfLine("503 RCPT command required first")
+				continue
+			}
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+
+			dotReader := text.DotReader()
+			data, err := io.ReadAll(io.LimitReader(dotReader, gatewayMaxMessageSize+1))
+			if err != nil {
+				return
+			}
+			if len(data) > gatewayMaxMessageSize {
+				// drain the rest of the message before answering
+				io.Copy(io.Discard, dotReader)
+				text.PrintfLine("552 Message size exceeds limit")
+			} else if err = gateway.deliver(tokens, data); err != nil {
+				fmt.Println("Error processing incoming mail: ", err)
+				text.PrintfLine("554 Transaction failed")
+			} else {
+				text.PrintfLine("250 OK")
+			}
+			tokens = nil
+			hasSender = false
+		case "RSET":
+			tokens = nil
+			hasSender = false
+			text.PrintfLine("250 OK")
+		case "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// Extracts the token from a "TO:<task+token@domain>" argument
+func (gateway *Gateway) parseRecipient(argument string) (string, bool) {
+	prefix, address, ok := strings.Cut(argument, ":")
+	if !ok || !strings.EqualFold(strings.TrimSpace(prefix), "TO") {
+		return "", false
+	}
+
+	parsedAddress, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", false
+	}
+
+	localPart, domain, ok := strings.Cut(parsedAddress.Address, "@")
+	if !ok || (gateway.Domain != "" && !strings.EqualFold(domain, gateway.Domain)) {
+		return "", false
+	}
+
+	_, token, ok := strings.Cut(localPart, "+")
+	if !ok || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+func (gateway *Gateway) deliver(tokens []string, data []byte) error {
+	message, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		subject = message.Header.Get("Subject")
+	}
+
+	body, err := readTextBody(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Body)
+	if err != nil {
+		return err
+	}
+
+	// a recipient may have become invalid since it was accepted. The message is rejected before any task is
+	// added, so the retry of the sender doesn't add the tasks of the other recipients again
+	for _, token := range tokens {
+		if !gateway.IsValidToken(token) {
+			return errors.New("mail gateway token is invalid")
+		}
+	}
+
+	for _, token := range tokens {
+		err = gateway.OnMessage(token, strings.TrimSpace(subject), strings.TrimSpace(body))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the text/plain content of the message, looking into multipart messages if necessary
+func readTextBody(contentType string, transferEncoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := readTextBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	switch strings.ToLower(transferEncoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	content, err := io.ReadAll(body)
+	return string(content), err
+}
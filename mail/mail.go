@@ -3,6 +3,7 @@ package mail
 import (
 	"crypto/tls"
 	"fmt"
+	"html"
 	"net/mail"
 	"net/smtp"
 	"strings"
@@ -152,6 +153,101 @@ func SendConfirmationEmail(email string, token string) error {
 	return SendMail(email, subject, textBody, htmlBody)
 }
 
+func SendPasswordResetEmail(email string, token string) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	resetLink := fmt.Sprintf("https://"+config.Domain+"/login.html?reset_token=%s", token)
+
+	htmlBody := fmt.Sprintf(`
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<style>
+			.button {
+				background-color: #ff4444;
+				color: white;
+				padding: 12px 24px;
+				text-align: center;
+				text-decoration: none;
+				display: inline-block;
+				font-size: 16px;
+				margin: 4px 2px;
+				cursor: pointer;
+				border-radius: 4px;
+				border: none;
+    			transition: background 0.3s;
+			}
+			button:hover {
+				background: darkred;
+			}
+			.container {
+				max-width: 600px;
+				margin: 0 auto;
+				font-family: Arial, sans-serif;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<h2>Password Reset</h2>
+			<p>We received a request to reset your password. Click the button below to choose a new one:</p>
+			<a href="%s" class="button">Reset Password</a>
+			<p>Or copy this link to your browser: %s</p>
+			<p>The link expires in one hour. If you didn't request a password reset, you can ignore this email.</p>
+		</div>
+	</body>
+	</html>
+	`, resetLink, resetLink)
+
+	textBody := fmt.Sprintf("Reset your password by visiting this link (valid for one hour):\n%s\n\nIf you didn't request a password reset, you can ignore this email.", resetLink)
+
+	subject := "Reset Your Password"
+
+	return SendMail(email, subject, textBody, htmlBody)
+}
+
+func SendLockoutAlertEmail(email string, login string, ip string, lockedUntil time.Time) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	resetLink := "https://" + config.Domain + "/login.html"
+	until := lockedUntil.UTC().Format("2006-01-02 15:04 MST")
+
+	htmlBody := fmt.Sprintf(`
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<style>
+			.container {
+				max-width: 600px;
+				margin: 0 auto;
+				font-family: Arial, sans-serif;
+			}
+		</style>
+	</head>
+	<body>
+		<div class="container">
+			<h2>Account Temporarily Locked</h2>
+			<p>There were too many failed login attempts for your account <b>%s</b>, the last one from the IP address %s.</p>
+			<p>Logins are blocked until %s.</p>
+			<p>If these attempts were not made by you, consider changing your password with the password reset on the <a href="%s">login page</a>.</p>
+		</div>
+	</body>
+	</html>
+	`, html.EscapeString(login), html.EscapeString(ip), until, resetLink)
+
+	textBody := fmt.Sprintf("There were too many failed login attempts for your account %s, the last one from the IP address %s.\nLogins are blocked until %s.\n\nIf these attempts were not made by you, consider changing your password with the password reset on the login page:\n%s", login, ip, until, resetLink)
+
+	subject := "Your Account Is Temporarily Locked"
+
+	return SendMail(email, subject, textBody, htmlBody)
+}
+
 func ParseAddress(address string) (*mail.Address, error) {
 	return mail.ParseAddress(address)
 }
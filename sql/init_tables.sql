@@ -4,7 +4,9 @@ create table if not exists user (
 	login text unique,
 	password_hash text,
 	email text,
-	is_active int 
+	is_active int,
+	token_valid_after int,
+	is_disabled int
 );
 
 create table if not exists project (
@@ -34,6 +36,8 @@ create table if not exists task (
 	sequence integer,
 	task_status_id int,
 	task_group_id text,
+	due_utc_time int,
+	status_utc_time int,
 	foreign key (task_status_id) references task_status(task_status_id),
 	foreign key (task_group_id) references task_group (task_group_id)
 );
@@ -69,8 +73,26 @@ where not exists (
 );
 
 
+create table if not exists change_log (
+	revision integer primary key autoincrement,
+	user_id text,
+	entity_type text,
+	entity_id text,
+	is_deleted int,
+	utc_time int,
+	foreign key (user_id) references user(user_id)
+);
+
+create index if not exists change_log_user on change_log (user_id, revision);
+
+create index if not exists change_log_entity on change_log (entity_type, entity_id);
+
 create table if not exists jwt (
-	jwt_key text
+	jwt_key text,
+	kid text,
+	algorithm text,
+	created_utc_time int,
+	retire_utc_time int
 );
 
 create table if not exists user_secret (
@@ -80,3 +102,122 @@ create table if not exists user_secret (
 	target text,
 	foreign key (user_id) references user(user_id)
 );
+
+
+create table if not exists attachment (
+	attachment_id text primary key,
+	task_id text,
+	user_id text,
+	file_name text,
+	content_type text,
+	size int,
+	utc_time int,
+	foreign key (task_id) references task(task_id),
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists user_digest (
+	user_id text primary key,
+	schedule text,
+	timezone text,
+	hour int,
+	weekday int,
+	last_sent int,
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists webhook (
+	webhook_id text primary key,
+	user_id text,
+	url text,
+	secret text,
+	event_types text,
+	is_active int,
+	failure_count int,
+	utc_time int,
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists webhook_delivery (
+	delivery_id text,
+	webhook_id text,
+	event_type text,
+	payload text,
+	attempt int,
+	status_code int,
+	error text,
+	is_success int,
+	utc_time int,
+	primary key (delivery_id, attempt),
+	foreign key (webhook_id) references webhook(webhook_id)
+);
+
+create table if not exists mail_gateway (
+	user_id text primary key,
+	token text unique,
+	task_group_id text,
+	foreign key (user_id) references user(user_id),
+	foreign key (task_group_id) references task_group(task_group_id)
+);
+
+create table if not exists session (
+	session_id text primary key,
+	user_id text,
+	refresh_hash text unique,
+	previous_refresh_hash text,
+	device_name text,
+	ip text,
+	created_utc_time int,
+	last_seen_utc_time int,
+	rotated_utc_time int,
+	expire_utc_time int,
+	is_revoked int,
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists user_totp (
+	user_id text primary key,
+	secret text,
+	is_enabled int,
+	last_step int,
+	utc_time int,
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists recovery_code (
+	user_id text,
+	code_hash text,
+	is_used int,
+	primary key (user_id, code_hash),
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists access_token (
+	token_id text primary key,
+	user_id text,
+	name text,
+	token_hash text unique,
+	scopes text,
+	created_utc_time int,
+	expire_utc_time int,
+	last_used_utc_time int,
+	is_revoked int,
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists user_identity (
+	issuer text,
+	subject text,
+	user_id text,
+	email text,
+	utc_time int,
+	primary key (issuer, subject),
+	foreign key (user_id) references user(user_id)
+);
+
+create table if not exists login_attempt (
+	attempt_key text primary key,
+	failures int,
+	last_failure_utc_time int,
+	blocked_until_utc_time int
+);
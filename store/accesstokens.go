@@ -0,0 +1,137 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type AccessToken struct {
+	TokenId   string `json:"id"`
+	UserId    string `json:"-"`
+	Name      string `json:"name"`
+	TokenHash string `json:"-"`
+	Scopes    string `json:"scopes"` // comma separated scopes
+	Created   int64  `json:"created"`
+	Expire    int64  `json:"expire"` // 0 if the token never expires
+	LastUsed  int64  `json:"lastused"`
+	IsRevoked int    `json:"-"`
+}
+
+const accessTokenColumns = `
+	token_id, user_id, name, token_hash, scopes, created_utc_time, COALESCE(expire_utc_time, 0), COALESCE(last_used_utc_time, 0), is_revoked`
+
+func scanAccessToken(row interface{ Scan(...any) error }) (*AccessToken, error) {
+	var accessToken AccessToken
+	err := row.Scan(
+		&accessToken.TokenId,
+		&accessToken.UserId,
+		&accessToken.Name,
+		&accessToken.TokenHash,
+		&accessToken.Scopes,
+		&accessToken.Created,
+		&accessToken.Expire,
+		&accessToken.LastUsed,
+		&accessToken.IsRevoked)
+	if err != nil {
+		return nil, err
+	}
+	return &accessToken, nil
+}
+
+func InsertAccessToken(db Querier, accessToken AccessToken) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM access_token WHERE token_id = ?)", accessToken.TokenId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("An access token with ID '" + accessToken.TokenId + "' is already registered")
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO access_token (token_id, user_id, name, token_hash, scopes, created_utc_time, expire_utc_time, last_used_utc_time, is_revoked)
+	VALUES (?, ?, ?, ?, ?, ?, ?, 0, 0)`,
+		accessToken.TokenId,
+		accessToken.UserId,
+		accessToken.Name,
+		accessToken.TokenHash,
+		accessToken.Scopes,
+		accessToken.Created,
+		accessToken.Expire)
+
+	return err
+}
+
+// Returns the access token with the hash or nil if not found
+func GetAccessTokenByHash(db Querier, tokenHash string) (*AccessToken, error) {
+	row := db.QueryRow("SELECT "+accessTokenColumns+" FROM access_token WHERE token_hash = ?", tokenHash)
+
+	accessToken, err := scanAccessToken(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return accessToken, err
+}
+
+// Returns the access tokens of the user which are not revoked, including expired ones
+func GetUserAccessTokens(db Querier, userId string) ([]AccessToken, error) {
+	rows, err := db.Query("SELECT "+accessTokenColumns+" FROM access_token WHERE user_id = ? AND is_revoked = 0 ORDER BY created_utc_time", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accessTokens := []AccessToken{}
+	for rows.Next() {
+		accessToken, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		accessTokens = append(accessTokens, *accessToken)
+	}
+	return accessTokens, rows.Err()
+}
+
+func SetAccessTokenLastUsed(db Querier, tokenId string, utcTime int64) error {
+	_, err := db.Exec("UPDATE access_token SET last_used_utc_time = ? WHERE token_id = ?", utcTime, tokenId)
+	return err
+}
+
+func RevokeAccessToken(db Querier, userId string, tokenId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM access_token WHERE token_id = ? AND user_id = ? AND is_revoked = 0)", tokenId, userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("An access token with ID '" + tokenId + "' is not registered")
+	}
+
+	_, err = db.Exec("UPDATE access_token SET is_revoked = 1 WHERE token_id = ?", tokenId)
+	return err
+}
+
+// Revokes all access tokens of the user and returns the ids of the revoked tokens
+func RevokeUserAccessTokens(db Querier, userId string) ([]string, error) {
+	rows, err := db.Query("SELECT token_id FROM access_token WHERE user_id = ? AND is_revoked = 0", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokenIds []string
+	for rows.Next() {
+		var tokenId string
+		err = rows.Scan(&tokenId)
+		if err != nil {
+			return nil, err
+		}
+		tokenIds = append(tokenIds, tokenId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("UPDATE access_token SET is_revoked = 1 WHERE user_id = ?", userId)
+	return tokenIds, err
+}
@@ -1,14 +1,19 @@
 package store
 
-import "database/sql"
-
 type AllData struct {
+	Revision int64       `json:"revision"` // revision to pass as since to the first changes request
 	Projects []Project   `json:"projects"`
 	Groups   []TaskGroup `json:"groups"`
 	Tasks    []Task      `json:"tasks"`
 }
 
-func GetAllUserData(db *sql.DB, userId string) (AllData, error) {
+func GetAllUserData(db Querier, userId string) (AllData, error) {
+	// read first, so a change made while the data is read is returned by the next changes request
+	revision, err := GetRevision(db)
+	if err != nil {
+		return AllData{}, err
+	}
+
 	projects, err := GetProjects(db, userId)
 	if err != nil {
 		return AllData{}, err
@@ -26,6 +31,7 @@ func GetAllUserData(db *sql.DB, userId string) (AllData, error) {
 
 	var allData AllData
 
+	allData.Revision = revision
 	allData.Projects = projects
 	allData.Groups = groups
 	allData.Tasks = tasks
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type Attachment struct {
+	AttachmentId string `json:"id"`
+	TaskId       string `json:"task"`
+	UserId       string `json:"-"`
+	FileName     string `json:"name"`
+	ContentType  string `json:"contenttype"`
+	Size         int64  `json:"size"`
+	UtcTime      int64  `json:"utctime"`
+}
+
+func InsertAttachment(db Querier, attachment Attachment) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM attachment WHERE attachment_id = ?)", attachment.AttachmentId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("An attachment with ID '" + attachment.AttachmentId + "' is already registered")
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO attachment (attachment_id, task_id, user_id, file_name, content_type, size, utc_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		attachment.AttachmentId,
+		attachment.TaskId,
+		attachment.UserId,
+		attachment.FileName,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.UtcTime)
+
+	return err
+}
+
+func GetAttachment(db Querier, attachmentId string) (*Attachment, error) {
+	var attachment Attachment
+
+	err := db.QueryRow(`
+		SELECT attachment_id, task_id, user_id, file_name, content_type, size, utc_time
+		FROM attachment
+		WHERE attachment_id = ?
+		`, attachmentId).Scan(
+		&attachment.AttachmentId,
+		&attachment.TaskId,
+		&attachment.UserId,
+		&attachment.FileName,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.UtcTime)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("An attachment with ID '" + attachmentId + "' is not registered")
+	}
+
+	return &attachment, err
+}
+
+func GetAttachmentsByTask(db Querier, taskId string) ([]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT attachment_id, task_id, user_id, file_name, content_type, size, utc_time
+		FROM attachment
+		WHERE task_id = ?
+		ORDER BY utc_time
+		`, taskId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var attachment Attachment
+		err = rows.Scan(
+			&attachment.AttachmentId,
+			&attachment.TaskId,
+			&attachment.UserId,
+			&attachment.FileName,
+			&attachment.ContentType,
+			&attachment.Size,
+			&attachment.UtcTime)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+func GetAttachmentIds(db Querier) (map[string]bool, error) {
+	rows, err := db.Query("SELECT attachment_id FROM attachment")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachmentIds := make(map[string]bool)
+	for rows.Next() {
+		var attachmentId string
+		err = rows.Scan(&attachmentId)
+		if err != nil {
+			return nil, err
+		}
+		attachmentIds[attachmentId] = true
+	}
+
+	return attachmentIds, nil
+}
+
+// Returns the total size in bytes of all attachments uploaded by the user
+func GetUserAttachmentsSize(db Querier, userId string) (int64, error) {
+	var size int64
+	err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM attachment WHERE user_id = ?", userId).Scan(&size)
+	return size, err
+}
+
+func DeleteAttachment(db Querier, attachmentId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM attachment WHERE attachment_id = ?)", attachmentId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("An attachment with ID '" + attachmentId + "' is not registered")
+	}
+
+	_, err = db.Exec(`DELETE FROM attachment WHERE attachment_id = ?`, attachmentId)
+	return err
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"time"
+)
+
+// Entity types recorded in the change log
+const (
+	ChangeTypeProject = "project"
+	ChangeTypeGroup   = "group"
+	ChangeTypeTask    = "task"
+)
+
+// Reference to a deleted project, group or task
+type Tombstone struct {
+	Type     string `json:"type"`
+	Id       string `json:"id"`
+	Revision int64  `json:"revision"`
+}
+
+// Projects, groups and tasks changed after a revision. The entities hold their current state,
+// which may already include changes of later revisions; applying them again is harmless
+type Changes struct {
+	Revision int64       `json:"revision"` // revision to pass as since to the next request
+	Projects []Project   `json:"projects"`
+	Groups   []TaskGroup `json:"groups"`
+	Tasks    []Task      `json:"tasks"`
+	Deleted  []Tombstone `json:"deleted"`
+}
+
+// Records a change of the project, group or task under the next revision. Only the latest change
+// of an entity is kept, so the log grows with the number of entities rather than with their changes.
+// The revision is assigned by the insert, so revisions become visible in increasing order
+func recordChange(db Querier, userId string, entityType string, entityId string, isDeleted bool) error {
+	result, err := db.Exec(`
+	INSERT INTO change_log (user_id, entity_type, entity_id, is_deleted, utc_time)
+	VALUES (?, ?, ?, ?, ?)`,
+		userId, entityType, entityId, isDeleted, time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	revision, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM change_log WHERE entity_type = ? AND entity_id = ? AND revision < ?", entityType, entityId, revision)
+	return err
+}
+
+// Records a change of the task for the owner of its group
+func recordTaskChange(db Querier, taskId string) error {
+	userId, err := GetTaskUserId(db, taskId)
+	if err != nil {
+		return err
+	}
+	return recordChange(db, userId, ChangeTypeTask, taskId, false)
+}
+
+// Records the deletion of the entities of the type returned by the query
+func recordDeletions(db Querier, userId string, entityType string, query string, args ...any) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var entityIds []string
+	for rows.Next() {
+		var entityId string
+		err = rows.Scan(&entityId)
+		if err != nil {
+			return err
+		}
+		entityIds = append(entityIds, entityId)
+	}
+	rows.Close()
+
+	// recorded once the rows are read, so a single connection is enough, e.g. in a transaction
+	for _, entityId := range entityIds {
+		err = recordChange(db, userId, entityType, entityId, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the latest revision of the server, 0 if nothing has changed yet
+func GetRevision(db Querier) (int64, error) {
+	var revision int64
+	err := db.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM change_log").Scan(&revision)
+	return revision, err
+}
+
+// Returns the projects, groups and tasks of the user changed after the revision with the tombstones
+// of the deleted ones. The revision is read first, so a change made meanwhile is returned again next time
+func GetChangesSince(db Querier, userId string, since int64) (Changes, error) {
+	changes := Changes{Projects: []Project{}, Groups: []TaskGroup{}, Tasks: []Task{}, Deleted: []Tombstone{}}
+
+	revision, err := GetRevision(db)
+	if err != nil {
+		return changes, err
+	}
+	changes.Revision = revision
+
+	projectRows, err := db.Query(`
+		SELECT p.project_id, p.name, p.sequence
+		FROM project p
+		INNER JOIN change_log c ON c.entity_type = 'project' AND c.entity_id = p.project_id
+		WHERE c.user_id = ? AND c.revision > ? AND c.is_deleted = 0
+		ORDER BY p.sequence
+		`, userId, since)
+	if err != nil {
+		return changes, err
+	}
+	defer projectRows.Close()
+	for projectRows.Next() {
+		var project Project
+		err = projectRows.Scan(&project.ProjectId, &project.Name, &project.Sequence)
+		if err != nil {
+			return changes, err
+		}
+		project.UserId = userId
+		changes.Projects = append(changes.Projects, project)
+	}
+	projectRows.Close()
+
+	groupRows, err := db.Query(`
+		SELECT g.task_group_id, g.name, g.sequence, g.project_id
+		FROM task_group g
+		INNER JOIN change_log c ON c.entity_type = 'group' AND c.entity_id = g.task_group_id
+		WHERE c.user_id = ? AND c.revision > ? AND c.is_deleted = 0
+		ORDER BY g.sequence
+		`, userId, since)
+	if err != nil {
+		return changes, err
+	}
+	defer groupRows.Close()
+	for groupRows.Next() {
+		var taskGroup TaskGroup
+		err = groupRows.Scan(&taskGroup.TaskGroupId, &taskGroup.Name, &taskGroup.Sequence, &taskGroup.ProjectId)
+		if err != nil {
+			return changes, err
+		}
+		changes.Groups = append(changes.Groups, taskGroup)
+	}
+	groupRows.Close()
+
+	taskRows, err := db.Query(`
+		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, t.sequence, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
+		FROM task t
+		INNER JOIN change_log c ON c.entity_type = 'task' AND c.entity_id = t.task_id
+		WHERE c.user_id = ? AND c.revision > ? AND c.is_deleted = 0
+		ORDER BY t.sequence
+		`, userId, since)
+	if err != nil {
+		return changes, err
+	}
+	defer taskRows.Close()
+	for taskRows.Next() {
+		var task Task
+		err = taskRows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Sequence, &task.Due, &task.StatusTime)
+		if err != nil {
+			return changes, err
+		}
+		changes.Tasks = append(changes.Tasks, task)
+	}
+	taskRows.Close()
+
+	tombstoneRows, err := db.Query(`
+		SELECT entity_type, entity_id, revision
+		FROM change_log
+		WHERE user_id = ? AND revision > ? AND is_deleted = 1
+		ORDER BY revision
+		`, userId, since)
+	if err != nil {
+		return changes, err
+	}
+	defer tombstoneRows.Close()
+	for tombstoneRows.Next() {
+		var tombstone Tombstone
+		err = tombstoneRows.Scan(&tombstone.Type, &tombstone.Id, &tombstone.Revision)
+		if err != nil {
+			return changes, err
+		}
+		changes.Deleted = append(changes.Deleted, tombstone)
+	}
+	return changes, tombstoneRows.Err()
+}
+
+// Records the entities stored before the change log existed, so clients syncing from revision 0 get them
+func initChangeLog(db Querier) error {
+	_, err := db.Exec(`
+	INSERT INTO change_log (user_id, entity_type, entity_id, is_deleted, utc_time)
+	SELECT p.user_id, 'project', p.project_id, 0, ?
+	FROM project p
+	WHERE NOT EXISTS (SELECT 1 FROM change_log c WHERE c.entity_type = 'project' AND c.entity_id = p.project_id)`,
+		time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO change_log (user_id, entity_type, entity_id, is_deleted, utc_time)
+	SELECT p.user_id, 'group', g.task_group_id, 0, ?
+	FROM task_group g
+	INNER JOIN project p ON p.project_id = g.project_id
+	WHERE NOT EXISTS (SELECT 1 FROM change_log c WHERE c.entity_type = 'group' AND c.entity_id = g.task_group_id)`,
+		time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO change_log (user_id, entity_type, entity_id, is_deleted, utc_time)
+	SELECT p.user_id, 'task', t.task_id, 0, ?
+	FROM task t
+	INNER JOIN task_group g ON g.task_group_id = t.task_group_id
+	INNER JOIN project p ON p.project_id = g.project_id
+	WHERE NOT EXISTS (SELECT 1 FROM change_log c WHERE c.entity_type = 'task' AND c.entity_id = t.task_id)`,
+		time.Now().UTC().UnixMilli())
+	return err
+}
@@ -8,8 +8,22 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Runs the statements of the functions of this package. Satisfied by *sql.DB and *sql.Tx, so the same
+// functions serve single statements and transactions
+type Querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 func OpenDb(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// concurrent writers wait for the lock instead of failing with "database is locked". Transactions take
+	// the write lock when they begin, so two of them can't deadlock upgrading their read locks
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", dbPath+separator+"_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
@@ -17,13 +31,13 @@ func OpenDb(dbPath string) (*sql.DB, error) {
 	return db, err
 }
 
-func IsTableEmpty(db *sql.DB, tableName string) (bool, error) {
+func IsTableEmpty(db Querier, tableName string) (bool, error) {
 	var exists bool
 	err := db.QueryRow("SELECT NOT EXISTS (SELECT 1 FROM " + tableName + " LIMIT 1)").Scan(&exists)
 	return exists, err
 }
 
-func ExecScript(db *sql.DB, sqlScript string) error {
+func ExecScript(db Querier, sqlScript string) error {
 	queries := strings.Split(string(sqlScript), ";")
 
 	for _, query := range queries {
@@ -41,18 +55,18 @@ func ExecScript(db *sql.DB, sqlScript string) error {
 	return nil
 }
 
-func IsTableFieldExists(db *sql.DB, tableName string, fieldName string) (bool, error) {
+func IsTableFieldExists(db Querier, tableName string, fieldName string) (bool, error) {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ? )", tableName, fieldName).Scan(&exists)
 	return exists, err
 }
 
-func dropField(db *sql.DB, tableName string, fieldName string) error {
+func dropField(db Querier, tableName string, fieldName string) error {
 	_, err := db.Exec("ALTER TABLE " + tableName + " DROP COLUMN " + fieldName)
 	return err
 }
 
-func addField(db *sql.DB, tableName string, fieldName string, fieldType string) error {
+func addField(db Querier, tableName string, fieldName string, fieldType string) error {
 	_, err := db.Exec("ALTER TABLE " + tableName + " ADD " + fieldName + " " + fieldType)
 	return err
 }
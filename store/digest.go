@@ -0,0 +1,147 @@
+package store
+
+import (
+	"database/sql"
+)
+
+type DigestSettings struct {
+	UserId   string `json:"-"`
+	Email    string `json:"-"`
+	Schedule string `json:"schedule"` // off, daily or weekly
+	Timezone string `json:"timezone"`
+	Hour     int    `json:"hour"`
+	Weekday  int    `json:"weekday"` // used by the weekly schedule, 0 is Sunday
+	LastSent int64  `json:"lastsent"`
+}
+
+type DigestTask struct {
+	Name       string
+	Project    string
+	Group      string
+	Due        int64
+	StatusTime int64
+}
+
+type DigestTasks struct {
+	InProgress []DigestTask
+	DueSoon    []DigestTask
+	Overdue    []DigestTask
+	Completed  []DigestTask
+}
+
+func GetDigestSettings(db Querier, userId string) (DigestSettings, error) {
+	settings := DigestSettings{UserId: userId, Schedule: "off", Timezone: "UTC", Hour: 8, Weekday: 1}
+
+	err := db.QueryRow(`
+		SELECT schedule, timezone, hour, weekday, last_sent
+		FROM user_digest
+		WHERE user_id = ?
+		`, userId).Scan(&settings.Schedule, &settings.Timezone, &settings.Hour, &settings.Weekday, &settings.LastSent)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+
+	return settings, err
+}
+
+func UpsertDigestSettings(db Querier, settings DigestSettings) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_digest WHERE user_id = ?)", settings.UserId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		_, err = db.Exec(`
+		UPDATE user_digest
+		SET
+			 schedule = ?
+		   , timezone = ?
+		   , hour = ?
+		   , weekday = ?
+		   , last_sent = ?
+		WHERE user_id = ?`,
+			settings.Schedule, settings.Timezone, settings.Hour, settings.Weekday, settings.LastSent, settings.UserId)
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO user_digest (user_id, schedule, timezone, hour, weekday, last_sent)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		settings.UserId, settings.Schedule, settings.Timezone, settings.Hour, settings.Weekday, settings.LastSent)
+	return err
+}
+
+// Returns the digest settings of all active users who subscribed to a digest and have an email
+func GetActiveDigestSettings(db Querier) ([]DigestSettings, error) {
+	rows, err := db.Query(`
+		SELECT d.user_id, u.email, d.schedule, d.timezone, d.hour, d.weekday, d.last_sent
+		FROM user_digest d
+		INNER JOIN user u ON u.user_id = d.user_id
+		WHERE d.schedule <> 'off'
+		  AND u.is_active = 1
+		  AND COALESCE(u.email, '') <> ''
+		`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var settingsList []DigestSettings
+	for rows.Next() {
+		var settings DigestSettings
+		err = rows.Scan(&settings.UserId, &settings.Email, &settings.Schedule, &settings.Timezone, &settings.Hour, &settings.Weekday, &settings.LastSent)
+		if err != nil {
+			return nil, err
+		}
+		settingsList = append(settingsList, settings)
+	}
+
+	return settingsList, nil
+}
+
+func SetDigestLastSent(db Querier, userId string, lastSent int64) error {
+	_, err := db.Exec("UPDATE user_digest SET last_sent = ? WHERE user_id = ?", lastSent, userId)
+	return err
+}
+
+// Collects tasks for the digest: tasks in progress, tasks due before dueBefore, overdue tasks
+// and tasks completed between completedFrom and now (all times are utc milliseconds)
+func GetDigestTasks(db Querier, userId string, now int64, dueBefore int64, completedFrom int64) (DigestTasks, error) {
+	rows, err := db.Query(`
+		SELECT t.name, p.name, g.name, t.task_status_id, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
+		FROM task t
+		INNER JOIN task_group g ON g.task_group_id = t.task_group_id
+		INNER JOIN project p ON p.project_id = g.project_id
+		WHERE p.user_id = ?
+		ORDER BY p.sequence, g.sequence, t.sequence
+		`, userId)
+	if err != nil {
+		return DigestTasks{}, err
+	}
+	defer rows.Close()
+
+	var digestTasks DigestTasks
+	for rows.Next() {
+		var task DigestTask
+		var taskStatusId int
+		err = rows.Scan(&task.Name, &task.Project, &task.Group, &taskStatusId, &task.Due, &task.StatusTime)
+		if err != nil {
+			return DigestTasks{}, err
+		}
+
+		isOpen := taskStatusId == 1 || taskStatusId == 2
+		switch {
+		case isOpen && task.Due > 0 && task.Due < now:
+			digestTasks.Overdue = append(digestTasks.Overdue, task)
+		case isOpen && task.Due > 0 && task.Due < dueBefore:
+			digestTasks.DueSoon = append(digestTasks.DueSoon, task)
+		case taskStatusId == 2:
+			digestTasks.InProgress = append(digestTasks.InProgress, task)
+		case taskStatusId == 3 && task.StatusTime >= completedFrom && task.StatusTime <= now:
+			digestTasks.Completed = append(digestTasks.Completed, task)
+		}
+	}
+
+	return digestTasks, nil
+}
@@ -11,7 +11,7 @@ type Event struct {
 	IsError  int
 }
 
-func InsertEvent(db *sql.DB, event Event) error {
+func InsertEvent(db Querier, event Event) error {
 	_, err := db.Exec(`
 	INSERT INTO event (event_id, utc_time, user_id, payload, responce, is_error) 
 	VALUES (?, ?, ?, ?, ?, ?)`,
@@ -19,3 +19,44 @@ func InsertEvent(db *sql.DB, event Event) error {
 
 	return err
 }
+
+// Returns the id of the latest change of the user, or an empty string if there is none yet
+func GetLastEventId(db Querier, userId string) (string, error) {
+	var eventId string
+	err := db.QueryRow(`
+	SELECT event_id FROM event WHERE user_id = ? AND is_error = 0 ORDER BY rowid DESC LIMIT 1`, userId).Scan(&eventId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return eventId, err
+}
+
+func IsEventExists(db Querier, userId string, eventId string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM event WHERE user_id = ? AND event_id = ?)", userId, eventId).Scan(&exists)
+	return exists, err
+}
+
+// Returns the changes of the user stored after the event in the order they were applied, from the first one
+// if the id is empty. Rejected events are left out, they were only sent to the client which sent them
+func GetEventsAfter(db Querier, userId string, eventId string, limit int) ([]Event, error) {
+	rows, err := db.Query(`
+	SELECT event_id, utc_time, user_id, payload, responce, is_error FROM event
+	WHERE user_id = ? AND is_error = 0 AND rowid > COALESCE((SELECT rowid FROM event WHERE user_id = ? AND event_id = ?), 0)
+	ORDER BY rowid LIMIT ?`, userId, userId, eventId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		err = rows.Scan(&event.EventId, &event.UtcTime, &event.UserId, &event.Payload, &event.Responce, &event.IsError)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Returns the id of the user linked to the identity provider subject, or an empty string if none is linked
+func GetUserIdByIdentity(db Querier, issuer string, subject string) (string, error) {
+	var userId string
+	err := db.QueryRow("SELECT user_id FROM user_identity WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userId, err
+}
+
+func InsertUserIdentity(db Querier, issuer string, subject string, userId string, email string, utcTime int64) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_identity WHERE issuer = ? AND subject = ?)", issuer, subject).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("An identity with subject '" + subject + "' is already linked")
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO user_identity (issuer, subject, user_id, email, utc_time)
+	VALUES (?, ?, ?, ?, ?)`,
+		issuer, subject, userId, email, utcTime)
+	return err
+}
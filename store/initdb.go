@@ -82,6 +82,12 @@ func InitDatabase(dbPath string) error {
 		return err
 	}
 
+	//Record the projects, groups and tasks stored before the change log
+	err = initChangeLog(db)
+	if err != nil {
+		return err
+	}
+
 	//Remove unused field task_group.default if exists
 	if exists, err := IsTableFieldExists(db, "task_group", "is_default"); err != nil {
 		return err
@@ -112,5 +118,79 @@ func InitDatabase(dbPath string) error {
 		}
 	}
 
+	//Add user.token_valid_after field if not exists
+	if exists, err := IsTableFieldExists(db, "user", "token_valid_after"); err != nil {
+		return err
+	} else if !exists {
+		err = addField(db, "user", "token_valid_after", "int")
+		if err != nil {
+			return err
+		}
+	}
+
+	//Add user.is_disabled field if not exists
+	if exists, err := IsTableFieldExists(db, "user", "is_disabled"); err != nil {
+		return err
+	} else if !exists {
+		err = addField(db, "user", "is_disabled", "int")
+		if err != nil {
+			return err
+		}
+	}
+
+	//Add task.due_utc_time field if not exists
+	if exists, err := IsTableFieldExists(db, "task", "due_utc_time"); err != nil {
+		return err
+	} else if !exists {
+		err = addField(db, "task", "due_utc_time", "int")
+		if err != nil {
+			return err
+		}
+	}
+
+	//Add task.status_utc_time field if not exists
+	if exists, err := IsTableFieldExists(db, "task", "status_utc_time"); err != nil {
+		return err
+	} else if !exists {
+		err = addField(db, "task", "status_utc_time", "int")
+		if err != nil {
+			return err
+		}
+	}
+
+	//Add jwt.kid, jwt.algorithm, jwt.created_utc_time and jwt.retire_utc_time fields if not exist
+	for _, field := range []string{"kid", "algorithm", "created_utc_time", "retire_utc_time"} {
+		if exists, err := IsTableFieldExists(db, "jwt", field); err != nil {
+			return err
+		} else if !exists {
+			fieldType := "int"
+			if field == "kid" || field == "algorithm" {
+				fieldType = "text"
+			}
+			err = addField(db, "jwt", field, fieldType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//Assign a key id to the key created before key rotation
+	_, err = db.Exec(`
+		UPDATE jwt
+		SET
+			 kid = lower(hex(randomblob(8)))
+		   , created_utc_time = COALESCE(created_utc_time, 0)
+		   , retire_utc_time = COALESCE(retire_utc_time, 0)
+		WHERE kid IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	//Keys created before asymmetric signing are HMAC keys
+	_, err = db.Exec("UPDATE jwt SET algorithm = 'HS256' WHERE algorithm IS NULL")
+	if err != nil {
+		return err
+	}
+
 	return err
 }
@@ -1,45 +1,94 @@
 package store
 
 import (
-	"database/sql"
 	"errors"
 )
 
-func IsEmptyjwt(db *sql.DB) (bool, error) {
-	return IsTableEmpty(db, "jwt")
+// JWT signing key. Only the newest key signs; older keys keep verifying until their retire time
+type JwtKey struct {
+	Kid       string
+	Algorithm string // HS256, ES256 or EdDSA
+	Key       []byte // HMAC secret or PKCS #8 private key
+	Created   int64
+	RetireAt  int64 // 0 while the key is not scheduled for retirement
 }
 
-func InsertJwt(db *sql.DB, jwt_key string) error {
+func IsEmptyjwt(db Querier) (bool, error) {
+	return IsTableEmpty(db, "jwt")
+}
 
-	isEmpty, err := IsEmptyjwt(db)
+func InsertJwtKey(db Querier, jwtKey JwtKey) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM jwt WHERE kid = ?)", jwtKey.Kid).Scan(&exists)
 	if err != nil {
 		return err
 	}
-
-	if !isEmpty {
-		_, err = db.Exec("DELETE FROM jwt")
-		if err != nil {
-			return err
-		}
+	if exists {
+		return errors.New("A jwt key with ID '" + jwtKey.Kid + "' is already registered")
 	}
 
-	_, err = db.Exec("INSERT INTO jwt (jwt_key) VALUES (?)", jwt_key)
-
+	_, err = db.Exec("INSERT INTO jwt (jwt_key, kid, algorithm, created_utc_time, retire_utc_time) VALUES (?, ?, ?, ?, ?)",
+		string(jwtKey.Key), jwtKey.Kid, jwtKey.Algorithm, jwtKey.Created, jwtKey.RetireAt)
 	return err
 }
 
-func GetJwtKey(db *sql.DB) ([]byte, error) {
-	isEmpty, err := IsEmptyjwt(db)
+// Returns all keys including the retired ones, newest first
+func GetJwtKeys(db Querier) ([]JwtKey, error) {
+	rows, err := db.Query(`
+		SELECT jwt_key, kid, algorithm, created_utc_time, retire_utc_time
+		FROM jwt
+		ORDER BY created_utc_time DESC`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if isEmpty {
-		return nil, errors.New("jwt key not defined")
+	jwtKeys := []JwtKey{}
+	for rows.Next() {
+		var jwtKey JwtKey
+		var key string
+		err = rows.Scan(&key, &jwtKey.Kid, &jwtKey.Algorithm, &jwtKey.Created, &jwtKey.RetireAt)
+		if err != nil {
+			return nil, err
+		}
+		jwtKey.Key = []byte(key)
+		jwtKeys = append(jwtKeys, jwtKey)
 	}
+	return jwtKeys, rows.Err()
+}
 
-	var jwt_key string
-	err = db.QueryRow("SELECT jwt_key FROM jwt LIMIT 1;").Scan(&jwt_key)
+// Schedules the retirement of the key. A key retiring earlier keeps its retire time
+func RetireJwtKey(db Querier, kid string, utcTime int64) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM jwt WHERE kid = ?)", kid).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A jwt key with ID '" + kid + "' is not registered")
+	}
+
+	_, err = db.Exec(`
+		UPDATE jwt
+		SET retire_utc_time = ?
+		WHERE kid = ?
+		  AND (retire_utc_time = 0 OR retire_utc_time > ?)`,
+		utcTime, kid, utcTime)
+	return err
+}
 
-	return []byte(jwt_key), err
+// Schedules the retirement of all keys except the given one, used when a new signing key takes over
+func RetireOtherJwtKeys(db Querier, kid string, utcTime int64) error {
+	_, err := db.Exec(`
+		UPDATE jwt
+		SET retire_utc_time = ?
+		WHERE kid <> ?
+		  AND (retire_utc_time = 0 OR retire_utc_time > ?)`,
+		utcTime, kid, utcTime)
+	return err
+}
+
+func DeleteRetiredJwtKeys(db Querier, utcTime int64) error {
+	_, err := db.Exec("DELETE FROM jwt WHERE retire_utc_time <> 0 AND retire_utc_time <= ?", utcTime)
+	return err
 }
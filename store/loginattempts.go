@@ -0,0 +1,68 @@
+package store
+
+import (
+	"database/sql"
+)
+
+// Failed attempts of an action from an IP address or for a login, keyed like "login:ip:<address>" or "login:user:<login>"
+type LoginAttempt struct {
+	AttemptKey   string
+	Failures     int
+	LastFailure  int64
+	BlockedUntil int64
+}
+
+// Returns nil if there are no failed attempts for the key
+func GetLoginAttempt(db Querier, attemptKey string) (*LoginAttempt, error) {
+	var attempt LoginAttempt
+	err := db.QueryRow(`
+		SELECT attempt_key, failures, last_failure_utc_time, blocked_until_utc_time
+		FROM login_attempt
+		WHERE attempt_key = ?`,
+		attemptKey).Scan(&attempt.AttemptKey, &attempt.Failures, &attempt.LastFailure, &attempt.BlockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// Counts a failure for the key and returns the failures so far. The increment is a single statement,
+// so concurrent failures are all counted
+func IncrementLoginAttempt(db Querier, attemptKey string, utcTime int64) (int, error) {
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_attempt (attempt_key, failures, last_failure_utc_time, blocked_until_utc_time)
+		VALUES (?, 1, ?, 0)
+		ON CONFLICT(attempt_key) DO UPDATE SET
+			  failures = failures + 1
+			, last_failure_utc_time = excluded.last_failure_utc_time
+		RETURNING failures`,
+		attemptKey,
+		utcTime).Scan(&failures)
+	return failures, err
+}
+
+// Blocks the key until the given time, unless it is already blocked longer
+func BlockLoginAttempt(db Querier, attemptKey string, blockedUntil int64) error {
+	_, err := db.Exec(`
+		UPDATE login_attempt
+		SET blocked_until_utc_time = MAX(blocked_until_utc_time, ?)
+		WHERE attempt_key = ?`,
+		blockedUntil,
+		attemptKey)
+	return err
+}
+
+func DeleteLoginAttempt(db Querier, attemptKey string) error {
+	_, err := db.Exec("DELETE FROM login_attempt WHERE attempt_key = ?", attemptKey)
+	return err
+}
+
+// Deletes the attempts which neither block anymore nor had a failure since the given time
+func DeleteStaleLoginAttempts(db Querier, utcTime int64) error {
+	_, err := db.Exec("DELETE FROM login_attempt WHERE last_failure_utc_time < ? AND blocked_until_utc_time < ?", utcTime, utcTime)
+	return err
+}
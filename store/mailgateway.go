@@ -0,0 +1,67 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type MailGateway struct {
+	UserId      string `json:"-"`
+	Token       string `json:"-"`
+	TaskGroupId string `json:"group"`
+}
+
+func GetMailGateway(db Querier, userId string) (*MailGateway, error) {
+	var mailGateway MailGateway
+
+	err := db.QueryRow(`
+		SELECT user_id, token, COALESCE(task_group_id, '')
+		FROM mail_gateway
+		WHERE user_id = ?
+		`, userId).Scan(&mailGateway.UserId, &mailGateway.Token, &mailGateway.TaskGroupId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &mailGateway, err
+}
+
+func GetMailGatewayByToken(db Querier, token string) (*MailGateway, error) {
+	var mailGateway MailGateway
+
+	err := db.QueryRow(`
+		SELECT user_id, token, COALESCE(task_group_id, '')
+		FROM mail_gateway
+		WHERE token = ?
+		`, token).Scan(&mailGateway.UserId, &mailGateway.Token, &mailGateway.TaskGroupId)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("mail gateway token is invalid")
+	}
+
+	return &mailGateway, err
+}
+
+func UpsertMailGateway(db Querier, mailGateway MailGateway) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM mail_gateway WHERE user_id = ?)", mailGateway.UserId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		_, err = db.Exec(`
+		UPDATE mail_gateway
+		SET
+			 token = ?
+		   , task_group_id = ?
+		WHERE user_id = ?`,
+			mailGateway.Token, mailGateway.TaskGroupId, mailGateway.UserId)
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO mail_gateway (user_id, token, task_group_id)
+	VALUES (?, ?, ?)`,
+		mailGateway.UserId, mailGateway.Token, mailGateway.TaskGroupId)
+	return err
+}
@@ -12,11 +12,11 @@ type Project struct {
 	UserId    string `json:"userid"`
 }
 
-func IsEmptyProjects(db *sql.DB) (bool, error) {
+func IsEmptyProjects(db Querier) (bool, error) {
 	return IsTableEmpty(db, "project")
 }
 
-func InsertProject(db *sql.DB, project Project) error {
+func InsertProject(db Querier, project Project) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM project WHERE project_id = ?)", project.ProjectId).Scan(&exists)
 	if err != nil {
@@ -28,11 +28,14 @@ func InsertProject(db *sql.DB, project Project) error {
 
 	_, err = db.Exec("INSERT INTO project (project_id, name, sequence, user_id) VALUES (?, ?, ?, ?)",
 		project.ProjectId, project.Name, project.Sequence, project.UserId)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return recordChange(db, project.UserId, ChangeTypeProject, project.ProjectId, false)
 }
 
-func GetProjects(db *sql.DB, userId string) ([]Project, error) {
+func GetProjects(db Querier, userId string) ([]Project, error) {
 	rows, err := db.Query(`
 		SELECT project_id, name, sequence
 		FROM project 
@@ -58,7 +61,7 @@ func GetProjects(db *sql.DB, userId string) ([]Project, error) {
 	return projects, nil
 }
 
-func GetProjectsFromId(db *sql.DB, userId string, fromProjectId string) ([]Project, error) {
+func GetProjectsFromId(db Querier, userId string, fromProjectId string) ([]Project, error) {
 	startSequence := -9007199254740991
 	if fromProjectId != "" {
 		err := db.QueryRow(`
@@ -97,7 +100,7 @@ func GetProjectsFromId(db *sql.DB, userId string, fromProjectId string) ([]Proje
 	return projects, nil
 }
 
-func UpdateProject(db *sql.DB, project Project) error {
+func UpdateProject(db Querier, project Project) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM project WHERE project_id = ?)", project.ProjectId).Scan(&exists)
 	if err != nil {
@@ -107,18 +110,29 @@ func UpdateProject(db *sql.DB, project Project) error {
 		return errors.New("A project with ID '" + project.ProjectId + "' is not registered")
 	}
 
-	_, err = db.Exec(`
+	// an unchanged project is not updated, so it is not sent to the clients again
+	result, err := db.Exec(`
 		UPDATE project
 		SET name = ?,
 			sequence = ?,
 			user_id = ?
-		WHERE project_id = ?`,
-		project.Name, project.Sequence, project.UserId, project.ProjectId)
+		WHERE project_id = ?
+			AND (name IS NOT ? OR sequence IS NOT ? OR user_id IS NOT ?)`,
+		project.Name, project.Sequence, project.UserId, project.ProjectId,
+		project.Name, project.Sequence, project.UserId)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return nil
+	}
 
-	return err
+	return recordChange(db, project.UserId, ChangeTypeProject, project.ProjectId, false)
 }
 
-func UpsertProject(db *sql.DB, project Project) error {
+func UpsertProject(db Querier, project Project) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM project WHERE project_id = ?)", project.ProjectId).Scan(&exists)
 	if err != nil {
@@ -131,22 +145,29 @@ func UpsertProject(db *sql.DB, project Project) error {
 			return err
 		}
 	} else {
-		_, err = db.Exec(`
+		result, err := db.Exec(`
 			UPDATE project
 			SET name = ?,
 				sequence = ?,
 				user_id = ?
-			WHERE project_id = ?`,
-			project.Name, project.Sequence, project.UserId, project.ProjectId)
+			WHERE project_id = ?
+				AND (name IS NOT ? OR sequence IS NOT ? OR user_id IS NOT ?)`,
+			project.Name, project.Sequence, project.UserId, project.ProjectId,
+			project.Name, project.Sequence, project.UserId)
 		if err != nil {
 			return err
 		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return nil
+		}
 	}
 
-	return nil
+	return recordChange(db, project.UserId, ChangeTypeProject, project.ProjectId, false)
 }
 
-func DeleteProject(db *sql.DB, projectId string) error {
+func DeleteProject(db Querier, projectId string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM project WHERE project_id = ?)", projectId).Scan(&exists)
 	if err != nil {
@@ -156,6 +177,39 @@ func DeleteProject(db *sql.DB, projectId string) error {
 		return errors.New("A project with ID '" + projectId + "' is not registered")
 	}
 
+	userId, err := GetProjectUserId(db, projectId)
+	if err != nil {
+		return err
+	}
+
+	err = recordDeletions(db, userId, ChangeTypeTask, `
+		SELECT t.task_id
+		FROM task t
+		INNER JOIN task_group g ON g.task_group_id = t.task_group_id
+		WHERE g.project_id = ?`, projectId)
+	if err != nil {
+		return err
+	}
+
+	err = recordDeletions(db, userId, ChangeTypeGroup, "SELECT task_group_id FROM task_group WHERE project_id = ?", projectId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	DELETE FROM attachment
+	WHERE EXISTS (
+			SELECT 1
+			FROM task t
+			INNER JOIN task_group g ON g.task_group_id = t.task_group_id
+			WHERE t.task_id = attachment.task_id
+			  AND g.project_id = ?
+		);`,
+		projectId)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`
 	DELETE FROM task
 	where EXISTS (
@@ -179,5 +233,16 @@ func DeleteProject(db *sql.DB, projectId string) error {
 		return err
 	}
 
-	return nil
+	return recordChange(db, userId, ChangeTypeProject, projectId, true)
+}
+
+func GetProjectUserId(db Querier, projectId string) (string, error) {
+	var userId string
+
+	err := db.QueryRow("SELECT user_id FROM project WHERE project_id = ?", projectId).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", errors.New("A project with ID '" + projectId + "' is not registered")
+	}
+
+	return userId, err
 }
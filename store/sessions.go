@@ -0,0 +1,182 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type Session struct {
+	SessionId           string `json:"id"`
+	UserId              string `json:"-"`
+	RefreshHash         string `json:"-"`
+	PreviousRefreshHash string `json:"-"`
+	DeviceName          string `json:"devicename"`
+	Ip                  string `json:"ip"`
+	Created             int64  `json:"created"`
+	LastSeen            int64  `json:"lastseen"`
+	Rotated             int64  `json:"-"`
+	Expire              int64  `json:"expire"`
+	IsRevoked           int    `json:"-"`
+}
+
+const sessionColumns = `
+	session_id, user_id, refresh_hash, COALESCE(previous_refresh_hash, ''), COALESCE(device_name, ''), COALESCE(ip, ''),
+	created_utc_time, last_seen_utc_time, COALESCE(rotated_utc_time, 0), expire_utc_time, is_revoked`
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.SessionId,
+		&session.UserId,
+		&session.RefreshHash,
+		&session.PreviousRefreshHash,
+		&session.DeviceName,
+		&session.Ip,
+		&session.Created,
+		&session.LastSeen,
+		&session.Rotated,
+		&session.Expire,
+		&session.IsRevoked)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func InsertSession(db Querier, session Session) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM session WHERE session_id = ?)", session.SessionId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("A session with ID '" + session.SessionId + "' is already registered")
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO session (session_id, user_id, refresh_hash, device_name, ip, created_utc_time, last_seen_utc_time, rotated_utc_time, expire_utc_time, is_revoked)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		session.SessionId,
+		session.UserId,
+		session.RefreshHash,
+		session.DeviceName,
+		session.Ip,
+		session.Created,
+		session.LastSeen,
+		session.Rotated,
+		session.Expire)
+
+	return err
+}
+
+// Looks for the session by its current or previous refresh token hash. Returns nil if not found
+func GetSessionByRefreshHash(db Querier, refreshHash string) (*Session, error) {
+	row := db.QueryRow(`
+		SELECT `+sessionColumns+`
+		FROM session
+		WHERE refresh_hash = ? OR previous_refresh_hash = ?`,
+		refreshHash, refreshHash)
+
+	session, err := scanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// Replaces the refresh token hash, keeping the previous one to detect reuse
+func RotateSession(db Querier, sessionId string, refreshHash string, ip string, utcTime int64, expire int64) error {
+	_, err := db.Exec(`
+		UPDATE session
+		SET
+			 previous_refresh_hash = refresh_hash
+		   , refresh_hash = ?
+		   , ip = ?
+		   , last_seen_utc_time = ?
+		   , rotated_utc_time = ?
+		   , expire_utc_time = ?
+		WHERE session_id = ?`,
+		refreshHash, ip, utcTime, utcTime, expire, sessionId)
+	return err
+}
+
+// Returns the sessions of the user which are neither revoked nor expired
+func GetUserSessions(db Querier, userId string, utcTime int64) ([]Session, error) {
+	rows, err := db.Query(`
+		SELECT `+sessionColumns+`
+		FROM session
+		WHERE user_id = ? AND is_revoked = 0 AND expire_utc_time > ?
+		ORDER BY last_seen_utc_time DESC`,
+		userId, utcTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// Reports whether the session belongs to the login and is neither revoked nor expired
+func IsSessionActive(db Querier, sessionId string, login string, utcTime int64) (bool, error) {
+	var isActive bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1
+			FROM session s
+				INNER JOIN user u ON u.user_id = s.user_id
+			WHERE s.session_id = ? AND u.login = ? AND s.is_revoked = 0 AND s.expire_utc_time > ?)`,
+		sessionId, login, utcTime).Scan(&isActive)
+	return isActive, err
+}
+
+func RevokeSession(db Querier, userId string, sessionId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM session WHERE session_id = ? AND user_id = ?)", sessionId, userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A session with ID '" + sessionId + "' is not registered")
+	}
+
+	_, err = db.Exec("UPDATE session SET is_revoked = 1 WHERE session_id = ?", sessionId)
+	return err
+}
+
+// Revokes all sessions of the user except the given one and returns the ids of the revoked sessions
+func RevokeUserSessions(db Querier, userId string, exceptSessionId string) ([]string, error) {
+	rows, err := db.Query("SELECT session_id FROM session WHERE user_id = ? AND session_id <> ? AND is_revoked = 0", userId, exceptSessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIds []string
+	for rows.Next() {
+		var sessionId string
+		err = rows.Scan(&sessionId)
+		if err != nil {
+			return nil, err
+		}
+		sessionIds = append(sessionIds, sessionId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("UPDATE session SET is_revoked = 1 WHERE user_id = ? AND session_id <> ?", userId, exceptSessionId)
+	return sessionIds, err
+}
+
+func DeleteExpiredSessions(db Querier, utcTime int64) error {
+	_, err := db.Exec("DELETE FROM session WHERE expire_utc_time <= ?", utcTime)
+	return err
+}
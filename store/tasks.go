@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"time"
 )
 
 type Task struct {
@@ -12,9 +13,11 @@ type Task struct {
 	Sequence     int    `json:"sequence"`
 	TaskStatusId int    `json:"status"`
 	TaskGroupId  string `json:"group"`
+	Due          int64  `json:"due"`
+	StatusTime   int64  `json:"statustime"`
 }
 
-func InsertTask(db *sql.DB, task Task) error {
+func InsertTask(db Querier, task Task) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task WHERE task_id = ?)", task.TaskId).Scan(&exists)
 
@@ -27,14 +30,17 @@ func InsertTask(db *sql.DB, task Task) error {
 	}
 
 	_, err = db.Exec(`
-	INSERT INTO task (task_id, name, sequence, task_status_id, task_group_id) 
-	VALUES (?, ?, ?, ?, ?)`,
-		task.TaskId, task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId)
+	INSERT INTO task (task_id, name, sequence, task_status_id, task_group_id, due_utc_time, status_utc_time) 
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		task.TaskId, task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId, task.Due, time.Now().UTC().UnixMilli())
+	if err != nil {
+		return err
+	}
 
-	return err
+	return recordTaskChange(db, task.TaskId)
 }
 
-func UpsertTask(db *sql.DB, task Task) error {
+func UpsertTask(db Querier, task Task) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task WHERE task_id = ?)", task.TaskId).Scan(&exists)
 
@@ -43,28 +49,46 @@ func UpsertTask(db *sql.DB, task Task) error {
 	}
 
 	if exists {
-		_, err = db.Exec(`
+		// status_utc_time keeps the moment of the last status change. An unchanged task is not updated, so it
+		// is not sent to the clients again
+		result, err := db.Exec(`
 			UPDATE task 
 			SET
 				name = ?,
 				Sequence = ?,
+				status_utc_time = CASE WHEN task_status_id = ? THEN status_utc_time ELSE ? END,
 				task_status_id = ?,
-				task_group_id = ?
-			WHERE task_id = ?`,
-			task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId, task.TaskId)
-		return err
+				task_group_id = ?,
+				due_utc_time = ?
+			WHERE task_id = ?
+				AND (name IS NOT ? OR sequence IS NOT ? OR task_status_id IS NOT ? OR task_group_id IS NOT ? OR due_utc_time IS NOT ?)`,
+			task.Name, task.Sequence, task.TaskStatusId, time.Now().UTC().UnixMilli(), task.TaskStatusId, task.TaskGroupId, task.Due, task.TaskId,
+			task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId, task.Due)
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return nil
+		}
+
+		return recordTaskChange(db, task.TaskId)
 	} else {
 
 		_, err = db.Exec(`
-			INSERT INTO task (task_id, name, sequence, task_status_id, task_group_id) 
-			VALUES (?, ?, ?, ?, ?)`,
-			task.TaskId, task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId)
+			INSERT INTO task (task_id, name, sequence, task_status_id, task_group_id, due_utc_time, status_utc_time) 
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			task.TaskId, task.Name, task.Sequence, task.TaskStatusId, task.TaskGroupId, task.Due, time.Now().UTC().UnixMilli())
+		if err != nil {
+			return err
+		}
 
-		return err
+		return recordTaskChange(db, task.TaskId)
 	}
 }
 
-func DeleteTask(db *sql.DB, taskId string) error {
+func DeleteTask(db Querier, taskId string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task WHERE task_id = ?)", taskId).Scan(&exists)
 
@@ -76,13 +100,27 @@ func DeleteTask(db *sql.DB, taskId string) error {
 		return errors.New("A task with ID '" + taskId + "' is not registered")
 	}
 
+	userId, err := GetTaskUserId(db, taskId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM attachment WHERE task_id = ?`, taskId)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`DELETE FROM task WHERE task_id = ?`, taskId)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return recordChange(db, userId, ChangeTypeTask, taskId, true)
 }
 
-func GetTasksByProject(db *sql.DB, ProjectId string) ([]Task, error) {
+func GetTasksByProject(db Querier, ProjectId string) ([]Task, error) {
 	rows, err := db.Query(`
-		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id
+		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
 		FROM task t 
 		INNER JOIN task_group g ON g.task_group_id = t.task_group_id
 		WHERE g.project_id = ?
@@ -96,7 +134,7 @@ func GetTasksByProject(db *sql.DB, ProjectId string) ([]Task, error) {
 	var tasks []Task
 	for rows.Next() {
 		var task Task
-		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId)
+		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Due, &task.StatusTime)
 		if err != nil {
 			return nil, err
 		}
@@ -106,9 +144,9 @@ func GetTasksByProject(db *sql.DB, ProjectId string) ([]Task, error) {
 	return tasks, nil
 }
 
-func GetTasksByGroup(db *sql.DB, groupId string) ([]Task, error) {
+func GetTasksByGroup(db Querier, groupId string) ([]Task, error) {
 	rows, err := db.Query(`
-		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id
+		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
 		FROM task t 
 		WHERE t.task_group_id = ?
 		ORDER BY t.sequence
@@ -121,7 +159,7 @@ func GetTasksByGroup(db *sql.DB, groupId string) ([]Task, error) {
 	var tasks []Task
 	for rows.Next() {
 		var task Task
-		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId)
+		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Due, &task.StatusTime)
 		if err != nil {
 			return nil, err
 		}
@@ -131,9 +169,9 @@ func GetTasksByGroup(db *sql.DB, groupId string) ([]Task, error) {
 	return tasks, nil
 }
 
-func GetTasksByUser(db *sql.DB, userId string) ([]Task, error) {
+func GetTasksByUser(db Querier, userId string) ([]Task, error) {
 	rows, err := db.Query(`
-		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, t.sequence
+		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, t.sequence, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
 		FROM task t 
 		INNER JOIN task_group g ON g.task_group_id = t.task_group_id
 		INNER JOIN project p ON p.project_id = g.project_id
@@ -147,7 +185,7 @@ func GetTasksByUser(db *sql.DB, userId string) ([]Task, error) {
 	var tasks []Task
 	for rows.Next() {
 		var task Task
-		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Sequence)
+		err = rows.Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Sequence, &task.Due, &task.StatusTime)
 		if err != nil {
 			return nil, err
 		}
@@ -157,7 +195,7 @@ func GetTasksByUser(db *sql.DB, userId string) ([]Task, error) {
 	return tasks, nil
 }
 
-func GetTasksToJson(db *sql.DB, projectId string, jsonFormat string) ([]byte, error) {
+func GetTasksToJson(db Querier, projectId string, jsonFormat string) ([]byte, error) {
 
 	switch jsonFormat {
 	case "flat":
@@ -191,7 +229,7 @@ func GetTasksToJson(db *sql.DB, projectId string, jsonFormat string) ([]byte, er
 	}
 }
 
-func UpdateTasksFromJson(db *sql.DB, jsonTasks []byte, projectId string, jsonFormat string) error {
+func UpdateTasksFromJson(db Querier, jsonTasks []byte, projectId string, jsonFormat string) error {
 	if jsonFormat == "flat" {
 
 		sequence := 0
@@ -243,16 +281,33 @@ func UpdateTasksFromJson(db *sql.DB, jsonTasks []byte, projectId string, jsonFor
 	}
 }
 
-func GetTask(db *sql.DB, taskId string) (*Task, error) {
+func GetTask(db Querier, taskId string) (*Task, error) {
 
 	var task Task
 
 	err := db.QueryRow(`
-		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id
+		SELECT t.task_id, t.name, t.task_group_id, t.task_status_id, t.sequence, COALESCE(t.due_utc_time, 0), COALESCE(t.status_utc_time, 0)
 		FROM task t
-		WHERE t.taskId = ?
+		WHERE t.task_id = ?
 		LIMIT 1
-		`, taskId).Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId)
+		`, taskId).Scan(&task.TaskId, &task.Name, &task.TaskGroupId, &task.TaskStatusId, &task.Sequence, &task.Due, &task.StatusTime)
 
 	return &task, err
 }
+
+func GetTaskUserId(db Querier, taskId string) (string, error) {
+	var userId string
+
+	err := db.QueryRow(`
+		SELECT p.user_id
+		FROM task t
+		INNER JOIN task_group g ON g.task_group_id = t.task_group_id
+		INNER JOIN project p ON p.project_id = g.project_id
+		WHERE t.task_id = ?
+		`, taskId).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", errors.New("A task with ID '" + taskId + "' is not registered")
+	}
+
+	return userId, err
+}
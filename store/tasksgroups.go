@@ -13,11 +13,11 @@ type TaskGroup struct {
 	Tasks       []Task `json:"tasks"`
 }
 
-func IsEmptyTaskGroup(db *sql.DB) (bool, error) {
+func IsEmptyTaskGroup(db Querier) (bool, error) {
 	return IsTableEmpty(db, "task_group")
 }
 
-func InsertTaskGroup(db *sql.DB, taskGroup TaskGroup) error {
+func InsertTaskGroup(db Querier, taskGroup TaskGroup) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task_group WHERE task_group_id = ?)", taskGroup.TaskGroupId).Scan(&exists)
 
@@ -37,7 +37,7 @@ func InsertTaskGroup(db *sql.DB, taskGroup TaskGroup) error {
 	return err
 }
 
-func GetTaskGroups(db *sql.DB, projectId string) ([]TaskGroup, error) {
+func GetTaskGroups(db Querier, projectId string) ([]TaskGroup, error) {
 	rows, err := db.Query(`
 		SELECT task_group_id, name, sequence, project_id
 		FROM task_group 
@@ -56,19 +56,22 @@ func GetTaskGroups(db *sql.DB, projectId string) ([]TaskGroup, error) {
 		if err != nil {
 			return nil, err
 		}
+		taskGroups = append(taskGroups, taskGroup)
+	}
+	rows.Close()
 
-		tasks, err := GetTasksByGroup(db, taskGroup.TaskGroupId)
+	// the tasks are read once the groups are, so a single connection is enough, e.g. in a transaction
+	for index := range taskGroups {
+		tasks, err := GetTasksByGroup(db, taskGroups[index].TaskGroupId)
 		if err != nil {
 			return nil, err
 		}
-		taskGroup.Tasks = tasks
-
-		taskGroups = append(taskGroups, taskGroup)
+		taskGroups[index].Tasks = tasks
 	}
 	return taskGroups, nil
 }
 
-func UpsertTaskGroup(db *sql.DB, taskGroup TaskGroup) error {
+func UpsertTaskGroup(db Querier, taskGroup TaskGroup) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task_group WHERE task_group_id = ?)", taskGroup.TaskGroupId).Scan(&exists)
 	if err != nil {
@@ -81,22 +84,35 @@ func UpsertTaskGroup(db *sql.DB, taskGroup TaskGroup) error {
 			return err
 		}
 	} else {
-		_, err = db.Exec(`
+		// an unchanged group is not updated, so it is not sent to the clients again
+		result, err := db.Exec(`
 			UPDATE task_group
 			SET name = ?,
 				sequence = ?,
 				project_id = ?
-			WHERE task_group_id = ?`,
-			taskGroup.Name, taskGroup.Sequence, taskGroup.ProjectId, taskGroup.TaskGroupId)
+			WHERE task_group_id = ?
+				AND (name IS NOT ? OR sequence IS NOT ? OR project_id IS NOT ?)`,
+			taskGroup.Name, taskGroup.Sequence, taskGroup.ProjectId, taskGroup.TaskGroupId,
+			taskGroup.Name, taskGroup.Sequence, taskGroup.ProjectId)
 		if err != nil {
 			return err
 		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return nil
+		}
 	}
 
-	return nil
+	userId, err := GetTaskGroupUserId(db, taskGroup.TaskGroupId)
+	if err != nil {
+		return err
+	}
+
+	return recordChange(db, userId, ChangeTypeGroup, taskGroup.TaskGroupId, false)
 }
 
-func DeleteTaskGroup(db *sql.DB, taskGroupId string) error {
+func DeleteTaskGroup(db Querier, taskGroupId string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task_group WHERE task_group_id = ?)", taskGroupId).Scan(&exists)
 	if err != nil {
@@ -106,6 +122,29 @@ func DeleteTaskGroup(db *sql.DB, taskGroupId string) error {
 		return errors.New("A group with ID '" + taskGroupId + "' is not registered")
 	}
 
+	userId, err := GetTaskGroupUserId(db, taskGroupId)
+	if err != nil {
+		return err
+	}
+
+	err = recordDeletions(db, userId, ChangeTypeTask, "SELECT task_id FROM task WHERE task_group_id = ?", taskGroupId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	DELETE FROM attachment
+	WHERE EXISTS (
+			SELECT 1
+			FROM task t
+			WHERE t.task_id = attachment.task_id
+			  AND t.task_group_id = ?
+		);`,
+		taskGroupId)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`DELETE FROM task where task_group_id = ?;`, taskGroupId)
 	if err != nil {
 		return err
@@ -116,10 +155,10 @@ func DeleteTaskGroup(db *sql.DB, taskGroupId string) error {
 		return err
 	}
 
-	return nil
+	return recordChange(db, userId, ChangeTypeGroup, taskGroupId, true)
 }
 
-func GetTaskGroupsByUser(db *sql.DB, userId string) ([]TaskGroup, error) {
+func GetTaskGroupsByUser(db Querier, userId string) ([]TaskGroup, error) {
 	rows, err := db.Query(`
 		SELECT g.task_group_id, g.name, g.sequence, g.project_id
 		FROM task_group g
@@ -142,3 +181,19 @@ func GetTaskGroupsByUser(db *sql.DB, userId string) ([]TaskGroup, error) {
 	}
 	return taskGroups, nil
 }
+
+func GetTaskGroupUserId(db Querier, taskGroupId string) (string, error) {
+	var userId string
+
+	err := db.QueryRow(`
+		SELECT p.user_id
+		FROM task_group g
+		INNER JOIN project p ON p.project_id = g.project_id
+		WHERE g.task_group_id = ?
+		`, taskGroupId).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", errors.New("A group with ID '" + taskGroupId + "' is not registered")
+	}
+
+	return userId, err
+}
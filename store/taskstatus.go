@@ -1,7 +1,6 @@
 package store
 
 import (
-	"database/sql"
 	"errors"
 	"strconv"
 )
@@ -11,11 +10,11 @@ type TaskStatus struct {
 	Name         string
 }
 
-func IsEmptyTaskStatus(db *sql.DB) (bool, error) {
+func IsEmptyTaskStatus(db Querier) (bool, error) {
 	return IsTableEmpty(db, "task_status")
 }
 
-func InsertTaskStatus(db *sql.DB, taskStatus TaskStatus) error {
+func InsertTaskStatus(db Querier, taskStatus TaskStatus) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task_status WHERE task_status_id = ?)", taskStatus.TaskStatusId).Scan(&exists)
 
@@ -34,3 +33,9 @@ func InsertTaskStatus(db *sql.DB, taskStatus TaskStatus) error {
 
 	return err
 }
+
+func IsTaskStatusExists(db Querier, taskStatusId int) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM task_status WHERE task_status_id = ?)", taskStatusId).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type UserTotp struct {
+	UserId    string
+	Secret    string
+	IsEnabled int
+	LastStep  int64 // time step of the last accepted code
+	UtcTime   int64
+}
+
+// Returns the TOTP settings of the user or nil if TOTP was never enrolled
+func GetUserTotp(db Querier, userId string) (*UserTotp, error) {
+	var userTotp UserTotp
+
+	err := db.QueryRow(`
+		SELECT user_id, secret, is_enabled, COALESCE(last_step, 0), utc_time
+		FROM user_totp
+		WHERE user_id = ?
+		`, userId).Scan(&userTotp.UserId, &userTotp.Secret, &userTotp.IsEnabled, &userTotp.LastStep, &userTotp.UtcTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &userTotp, err
+}
+
+func IsTotpEnabled(db Querier, userId string) (bool, error) {
+	var isEnabled bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ? AND is_enabled = 1)", userId).Scan(&isEnabled)
+	return isEnabled, err
+}
+
+func UpsertUserTotp(db Querier, userTotp UserTotp) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ?)", userTotp.UserId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		_, err = db.Exec(`
+		UPDATE user_totp
+		SET
+			 secret = ?
+		   , is_enabled = ?
+		   , last_step = ?
+		   , utc_time = ?
+		WHERE user_id = ?`,
+			userTotp.Secret, userTotp.IsEnabled, userTotp.LastStep, userTotp.UtcTime, userTotp.UserId)
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO user_totp (user_id, secret, is_enabled, last_step, utc_time)
+	VALUES (?, ?, ?, ?, ?)`,
+		userTotp.UserId, userTotp.Secret, userTotp.IsEnabled, userTotp.LastStep, userTotp.UtcTime)
+	return err
+}
+
+// Stores the time step of an accepted code. Returns false if the same or a later step
+// was already used, e.g. by a concurrent request with the same code
+func SetTotpLastStep(db Querier, userId string, step int64) (bool, error) {
+	result, err := db.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND COALESCE(last_step, 0) < ?", step, userId, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func DeleteUserTotp(db Querier, userId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_id = ?)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("TOTP is not enrolled for the user with ID '" + userId + "'")
+	}
+
+	_, err = db.Exec("DELETE FROM recovery_code WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM user_totp WHERE user_id = ?", userId)
+	return err
+}
+
+// Replaces all recovery codes of the user with the given hashes
+func ReplaceRecoveryCodes(db Querier, userId string, codeHashes []string) error {
+	_, err := db.Exec("DELETE FROM recovery_code WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err = db.Exec(`
+		INSERT INTO recovery_code (user_id, code_hash, is_used)
+		VALUES (?, ?, 0)`,
+			userId, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Marks the recovery code as used. Returns false if the code does not exist or was already used
+func UseRecoveryCode(db Querier, userId string, codeHash string) (bool, error) {
+	result, err := db.Exec("UPDATE recovery_code SET is_used = 1 WHERE user_id = ? AND code_hash = ? AND is_used = 0", userId, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func GetUnusedRecoveryCodeCount(db Querier, userId string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM recovery_code WHERE user_id = ? AND is_used = 0", userId).Scan(&count)
+	return count, err
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"database/sql"
 	"errors"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,11 +17,13 @@ type User struct {
 	IsActive     int
 }
 
-func IsEmptyUsers(db *sql.DB) (bool, error) {
+var ErrUserNotFound = errors.New("user not found")
+
+func IsEmptyUsers(db Querier) (bool, error) {
 	return IsTableEmpty(db, "user")
 }
 
-func InsertUser(db *sql.DB, user User) error {
+func InsertUser(db Querier, user User) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", user.UserId).Scan(&exists)
 
@@ -42,14 +45,17 @@ func InsertUser(db *sql.DB, user User) error {
 		return errors.New("A login '" + user.Login + "' is already registered")
 	}
 
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE email = ?)", user.Email).Scan(&exists)
+	// users provisioned by single sign-on may have no email
+	if user.Email != "" {
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE email = ?)", user.Email).Scan(&exists)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if exists {
-		return errors.New("A email '" + user.Email + "' is already registered")
+		if exists {
+			return errors.New("A email '" + user.Email + "' is already registered")
+		}
 	}
 
 	_, err = db.Exec(`
@@ -71,7 +77,7 @@ func InsertUser(db *sql.DB, user User) error {
 	return err
 }
 
-func UpsertUser(db *sql.DB, user User) error {
+func UpsertUser(db Querier, user User) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", user.UserId).Scan(&exists)
 
@@ -113,7 +119,7 @@ func UpsertUser(db *sql.DB, user User) error {
 	}
 }
 
-func DeleteUser(db *sql.DB, userId string) error {
+func DeleteUser(db Querier, userId string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", userId).Scan(&exists)
 
@@ -129,7 +135,7 @@ func DeleteUser(db *sql.DB, userId string) error {
 
 	return err
 }
-func GetUserPasswordHashByLogin(db *sql.DB, login string) (string, error) {
+func GetUserPasswordHashByLogin(db Querier, login string) (string, error) {
 	var exists int
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE login = ?)", login).Scan(&exists)
 	if err != nil {
@@ -144,7 +150,7 @@ func GetUserPasswordHashByLogin(db *sql.DB, login string) (string, error) {
 	return password_hash, err
 }
 
-func GetUserIdByLogin(db *sql.DB, login string) (string, error) {
+func GetUserIdByLogin(db Querier, login string) (string, error) {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE login = ?)", login).Scan(&exists)
 	if err != nil {
@@ -159,7 +165,7 @@ func GetUserIdByLogin(db *sql.DB, login string) (string, error) {
 	return userId, err
 }
 
-func ValidateUserRegistration(db *sql.DB, login string, email string) error {
+func ValidateUserRegistration(db Querier, login string, email string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE login = ?)", login).Scan(&exists)
 	if err != nil {
@@ -179,16 +185,16 @@ func ValidateUserRegistration(db *sql.DB, login string, email string) error {
 	return nil
 }
 
-func IsUserExistsAndActive(db *sql.DB, login string) bool {
+func IsUserExistsAndActive(db Querier, login string) bool {
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE is_active = 1 and login = ?)", login).Scan(&exists)
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE is_active = 1 and COALESCE(is_disabled, 0) = 0 and login = ?)", login).Scan(&exists)
 	if err != nil {
 		return false
 	}
 	return exists
 }
 
-func ActivateUser(db *sql.DB, userId string) error {
+func ActivateUser(db Querier, userId string) error {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", userId).Scan(&exists)
 
@@ -206,16 +212,52 @@ func ActivateUser(db *sql.DB, userId string) error {
 	}
 }
 
-func IsUserActive(db *sql.DB, userId string) bool {
+func DeactivateUser(db Querier, userId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A user with ID '" + userId + "' is not registered")
+	}
+
+	// is_active stays as it is, it tells whether the email is confirmed
+	_, err = db.Exec("UPDATE user SET is_disabled = 1 WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	// the refresh tokens are kept with the sessions, the access tokens of the sessions are rejected with them
+	_, err = db.Exec("DELETE FROM session WHERE user_id = ?", userId)
+	return err
+}
+
+// Lifts a deactivation by the administrator
+func ReactivateUser(db Querier, userId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A user with ID '" + userId + "' is not registered")
+	}
+
+	_, err = db.Exec("UPDATE user SET is_disabled = 0 WHERE user_id = ?", userId)
+	return err
+}
+
+func IsUserActive(db Querier, userId string) bool {
 	var isActive bool
-	err := db.QueryRow("SELECT isActive FROM user WHERE user_id = ?)", userId).Scan(&isActive)
+	err := db.QueryRow("SELECT COALESCE(is_active, 0) FROM user WHERE user_id = ?", userId).Scan(&isActive)
 	if err != nil {
 		return false
 	}
 	return isActive
 }
 
-func IsUserExists(db *sql.DB, userId string) bool {
+func IsUserExists(db Querier, userId string) bool {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE user_id = ?)", userId).Scan(&exists)
 	if err != nil {
@@ -223,3 +265,84 @@ func IsUserExists(db *sql.DB, userId string) bool {
 	}
 	return exists
 }
+
+func GetUserLoginById(db Querier, userId string) (string, error) {
+	var login string
+	err := db.QueryRow("SELECT login FROM user WHERE user_id = ?", userId).Scan(&login)
+	if err == sql.ErrNoRows {
+		return "", errors.New("A user with ID '" + userId + "' is not registered")
+	}
+	return login, err
+}
+
+// Returns an active user by login or email
+func GetActiveUserByLoginOrEmail(db Querier, loginOrEmail string) (*User, error) {
+	var user User
+	err := db.QueryRow(`
+		SELECT user_id, name, login, COALESCE(email, ''), is_active
+		FROM user
+		WHERE is_active = 1
+		  AND COALESCE(is_disabled, 0) = 0
+		  AND (login = ? OR email = ?)
+		LIMIT 1
+		`, loginOrEmail, loginOrEmail).Scan(&user.UserId, &user.Name, &user.Login, &user.Email, &user.IsActive)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return &user, err
+}
+
+func GetUserByLogin(db Querier, login string) (*User, error) {
+	var user User
+	err := db.QueryRow(`
+		SELECT user_id, name, login, COALESCE(email, ''), is_active
+		FROM user
+		WHERE login = ?
+		`, login).Scan(&user.UserId, &user.Name, &user.Login, &user.Email, &user.IsActive)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return &user, err
+}
+
+func GetUserByEmail(db Querier, email string) (*User, error) {
+	var user User
+	err := db.QueryRow(`
+		SELECT user_id, name, login, COALESCE(email, ''), is_active
+		FROM user
+		WHERE email = ?
+		LIMIT 1
+		`, email).Scan(&user.UserId, &user.Name, &user.Login, &user.Email, &user.IsActive)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return &user, err
+}
+
+func IsLoginExists(db Querier, login string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user WHERE login = ?)", login).Scan(&exists)
+	return exists, err
+}
+
+// Stores a new password hash and invalidates all tokens issued before the change
+func UpdateUserPassword(db Querier, userId string, passwordHash string) error {
+	_, err := db.Exec(`
+		UPDATE user
+		SET
+			 password_hash = ?
+		   , token_valid_after = ?
+		WHERE user_id = ?`,
+		passwordHash, time.Now().Unix(), userId)
+	return err
+}
+
+// Returns the unix time before which tokens of the user are not accepted
+func GetUserTokenValidAfter(db Querier, login string) (int64, error) {
+	var tokenValidAfter int64
+	err := db.QueryRow("SELECT COALESCE(token_valid_after, 0) FROM user WHERE login = ?", login).Scan(&tokenValidAfter)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return tokenValidAfter, err
+}
@@ -1,7 +1,6 @@
 package store
 
 import (
-	"database/sql"
 	"errors"
 	"time"
 )
@@ -13,7 +12,7 @@ type UserSecret struct {
 	Target string
 }
 
-func InsertUserSecret(db *sql.DB, userSecret UserSecret) error {
+func InsertUserSecret(db Querier, userSecret UserSecret) error {
 
 	_, err := db.Exec(`
 	INSERT INTO user_secret (
@@ -30,36 +29,65 @@ func InsertUserSecret(db *sql.DB, userSecret UserSecret) error {
 	return err
 }
 
-func GetUserIdBySecret(db *sql.DB, secret string) (string, error) {
+func GetUserIdBySecret(db Querier, secret string) (string, error) {
 	var user_id string
 	err := db.QueryRow("SELECT user_id FROM user_secret WHERE secret = ?", secret).Scan(&user_id)
 	return user_id, err
 }
 
-func ValidateSecret(db *sql.DB, secret string) error {
+var ErrSecretInvalid = errors.New("secret is invalid")
+var ErrSecretExpired = errors.New("secret is expired")
+
+// Checks that the secret exists, was issued for the target and is not expired, returns the owner user id
+func CheckSecret(db Querier, secret string, target string) (string, error) {
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_secret WHERE secret = ?)", secret).Scan(&exists)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if !exists {
-		return errors.New("email confirmation required. The confirmation code you entered is invalid")
+		return "", ErrSecretInvalid
 	}
 
-	var userId, target string
+	var userId, secretTarget string
 	var expire int64
-	err = db.QueryRow("SELECT user_id, expire, target FROM user_secret WHERE secret = ?", secret).Scan(&userId, &expire, &target)
+	err = db.QueryRow("SELECT user_id, expire, target FROM user_secret WHERE secret = ?", secret).Scan(&userId, &expire, &secretTarget)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if target != "register" {
-		return errors.New("email confirmation required. The confirmation code you entered is invalid")
+	if secretTarget != target {
+		return "", ErrSecretInvalid
 	}
 
 	if expire < time.Now().UnixMilli() {
+		return "", ErrSecretExpired
+	}
+
+	return userId, nil
+}
+
+func DeleteSecret(db Querier, secret string) error {
+	_, err := db.Exec(`DELETE FROM user_secret WHERE secret = ?`, secret)
+	return err
+}
+
+func DeleteUserSecrets(db Querier, userId string, target string) error {
+	_, err := db.Exec(`DELETE FROM user_secret WHERE user_id = ? AND target = ?`, userId, target)
+	return err
+}
+
+func ValidateSecret(db Querier, secret string) error {
+	userId, err := CheckSecret(db, secret, "register")
+	if err == ErrSecretInvalid {
+		return errors.New("email confirmation required. The confirmation code you entered is invalid")
+	}
+	if err == ErrSecretExpired {
 		return errors.New("email confirmation required. The confirmation code you entered is expired")
 	}
+	if err != nil {
+		return err
+	}
 
 	if !IsUserExists(db, userId) {
 		return errors.New("user doesn't exists")
@@ -71,7 +99,5 @@ func ValidateSecret(db *sql.DB, secret string) error {
 
 	ActivateUser(db, userId)
 
-	_, err = db.Exec(`DELETE FROM user_secret WHERE secret = ?`, secret)
-
-	return err
+	return DeleteSecret(db, secret)
 }
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"errors"
+)
+
+type Webhook struct {
+	WebhookId    string `json:"id"`
+	UserId       string `json:"-"`
+	Url          string `json:"url"`
+	Secret       string `json:"secret,omitempty"`
+	EventTypes   string `json:"eventtypes"` // comma separated event types, empty for all events
+	IsActive     int    `json:"isactive"`
+	FailureCount int    `json:"failurecount"`
+	UtcTime      int64  `json:"utctime"`
+}
+
+type WebhookDelivery struct {
+	DeliveryId string `json:"id"`
+	WebhookId  string `json:"webhookid"`
+	EventType  string `json:"eventtype"`
+	Payload    string `json:"payload"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"statuscode"`
+	Error      string `json:"error"`
+	IsSuccess  int    `json:"issuccess"`
+	UtcTime    int64  `json:"utctime"`
+}
+
+func InsertWebhook(db Querier, webhook Webhook) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook WHERE webhook_id = ?)", webhook.WebhookId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("A webhook with ID '" + webhook.WebhookId + "' is already registered")
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO webhook (webhook_id, user_id, url, secret, event_types, is_active, failure_count, utc_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		webhook.WebhookId,
+		webhook.UserId,
+		webhook.Url,
+		webhook.Secret,
+		webhook.EventTypes,
+		webhook.IsActive,
+		webhook.FailureCount,
+		webhook.UtcTime)
+
+	return err
+}
+
+func UpdateWebhook(db Querier, webhook Webhook) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook WHERE webhook_id = ?)", webhook.WebhookId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A webhook with ID '" + webhook.WebhookId + "' is not registered")
+	}
+
+	_, err = db.Exec(`
+		UPDATE webhook
+		SET url = ?,
+			event_types = ?,
+			is_active = ?,
+			failure_count = ?
+		WHERE webhook_id = ?`,
+		webhook.Url, webhook.EventTypes, webhook.IsActive, webhook.FailureCount, webhook.WebhookId)
+
+	return err
+}
+
+func getWebhooks(db Querier, query string, args ...any) ([]Webhook, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err = rows.Scan(
+			&webhook.WebhookId,
+			&webhook.UserId,
+			&webhook.Url,
+			&webhook.Secret,
+			&webhook.EventTypes,
+			&webhook.IsActive,
+			&webhook.FailureCount,
+			&webhook.UtcTime)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+func GetWebhooks(db Querier, userId string) ([]Webhook, error) {
+	return getWebhooks(db, `
+		SELECT webhook_id, user_id, url, secret, event_types, is_active, failure_count, utc_time
+		FROM webhook
+		WHERE user_id = ?
+		ORDER BY utc_time
+		`, userId)
+}
+
+func GetActiveWebhooks(db Querier, userId string) ([]Webhook, error) {
+	return getWebhooks(db, `
+		SELECT webhook_id, user_id, url, secret, event_types, is_active, failure_count, utc_time
+		FROM webhook
+		WHERE user_id = ?
+		  AND is_active = 1
+		`, userId)
+}
+
+func GetWebhook(db Querier, webhookId string) (*Webhook, error) {
+	webhooks, err := getWebhooks(db, `
+		SELECT webhook_id, user_id, url, secret, event_types, is_active, failure_count, utc_time
+		FROM webhook
+		WHERE webhook_id = ?
+		`, webhookId)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, errors.New("A webhook with ID '" + webhookId + "' is not registered")
+	}
+	return &webhooks[0], nil
+}
+
+func DeleteWebhook(db Querier, webhookId string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook WHERE webhook_id = ?)", webhookId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("A webhook with ID '" + webhookId + "' is not registered")
+	}
+
+	_, err = db.Exec(`DELETE FROM webhook_delivery WHERE webhook_id = ?`, webhookId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM webhook WHERE webhook_id = ?`, webhookId)
+	return err
+}
+
+// Resets the failure counter after a successful delivery
+func ResetWebhookFailures(db Querier, webhookId string) error {
+	_, err := db.Exec("UPDATE webhook SET failure_count = 0 WHERE webhook_id = ?", webhookId)
+	return err
+}
+
+// Increments the failure counter and disables the webhook when the counter reaches maxFailures
+func IncrementWebhookFailures(db Querier, webhookId string, maxFailures int) error {
+	_, err := db.Exec(`
+		UPDATE webhook
+		SET failure_count = failure_count + 1,
+			is_active = CASE WHEN failure_count + 1 >= ? THEN 0 ELSE is_active END
+		WHERE webhook_id = ?`,
+		maxFailures, webhookId)
+	return err
+}
+
+func InsertWebhookDelivery(db Querier, delivery WebhookDelivery) error {
+	_, err := db.Exec(`
+	INSERT INTO webhook_delivery (delivery_id, webhook_id, event_type, payload, attempt, status_code, error, is_success, utc_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.DeliveryId,
+		delivery.WebhookId,
+		delivery.EventType,
+		delivery.Payload,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.IsSuccess,
+		delivery.UtcTime)
+
+	return err
+}
+
+// Deletes the deliveries of the webhook stored before utcTime and those beyond the latest keep ones
+func DeleteOldWebhookDeliveries(db Querier, webhookId string, keep int, utcTime int64) error {
+	_, err := db.Exec(`
+		DELETE FROM webhook_delivery
+		WHERE webhook_id = ?
+		  AND (utc_time < ?
+			OR rowid NOT IN (
+				SELECT rowid
+				FROM webhook_delivery
+				WHERE webhook_id = ?
+				ORDER BY utc_time DESC
+				LIMIT ?))`,
+		webhookId, utcTime, webhookId, keep)
+	return err
+}
+
+func GetWebhookDeliveries(db Querier, webhookId string, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`
+		SELECT delivery_id, webhook_id, event_type, payload, attempt, status_code, error, is_success, utc_time
+		FROM webhook_delivery
+		WHERE webhook_id = ?
+		ORDER BY utc_time DESC
+		LIMIT ?
+		`, webhookId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err = rows.Scan(
+			&delivery.DeliveryId,
+			&delivery.WebhookId,
+			&delivery.EventType,
+			&delivery.Payload,
+			&delivery.Attempt,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.IsSuccess,
+			&delivery.UtcTime)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"todopp/cli"
 	"todopp/store"
 	"todopp/util"
 	"todopp/web"
@@ -13,6 +14,21 @@ import (
 func main() {
 	appConfig, err := util.GetConfig()
 
+	// task, project and group subcommands
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		if err != nil {
+			fmt.Print("Error reading config: ", err)
+			log.Fatal(err)
+		}
+
+		err = cli.Run(appConfig, os.Args[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// // command line attributes variables
 	// var userSet *bool
 	// var userDelete *bool
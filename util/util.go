@@ -3,10 +3,7 @@ package util
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 
@@ -26,13 +23,43 @@ type Config struct {
 	SmtpFrom      string `json:"smtpFrom"`
 	CaptchaSecret string `json:"hcaptchaSecret"`
 	Domain        string `json:"domain"`
-}
 
-type hCaptchaResponse struct {
-	Success     bool     `json:"success"`
-	ChallengeTS string   `json:"challenge_ts"` // timestamp
-	Hostname    string   `json:"hostname"`     // site's domain
-	ErrorCodes  []string `json:"error-codes"`  // optional errors
+	CaptchaProvider         string `json:"captchaProvider"` // hcaptcha (default), pow or disabled
+	HcaptchaSiteKey         string `json:"hcaptchaSiteKey"`
+	CaptchaPowDifficulty    int    `json:"captchaPowDifficulty"`    // leading zero bits of the proof-of-work hash
+	CaptchaFailureThreshold int    `json:"captchaFailureThreshold"` // failed logins before a captcha is required, 0 to always require it
+
+	LoginLockoutThreshold int `json:"loginLockoutThreshold"` // failed logins before the account is locked, defaults to 10
+	LoginLockoutMinutes   int `json:"loginLockoutMinutes"`   // defaults to 15
+
+	JwtKeyRotationDays int    `json:"jwtKeyRotationDays"` // rotate the jwt signing key this often, 0 to rotate only from the command line
+	JwtKeyGraceMinutes int    `json:"jwtKeyGraceMinutes"` // previous keys keep verifying this long after a rotation, defaults to 60
+	JwtAlgorithm       string `json:"jwtAlgorithm"`       // HS256 (default), ES256 or EdDSA; changing it rotates the signing key
+	JwtIssuer          string `json:"jwtIssuer"`          // defaults to https://<domain>
+	JwtAudience        string `json:"jwtAudience"`        // defaults to todopp
+
+	WebSocketOrigins []string `json:"webSocketOrigins"` // origins allowed to open the event socket, defaults to the server itself
+	EventWorkers     int      `json:"eventWorkers"`     // goroutines processing events in parallel, defaults to the number of CPUs
+	LogEvents        bool     `json:"logEvents"`        // print every processed event with its result
+
+	AttachmentDir     string `json:"attachmentDir"`
+	AttachmentQuota   int64  `json:"attachmentQuota"`
+	AttachmentMaxSize int64  `json:"attachmentMaxSize"`
+
+	WebhookMaxFailures          int  `json:"webhookMaxFailures"`
+	WebhookAllowPrivateNetworks bool `json:"webhookAllowPrivateNetworks"` // allow webhooks to loopback, link-local and private addresses
+
+	MailGatewayAddr   string `json:"mailGatewayAddr"`
+	MailGatewayDomain string `json:"mailGatewayDomain"`
+
+	OidcIssuer        string   `json:"oidcIssuer"`
+	OidcClientId      string   `json:"oidcClientId"`
+	OidcClientSecret  string   `json:"oidcClientSecret"`
+	OidcRedirectUrl   string   `json:"oidcRedirectUrl"`   // defaults to https://<domain>/api/oidc/callback
+	OidcScopes        []string `json:"oidcScopes"`        // defaults to openid, email and profile
+	OidcAutoProvision bool     `json:"oidcAutoProvision"` // create a user on the first login of an unknown identity
+	OidcLinkByEmail   bool     `json:"oidcLinkByEmail"`   // link an unknown identity to the confirmed account with its verified email
+	OidcButtonText    string   `json:"oidcButtonText"`
 }
 
 var appConfig *Config = nil
@@ -79,33 +106,3 @@ func GetConfig() (*Config, error) {
 		return appConfig, nil
 	}
 }
-
-func VerifyCaptcha(captchaResponce string) (bool, error) {
-	config, err := GetConfig()
-	if err != nil {
-		return false, err
-	}
-
-	resp, err := http.PostForm("https://hcaptcha.com/siteverify",
-		url.Values{
-			"secret":   {config.CaptchaSecret},
-			"response": {captchaResponce},
-		})
-
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
-	}
-
-	var hCaptcha hCaptchaResponse
-	if err := json.Unmarshal(body, &hCaptcha); err != nil {
-		return false, err
-	}
-
-	return hCaptcha.Success, nil
-}
@@ -0,0 +1,381 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"todopp/event"
+	"todopp/store"
+	"todopp/util"
+)
+
+const defaultAttachmentQuota = 100 << 20  // 100 MiB per user
+const defaultAttachmentMaxSize = 10 << 20 // 10 MiB per file
+
+// how often the files of deleted attachments are removed
+const orphanedAttachmentsPeriod = time.Hour
+
+// files written more recently may belong to an upload whose record is not stored yet
+const orphanedAttachmentMinAge = 10 * time.Minute
+
+var errAttachmentQuotaExceeded = errors.New("attachment quota exceeded")
+
+func getAttachmentDir(config *util.Config) string {
+	if config.AttachmentDir == "" {
+		return util.GetExecDir() + "attachments"
+	}
+	return config.AttachmentDir
+}
+
+func getAttachmentQuota(config *util.Config) int64 {
+	if config.AttachmentQuota <= 0 {
+		return defaultAttachmentQuota
+	}
+	return config.AttachmentQuota
+}
+
+func getAttachmentMaxSize(config *util.Config) int64 {
+	if config.AttachmentMaxSize <= 0 {
+		return defaultAttachmentMaxSize
+	}
+	return config.AttachmentMaxSize
+}
+
+func getAttachmentPath(config *util.Config, attachment store.Attachment) string {
+	return filepath.Join(getAttachmentDir(config), attachment.UserId, attachment.AttachmentId)
+}
+
+// GET ?task_id= lists the attachments of a task, GET ?attachment_id= downloads an attachment,
+// POST uploads a multipart file for the task_id form field, DELETE ?attachment_id= removes an attachment
+func attachmentHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost && request.Method != http.MethodDelete {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		if attachmentId := request.URL.Query().Get("attachment_id"); attachmentId != "" {
+			downloadAttachment(responseWriter, request, db, config, userId, attachmentId)
+			return
+		}
+
+		taskId := request.URL.Query().Get("task_id")
+		if taskId == "" {
+			http.Error(responseWriter, "Task or attachment parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		taskUserId, err := store.GetTaskUserId(db, taskId)
+		if err != nil || taskUserId != userId {
+			http.Error(responseWriter, "Task not found", http.StatusNotFound)
+			return
+		}
+
+		attachments, err := store.GetAttachmentsByTask(db, taskId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to retrieve attachments", http.StatusInternalServerError)
+			return
+		}
+
+		attachmentsJson, err := json.Marshal(attachments)
+		if err != nil {
+			http.Error(responseWriter, "Failed to serialize attachments", http.StatusInternalServerError)
+			return
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.WriteHeader(http.StatusOK)
+		responseWriter.Write(attachmentsJson)
+	case http.MethodPost:
+		uploadAttachment(responseWriter, request, db, config, login, userId)
+	case http.MethodDelete:
+		deleteAttachment(responseWriter, request, db, config, login, userId)
+	}
+}
+
+func downloadAttachment(responseWriter http.ResponseWriter, request *http.Request, db *sql.DB, config *util.Config, userId string, attachmentId string) {
+	attachment, err := store.GetAttachment(db, attachmentId)
+	if err != nil || attachment.UserId != userId {
+		http.Error(responseWriter, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(getAttachmentPath(config, *attachment))
+	if err != nil {
+		http.Error(responseWriter, "Failed to open attachment", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// only images are rendered inline, everything else is downloaded to prevent serving active content
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") && attachment.ContentType != "image/svg+xml" {
+		disposition = "inline"
+	}
+
+	responseWriter.Header().Set("Content-Type", attachment.ContentType)
+	responseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	responseWriter.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, strconv.Quote(attachment.FileName)))
+	http.ServeContent(responseWriter, request, "", time.UnixMilli(attachment.UtcTime), file)
+}
+
+func uploadAttachment(responseWriter http.ResponseWriter, request *http.Request, db *sql.DB, config *util.Config, login string, userId string) {
+	maxSize := getAttachmentMaxSize(config)
+	// leave some room for the multipart headers and the form fields
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, maxSize+1<<20)
+
+	err := request.ParseMultipartForm(1 << 20)
+	if err != nil {
+		http.Error(responseWriter, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer request.MultipartForm.RemoveAll()
+
+	taskId := request.FormValue("task_id")
+	if taskId == "" {
+		http.Error(responseWriter, "Task parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	taskUserId, err := store.GetTaskUserId(db, taskId)
+	if err != nil || taskUserId != userId {
+		http.Error(responseWriter, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	file, fileHeader, err := request.FormFile("file")
+	if err != nil {
+		http.Error(responseWriter, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if fileHeader.Size > maxSize {
+		http.Error(responseWriter, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// detect the content type from the file content instead of trusting the client
+	sniff := make([]byte, 512)
+	sniffSize, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		http.Error(responseWriter, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	contentType := http.DetectContentType(sniff[:sniffSize])
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		http.Error(responseWriter, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	var attachment store.Attachment
+	attachment.AttachmentId = util.Uuid()
+	attachment.TaskId = taskId
+	attachment.UserId = userId
+	attachment.FileName = filepath.Base(fileHeader.Filename)
+	attachment.ContentType = contentType
+	attachment.Size = fileHeader.Size
+	attachment.UtcTime = time.Now().UTC().UnixMilli()
+
+	path := getAttachmentPath(config, attachment)
+	err = writeAttachmentFile(path, file)
+	if err != nil {
+		http.Error(responseWriter, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+
+	err = insertAttachmentWithinQuota(db, config, attachment)
+	if err != nil {
+		os.Remove(path)
+		if err == errAttachmentQuotaExceeded {
+			http.Error(responseWriter, "Attachment quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(responseWriter, "Failed to store attachment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = publishAttachmentEvent(db, login, userId, "attachment-add", request.FormValue("instance"), attachment)
+	if err != nil {
+		fmt.Println("Failed to publish attachment event: ", err)
+	}
+
+	attachmentJson, err := json.Marshal(attachment)
+	if err != nil {
+		http.Error(responseWriter, "Failed to serialize attachment", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(attachmentJson)
+}
+
+// Checks the quota and stores the attachment in one transaction, so concurrent uploads can't exceed the quota together
+func insertAttachmentWithinQuota(db *sql.DB, config *util.Config, attachment store.Attachment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	usedSize, err := store.GetUserAttachmentsSize(tx, attachment.UserId)
+	if err == nil && usedSize+attachment.Size > getAttachmentQuota(config) {
+		err = errAttachmentQuotaExceeded
+	}
+	if err == nil {
+		err = store.InsertAttachment(tx, attachment)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteAttachment(responseWriter http.ResponseWriter, request *http.Request, db *sql.DB, config *util.Config, login string, userId string) {
+	attachmentId := request.URL.Query().Get("attachment_id")
+
+	attachment, err := store.GetAttachment(db, attachmentId)
+	if err != nil || attachment.UserId != userId {
+		http.Error(responseWriter, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	err = store.DeleteAttachment(db, attachmentId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to delete attachment: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = os.Remove(getAttachmentPath(config, *attachment))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Failed to remove attachment file: ", err)
+	}
+
+	err = publishAttachmentEvent(db, login, userId, "attachment-delete", request.URL.Query().Get("instance"), *attachment)
+	if err != nil {
+		fmt.Println("Failed to publish attachment event: ", err)
+	}
+
+	responseWriter.WriteHeader(http.StatusOK)
+}
+
+func writeAttachmentFile(path string, source io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func publishAttachmentEvent(db *sql.DB, login string, userId string, eventType string, instance string, attachment store.Attachment) error {
+	payload, err := json.Marshal(event.AttachmentPayload{
+		Id:          attachment.AttachmentId,
+		Task:        attachment.TaskId,
+		Name:        attachment.FileName,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	return publishEvent(db, login, userId, event.Event{Type: eventType, Instance: instance, Payload: payload})
+}
+
+// Starts a background loop which removes the files of attachments deleted together with their tasks, groups or projects
+func startOrphanedAttachmentsScheduler() {
+	go func() {
+		for {
+			err := removeOrphanedAttachments()
+			if err != nil {
+				fmt.Println("Error while removing orphaned attachments: ", err)
+			}
+			time.Sleep(orphanedAttachmentsPeriod)
+		}
+	}()
+}
+
+// Removes stored files whose attachment records were deleted together with their tasks, groups or projects
+func removeOrphanedAttachments() error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	attachmentIds, err := store.GetAttachmentIds(db)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(getAttachmentDir(config), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || attachmentIds[entry.Name()] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < orphanedAttachmentMinAge {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"todopp/mail"
+	"todopp/store"
+	"todopp/util"
+)
+
+// Actions guarded against brute force
+const (
+	attemptLogin        = "login"
+	attemptRegister     = "register"
+	attemptConfirmEmail = "confirm_email"
+	attemptResetRequest = "reset_request"
+)
+
+const defaultLockoutThreshold = 10
+const defaultLockoutMinutes = 15
+
+// failures older than this are forgotten
+const attemptWindow = 24 * time.Hour
+
+// longest delay between failed attempts below the lockout
+const maxAttemptBackoff = 15 * time.Minute
+
+func getIpAttemptKey(action string, ip string) string {
+	return action + ":ip:" + ip
+}
+
+func getLoginAttemptKey(action string, login string) string {
+	return action + ":user:" + login
+}
+
+func getAttemptKeys(action string, ip string, login string) []string {
+	keys := []string{getIpAttemptKey(action, ip)}
+	if login != "" {
+		keys = append(keys, getLoginAttemptKey(action, login))
+	}
+	return keys
+}
+
+// Returns how long the caller has to wait before the next attempt, 0 if the attempt is allowed
+func getAttemptWait(db *sql.DB, keys []string) (time.Duration, error) {
+	now := time.Now().UTC().UnixMilli()
+	var wait time.Duration
+	for _, key := range keys {
+		attempt, err := store.GetLoginAttempt(db, key)
+		if err != nil {
+			return 0, err
+		}
+		if attempt != nil && attempt.BlockedUntil > now {
+			wait = max(wait, time.Duration(attempt.BlockedUntil-now)*time.Millisecond)
+		}
+	}
+	return wait, nil
+}
+
+// Writes 429 with Retry-After if the attempt has to wait. Returns false if the handler should stop
+func checkAttemptAllowed(responseWriter http.ResponseWriter, db *sql.DB, action string, ip string, login string) bool {
+	wait, err := getAttemptWait(db, getAttemptKeys(action, ip, login))
+	if err != nil {
+		http.Error(responseWriter, "Failed to check login attempts", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(responseWriter, wait)
+		return false
+	}
+	return true
+}
+
+func writeTooManyAttempts(responseWriter http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	responseWriter.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(responseWriter, "Too many failed attempts, please try again in "+formatWait(seconds), http.StatusTooManyRequests)
+}
+
+func formatWait(seconds int) string {
+	if seconds < 60 {
+		return strconv.Itoa(seconds) + " seconds"
+	}
+	return strconv.Itoa((seconds+59)/60) + " minutes"
+}
+
+// Records a failure of the action. Each failure doubles the delay before the next attempt; for logins
+// the account is locked once the failures reach the threshold and the owner is alerted by email
+func recordFailedAttempt(db *sql.DB, action string, ip string, login string) error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	threshold := config.LoginLockoutThreshold
+	if threshold <= 0 {
+		threshold = defaultLockoutThreshold
+	}
+	lockoutMinutes := config.LoginLockoutMinutes
+	if lockoutMinutes <= 0 {
+		lockoutMinutes = defaultLockoutMinutes
+	}
+
+	now := time.Now().UTC()
+	err = store.DeleteStaleLoginAttempts(db, now.Add(-attemptWindow).UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	for _, key := range getAttemptKeys(action, ip, login) {
+		// concurrent failures each get their own count, so none of them is lost
+		failures, err := store.IncrementLoginAttempt(db, key, now.UnixMilli())
+		if err != nil {
+			return err
+		}
+
+		backoff := min(time.Second<<min(failures-1, 20), maxAttemptBackoff)
+		blockedUntil := now.Add(backoff)
+
+		isLockout := action == attemptLogin && key != getIpAttemptKey(action, ip) && failures >= threshold
+		if isLockout {
+			blockedUntil = now.Add(time.Duration(lockoutMinutes) * time.Minute)
+		}
+
+		err = store.BlockLoginAttempt(db, key, blockedUntil.UnixMilli())
+		if err != nil {
+			return err
+		}
+
+		// one alert per window, later lockouts follow directly on further failures
+		if isLockout && failures == threshold {
+			sendLockoutAlert(db, login, ip, blockedUntil)
+		}
+	}
+	return nil
+}
+
+func sendLockoutAlert(db *sql.DB, login string, ip string, lockedUntil time.Time) {
+	user, err := store.GetUserByLogin(db, login)
+	if err != nil || user.Email == "" {
+		return
+	}
+
+	// the alert must not delay the response, which would tell the attacker the login exists
+	go func() {
+		err := mail.SendLockoutAlertEmail(user.Email, user.Login, ip, lockedUntil)
+		if err != nil {
+			fmt.Println("Error sending lockout alert: ", err)
+		}
+	}()
+}
+
+// Forgets the failures for the login after a successful attempt. Failures from the IP address expire on their own
+func clearFailedAttempts(db *sql.DB, action string, login string) error {
+	return store.DeleteLoginAttempt(db, getLoginAttemptKey(action, login))
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 	"todopp/auth"
@@ -43,28 +46,81 @@ func checkCredentials(username, password string, checkIfIsActive bool) bool {
 	return util.CheckPassword(password, password_hash) && (!checkIfIsActive || store.IsUserExistsAndActive(db, username))
 }
 
+// API paths available without a bearer token
+var publicPaths = []string{
+	"/api/captcha",
+	"/api/login",
+	"/api/login/2fa",
+	"/api/register",
+	"/api/confirm_email",
+	"/api/password_reset/request",
+	"/api/password_reset/confirm",
+	"/api/token_renew",
+	"/api/logout",
+}
+
 func bearerAuth(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
-		if !strings.Contains(request.URL.Path, "/api/") || request.URL.Path == "/api/login" || request.URL.Path == "/api/register" || request.URL.Path == "/api/confirm_email" {
+		if !strings.Contains(request.URL.Path, "/api/") || slices.Contains(publicPaths, request.URL.Path) || strings.HasPrefix(request.URL.Path, "/api/oidc/") {
 			next.ServeHTTP(responseWriter, request)
 			return
 		}
 
-		_, err := verifyJwtAndGetLoginByRequest(*request)
+		principal, err := getCurrentPrincipal(*request)
 		if err != nil {
 			http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
+		if !isRequestAllowed(*principal, *request) {
+			http.Error(responseWriter, "The access token scopes do not allow this request", http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(responseWriter, request)
 	})
 }
 
+// Paths managing the credentials of the account, which are only available to browser sessions and admin tokens
+var credentialPaths = []string{"/api/tokens", "/api/sessions", "/api/totp"}
+
+// Paths reporting the state of the server, which are only available to browser sessions and admin tokens
+var adminPaths = []string{"/api/event_metrics"}
+
+// Checks the request against the scopes of a personal access token
+func isRequestAllowed(principal auth.Principal, request http.Request) bool {
+	if principal.HasScope(auth.ScopeAdmin) {
+		return true
+	}
+
+	for _, path := range credentialPaths {
+		if request.URL.Path == path || strings.HasPrefix(request.URL.Path, path+"/") {
+			return false
+		}
+	}
+
+	if slices.Contains(adminPaths, request.URL.Path) {
+		return false
+	}
+
+	if request.Method == http.MethodGet {
+		return principal.HasScope(auth.ScopeRead)
+	}
+
+	// events sent over HTTP are checked one by one against the scopes by the handler
+	if request.URL.Path == "/api/attachments" || request.URL.Path == "/api/events" {
+		return principal.HasScope(auth.ScopeTasksWrite)
+	}
+
+	return false
+}
+
 type LoginPrompt struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 	Captcha  string `json:"captcha"`
+	Device   string `json:"device"` // optional device name shown in the session list
 }
 
 type Register struct {
@@ -102,34 +158,74 @@ func loginHandler(responseWriter http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	isCaptchaValid, err := util.VerifyCaptcha(loginPrompt.Captcha)
-	if err != nil || !isCaptchaValid {
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// locked accounts and IP addresses in backoff are rejected before the password is checked
+	ip := getRequestIp(request)
+	if !checkAttemptAllowed(responseWriter, db, attemptLogin, ip, loginPrompt.Login) {
+		return
+	}
+
+	// a captcha is only required after failed attempts from the IP or for the login
+	isCaptchaRequired, err := isLoginCaptchaRequired(db, ip, loginPrompt.Login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to check login attempts", http.StatusInternalServerError)
+		return
+	}
+	if isCaptchaRequired && !verifyCaptcha(loginPrompt.Captcha, ip) {
 		http.Error(responseWriter, "Failed Captcha validation", http.StatusInternalServerError)
 		return
 	}
 
 	// 2. Validate credentials (check against DB)
-	if checkCredentials(loginPrompt.Login, loginPrompt.Password, true) {
-
-		jwtKey, err := auth.GetJwtKey()
+	if !checkCredentials(loginPrompt.Login, loginPrompt.Password, true) {
+		err = recordFailedAttempt(db, attemptLogin, ip, loginPrompt.Login)
 		if err != nil {
-			http.Error(responseWriter, "Failed to read jwt key", http.StatusInternalServerError)
-			return
+			fmt.Println("Error recording failed login: ", err)
 		}
+		http.Error(responseWriter, "Invalid login or password", http.StatusUnauthorized)
+		return
+	}
 
-		tokenString, err := auth.CreateJWTToken(jwtKey, loginPrompt.Login)
+	userId, err := store.GetUserIdByLogin(db, loginPrompt.Login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	// 3. Users with two-factor authentication have to submit a code to /api/login/2fa first
+	isTotpEnabled, err := store.IsTotpEnabled(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve TOTP status", http.StatusInternalServerError)
+		return
+	}
+	if isTotpEnabled {
+		challenge, err := createTwoFactorChallenge(db, userId)
 		if err != nil {
-			http.Error(responseWriter, "Failed to create jwt token", http.StatusInternalServerError)
+			http.Error(responseWriter, "Failed to create login challenge", http.StatusInternalServerError)
 			return
 		}
-
-		responseWriter.Header().Set("Content-Type", "text/plain")
-		responseWriter.Write([]byte(tokenString))
-	} else {
-		http.Error(responseWriter, "Invalid login or password", http.StatusUnauthorized)
+		writeJson(responseWriter, TwoFactorChallenge{TwoFactor: true, Challenge: challenge})
 		return
 	}
 
+	err = clearFailedAttempts(db, attemptLogin, loginPrompt.Login)
+	if err != nil {
+		fmt.Println("Error clearing failed logins: ", err)
+	}
+
+	writeAccessToken(responseWriter, request, loginPrompt.Login, loginPrompt.Device)
 }
 
 func registerHandler(responseWriter http.ResponseWriter, request *http.Request) {
@@ -152,12 +248,6 @@ func registerHandler(responseWriter http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	err = ValidateRegistration(register)
-	if err != nil {
-		http.Error(responseWriter, "Registration form validation error: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	config, err := util.GetConfig()
 	if err != nil {
 		http.Error(responseWriter, "Error reading config: "+err.Error(), http.StatusInternalServerError)
@@ -171,8 +261,22 @@ func registerHandler(responseWriter http.ResponseWriter, request *http.Request)
 	}
 	defer db.Close()
 
+	// failed registrations are limited per IP address, they can be used to probe for taken logins and emails
+	ip := getRequestIp(request)
+	if !checkAttemptAllowed(responseWriter, db, attemptRegister, ip, "") {
+		return
+	}
+
+	err = ValidateRegistration(register)
+	if err != nil {
+		recordFailedRegistration(db, ip)
+		http.Error(responseWriter, "Registration form validation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	err = store.ValidateUserRegistration(db, register.Login, register.Email)
 	if err != nil {
+		recordFailedRegistration(db, ip)
 		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -225,6 +329,13 @@ func registerHandler(responseWriter http.ResponseWriter, request *http.Request)
 
 }
 
+func recordFailedRegistration(db *sql.DB, ip string) {
+	err := recordFailedAttempt(db, attemptRegister, ip, "")
+	if err != nil {
+		fmt.Println("Error recording failed registration: ", err)
+	}
+}
+
 func generateConfirmationToken() (string, error) {
 	key := make([]byte, 32)
 	if _, err := rand.Read(key); err != nil {
@@ -237,8 +348,7 @@ func generateConfirmationToken() (string, error) {
 
 func ValidateRegistration(register Register) error {
 
-	isCaptchaValid, err := util.VerifyCaptcha(register.Captcha)
-	if err != nil || !isCaptchaValid {
+	if !verifyCaptcha(register.Captcha, "") {
 		return errors.New("failed Captcha validation")
 	}
 
@@ -258,8 +368,12 @@ func ValidateRegistration(register Register) error {
 		return errors.New("invalid email format")
 	}
 
+	return validatePassword(register.Password)
+}
+
+func validatePassword(password string) error {
 	// Password validation
-	if len(register.Password) < 8 {
+	if len(password) < 8 {
 		return errors.New("password must be at least 8 characters long")
 	}
 
@@ -270,7 +384,7 @@ func ValidateRegistration(register Register) error {
 		hasSpecial = false
 	)
 
-	for _, char := range register.Password {
+	for _, char := range password {
 		switch {
 		case unicode.IsUpper(char):
 			hasUpper = true
@@ -299,33 +413,6 @@ func ValidateRegistration(register Register) error {
 	return nil
 }
 
-func tokenRenewHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	login, err := verifyJwtAndGetLoginByRequest(*request)
-	if err != nil {
-		http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
-	}
-
-	jwtKey, err := auth.GetJwtKey()
-	if err != nil {
-		http.Error(responseWriter, "Failed to read jwt key", http.StatusInternalServerError)
-		return
-	}
-
-	tokenString, err := auth.CreateJWTToken(jwtKey, login)
-	if err != nil {
-		http.Error(responseWriter, "Failed to create jwt token", http.StatusInternalServerError)
-		return
-	}
-
-	responseWriter.Header().Set("Content-Type", "text/plain")
-	responseWriter.Write([]byte(tokenString))
-}
-
 func emailConfirmationHandler(responseWriter http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
@@ -361,8 +448,26 @@ func emailConfirmationHandler(responseWriter http.ResponseWriter, request *http.
 	}
 	defer db.Close()
 
+	// guessing confirmation links is limited per IP address
+	ip := getRequestIp(request)
+	wait, err := getAttemptWait(db, getAttemptKeys(attemptConfirmEmail, ip, ""))
+	if err == nil && wait > 0 {
+		response.Status = "error"
+		response.Header = "Too Many Attempts"
+		response.Message = "There were too many invalid links from your network. Please try again in " + formatWait(int(wait.Seconds())+1) + "."
+		response.Details = ""
+		responseJson, _ := json.Marshal(response)
+		responseWriter.Header().Set("Content-Type", "application/json")
+		responseWriter.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		responseWriter.Write(responseJson)
+		return
+	}
+
 	err = store.ValidateSecret(db, token)
 	if err != nil {
+		if recordErr := recordFailedAttempt(db, attemptConfirmEmail, ip, ""); recordErr != nil {
+			fmt.Println("Error recording failed email confirmation: ", recordErr)
+		}
 		response.Status = "error"
 		response.Header = "Invalid or Expired Link"
 		response.Message = "We couldn't validate your email link. Please try again or request a new verification link."
@@ -383,12 +488,43 @@ func emailConfirmationHandler(responseWriter http.ResponseWriter, request *http.
 }
 
 func verifyJwtAndGetLoginByRequest(request http.Request) (string, error) {
+	principal, err := getCurrentPrincipal(request)
+	if err != nil {
+		return "", err
+	}
+	return principal.Login, nil
+}
+
+// Authenticates the bearer token of the request, which is a session JWT or a personal access token
+func getCurrentPrincipal(request http.Request) (*auth.Principal, error) {
+	tokenString, err := getRequestToken(request)
+	if err != nil {
+		return nil, err
+	}
+	return auth.Authenticate(tokenString)
+}
+
+// Paths opened by an EventSource, which can't send headers. The access token is read from the cookie instead
+var cookieAuthPaths = []string{"/api/events/stream"}
+
+// Returns the bearer token, or the token cookie on the paths which accept it
+func getRequestToken(request http.Request) (string, error) {
+	tokenString, err := getBearerToken(request)
+	if err != nil && request.Method == http.MethodGet && slices.Contains(cookieAuthPaths, request.URL.Path) {
+		cookie, cookieErr := request.Cookie("jwtToken")
+		if cookieErr == nil && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+	return tokenString, err
+}
+
+func getBearerToken(request http.Request) (string, error) {
 	authHeader := request.Header.Get("Authorization")
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 		return "", errors.New("the request is missing the 'Authorization: Bearer' header")
 	}
-	tokenString := authHeader[len("Bearer "):]
-	return auth.VerifyJwtAndGetLogin(tokenString)
+	return authHeader[len("Bearer "):], nil
 }
 
 func getCurrentLogin(request http.Request) (string, error) {
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+	"todopp/captcha"
+	"todopp/store"
+	"todopp/util"
+)
+
+type CaptchaResponse struct {
+	IsRequired bool `json:"isrequired"`
+	*captcha.Challenge
+}
+
+// failures older than this don't require a captcha anymore
+const captchaFailureWindow = 15 * time.Minute
+
+// Reports whether the next login from the IP has to solve a captcha. It is required once the IP or the
+// login has failed CaptchaFailureThreshold times recently, counting the failures recorded for the lockout
+func isLoginCaptchaRequired(db *sql.DB, ip string, login string) (bool, error) {
+	config, err := util.GetConfig()
+	if err != nil {
+		return true, err
+	}
+	if config.CaptchaFailureThreshold <= 0 {
+		return true, nil
+	}
+
+	recent := time.Now().UTC().Add(-captchaFailureWindow).UnixMilli()
+	for _, key := range getAttemptKeys(attemptLogin, ip, login) {
+		attempt, err := store.GetLoginAttempt(db, key)
+		if err != nil {
+			return true, err
+		}
+		if attempt != nil && attempt.Failures >= config.CaptchaFailureThreshold && attempt.LastFailure > recent {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func verifyCaptcha(response string, remoteIp string) bool {
+	provider, err := captcha.GetProvider()
+	if err != nil {
+		fmt.Println("Error reading captcha provider: ", err)
+		return false
+	}
+
+	isValid, err := provider.Verify(response, remoteIp)
+	if err != nil {
+		fmt.Println("Error verifying captcha: ", err)
+		return false
+	}
+	return isValid
+}
+
+// GET ?action=login&login= returns whether the action needs a captcha and the challenge to solve
+func captchaHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	provider, err := captcha.GetProvider()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read captcha provider", http.StatusInternalServerError)
+		return
+	}
+
+	challenge, err := provider.NewChallenge()
+	if err != nil {
+		http.Error(responseWriter, "Failed to create captcha challenge", http.StatusInternalServerError)
+		return
+	}
+
+	// registration and password reset always need a captcha, logins only after failed attempts
+	isRequired := challenge.Provider != captcha.ProviderDisabled
+	if isRequired && request.URL.Query().Get("action") == "login" {
+		config, err := util.GetConfig()
+		if err != nil {
+			http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+			return
+		}
+
+		db, err := store.OpenDb(config.DbPath)
+		if err != nil {
+			http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		isRequired, err = isLoginCaptchaRequired(db, getRequestIp(request), request.URL.Query().Get("login"))
+		if err != nil {
+			http.Error(responseWriter, "Failed to check login attempts", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJson(responseWriter, CaptchaResponse{IsRequired: isRequired, Challenge: challenge})
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+	"todopp/store"
+	"todopp/util"
+)
+
+// GET returns the digest settings of the current user, POST stores them
+func digestHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+			return
+		}
+		defer request.Body.Close()
+
+		var settings store.DigestSettings
+		err = json.Unmarshal(body, &settings)
+		if err != nil {
+			http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+			return
+		}
+
+		if settings.Schedule != "off" && settings.Schedule != "daily" && settings.Schedule != "weekly" {
+			http.Error(responseWriter, "Schedule must be one of 'off', 'daily' or 'weekly'", http.StatusBadRequest)
+			return
+		}
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			http.Error(responseWriter, "Unknown timezone '"+settings.Timezone+"'", http.StatusBadRequest)
+			return
+		}
+		if settings.Hour < 0 || settings.Hour > 23 {
+			http.Error(responseWriter, "Hour must be between 0 and 23", http.StatusBadRequest)
+			return
+		}
+		if settings.Weekday < 0 || settings.Weekday > 6 {
+			http.Error(responseWriter, "Weekday must be between 0 (Sunday) and 6 (Saturday)", http.StatusBadRequest)
+			return
+		}
+
+		settings.UserId = userId
+		// the first digest is sent at the next scheduled time, not for the already passed one
+		settings.LastSent = time.Now().UnixMilli()
+
+		err = store.UpsertDigestSettings(db, settings)
+		if err != nil {
+			http.Error(responseWriter, "Failed to store digest settings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	settings, err := store.GetDigestSettings(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve digest settings", http.StatusInternalServerError)
+		return
+	}
+
+	settingsJson, err := json.Marshal(settings)
+	if err != nil {
+		http.Error(responseWriter, "Failed to serialize digest settings", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(settingsJson)
+}
@@ -0,0 +1,432 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"todopp/auth"
+	"todopp/event"
+	"todopp/store"
+	"todopp/util"
+)
+
+// Fallback transports for clients which can't keep a WebSocket open, e.g. behind proxies dropping the upgrade.
+// They serve the changes stored in the event table, so a client resuming after its last event id misses none
+const (
+	// comment lines keep proxies from closing an idle stream
+	eventStreamHeartbeat = 15 * time.Second
+	// delay before an EventSource reconnects after the stream closed
+	eventStreamRetry = 3 * time.Second
+	// how long a long poll waits for a change by default, and at most
+	longPollTimeout    = 25 * time.Second
+	maxLongPollTimeout = 55 * time.Second
+	// changes read at once, the rest follows right after
+	eventPageSize = 100
+)
+
+var errUnknownEventId = errors.New("the event id is unknown, fetch the complete data and start from the latest event")
+
+// Reply of a long poll
+type EventPollResult struct {
+	Events []json.RawMessage `json:"events"`
+	Last   string            `json:"last"` // id to pass as after to the next poll
+}
+
+// Sent before a stream is closed for its token, mirroring the close frame of a WebSocket
+type EventStreamClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Stream or long poll waiting for the changes of a login
+type listener struct {
+	login     string
+	sessionId string
+	tokenId   string
+	notify    chan struct{} // signalled when a change has been stored, holds at most one signal
+	revoked   chan struct{} // closed by the hub when the access is revoked
+}
+
+func newListener(principal *auth.Principal) *listener {
+	return &listener{
+		login:     principal.Login,
+		sessionId: principal.SessionId,
+		tokenId:   principal.TokenId,
+		notify:    make(chan struct{}, 1),
+		revoked:   make(chan struct{}),
+	}
+}
+
+// Wakes the listeners of the login without blocking the hub
+func (hub *Hub) notifyListeners(login string) {
+	for listener := range hub.listeners {
+		if listener.login != login {
+			continue
+		}
+		select {
+		case listener.notify <- struct{}{}:
+		default:
+			// already signalled, the next query returns all changes anyway
+		}
+	}
+}
+
+func (hub *Hub) revokeListeners(disconnect disconnect) {
+	for listener := range hub.listeners {
+		if disconnect.matches(listener.login, listener.sessionId, listener.tokenId) {
+			delete(hub.listeners, listener)
+			close(listener.revoked)
+		}
+	}
+}
+
+// Returns the id of the last event the client has seen, or of the latest event if it has seen none.
+// An id which is not stored for the user can't be resumed from
+func getEventCursor(db *sql.DB, userId string, eventId string) (string, error) {
+	if eventId == "" {
+		return store.GetLastEventId(db, userId)
+	}
+	exists, err := store.IsEventExists(db, userId, eventId)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errUnknownEventId
+	}
+	return eventId, nil
+}
+
+// GET streams the changes of the user as server-sent events with the event ids as ids. A client reconnecting
+// with the Last-Event-ID header, or the lastEventId parameter, first gets the changes it missed.
+// Browsers authenticate with the token cookie and pick up the renewed token when they reconnect
+func eventStreamHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok {
+		http.Error(responseWriter, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := getRequestToken(*request)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	principal, err := auth.Authenticate(token)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, principal.Login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventId := request.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = request.URL.Query().Get("lastEventId")
+	}
+	cursor, err := getEventCursor(db, userId, lastEventId)
+	if err == errUnknownEventId {
+		http.Error(responseWriter, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(responseWriter, "Failed to read events", http.StatusInternalServerError)
+		return
+	}
+
+	// listening before the first query, so no change stored meanwhile is missed
+	listener := newListener(principal)
+	hub.listen <- listener
+	defer func() { hub.unlisten <- listener }()
+
+	responseWriter.Header().Set("Content-Type", "text/event-stream")
+	responseWriter.Header().Set("Cache-Control", "no-cache")
+	responseWriter.Header().Set("X-Accel-Buffering", "no")
+	responseWriter.WriteHeader(http.StatusOK)
+	fmt.Fprintf(responseWriter, "retry: %d\n\n", eventStreamRetry.Milliseconds())
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	reverify := time.NewTicker(webSocketReverifyPeriod)
+	defer reverify.Stop()
+
+	// like a WebSocket connection the stream ends with its token, the client reconnects with a renewed one
+	var expired <-chan time.Time
+	if principal.Expire != 0 {
+		expiryTimer := time.NewTimer(time.Until(time.UnixMilli(principal.Expire)))
+		defer expiryTimer.Stop()
+		expired = expiryTimer.C
+	}
+
+	for {
+		cursor, err = writeStreamEvents(responseWriter, db, userId, cursor)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-request.Context().Done():
+			return
+		case <-listener.notify:
+		case <-heartbeat.C:
+			fmt.Fprint(responseWriter, ": keepalive\n\n")
+		case <-reverify.C:
+			_, err = auth.Authenticate(token)
+			if err != nil {
+				closeEventStream(responseWriter, flusher, err.Error())
+				return
+			}
+		case <-expired:
+			closeEventStream(responseWriter, flusher, "The access token has expired")
+			return
+		case <-listener.revoked:
+			closeEventStream(responseWriter, flusher, "The access has been revoked")
+			return
+		}
+	}
+}
+
+// Writes the changes stored after the cursor and returns the id of the last one written
+func writeStreamEvents(writer io.Writer, db *sql.DB, userId string, cursor string) (string, error) {
+	for {
+		events, err := store.GetEventsAfter(db, userId, cursor, eventPageSize)
+		if err != nil {
+			return cursor, err
+		}
+		for _, storedEvent := range events {
+			// the stored responses are single line JSON, so each one fits a data field
+			_, err = fmt.Fprintf(writer, "id: %s\ndata: %s\n\n", storedEvent.EventId, storedEvent.Responce)
+			if err != nil {
+				return cursor, err
+			}
+			cursor = storedEvent.EventId
+		}
+		if len(events) < eventPageSize {
+			return cursor, nil
+		}
+	}
+}
+
+func closeEventStream(writer io.Writer, flusher http.Flusher, reason string) {
+	data, _ := json.Marshal(EventStreamClose{Code: closeUnauthorized, Reason: reason})
+	fmt.Fprintf(writer, "event: close\ndata: %s\n\n", data)
+	flusher.Flush()
+}
+
+// GET ?after=<event id> waits for the changes of the user stored after the event and returns them with the id
+// to poll after next. An empty after starts from the first change. Without after the id of the latest change
+// is returned right away. The optional timeout is in seconds
+func eventPollHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := getCurrentPrincipal(*request)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	timeout := longPollTimeout
+	if timeoutParam := request.URL.Query().Get("timeout"); timeoutParam != "" {
+		seconds, err := strconv.Atoi(timeoutParam)
+		if err != nil || seconds < 0 {
+			http.Error(responseWriter, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, maxLongPollTimeout)
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, principal.Login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	if !request.URL.Query().Has("after") {
+		last, err := store.GetLastEventId(db, userId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read events", http.StatusInternalServerError)
+			return
+		}
+		writeJson(responseWriter, EventPollResult{Events: []json.RawMessage{}, Last: last})
+		return
+	}
+
+	after := request.URL.Query().Get("after")
+	if after != "" {
+		_, err = getEventCursor(db, userId, after)
+		if err == errUnknownEventId {
+			http.Error(responseWriter, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(responseWriter, "Failed to read events", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	listener := newListener(principal)
+	hub.listen <- listener
+	defer func() { hub.unlisten <- listener }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		events, err := store.GetEventsAfter(db, userId, after, eventPageSize)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read events", http.StatusInternalServerError)
+			return
+		}
+		if len(events) > 0 {
+			result := EventPollResult{Events: make([]json.RawMessage, 0, len(events)), Last: events[len(events)-1].EventId}
+			for _, storedEvent := range events {
+				result.Events = append(result.Events, json.RawMessage(storedEvent.Responce))
+			}
+			writeJson(responseWriter, result)
+			return
+		}
+
+		select {
+		case <-request.Context().Done():
+			return
+		case <-listener.notify:
+		case <-timer.C:
+			writeJson(responseWriter, EventPollResult{Events: []json.RawMessage{}, Last: after})
+			return
+		case <-listener.revoked:
+			http.Error(responseWriter, "The access has been revoked", http.StatusUnauthorized)
+			return
+		}
+	}
+}
+
+// POST applies an event sent over plain HTTP like one sent on a WebSocket connection and replies with its ack,
+// or with its nack and the status of the error code. The change is delivered to all connections of the user
+func eventSubmitHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := getCurrentPrincipal(*request)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var appEvent event.Event
+	body, err := io.ReadAll(http.MaxBytesReader(responseWriter, request.Body, maxMessageSize))
+	if err != nil {
+		writeNack(responseWriter, appEvent, event.NewEventError(event.ErrorCodeTooLarge, "event exceeds "+strconv.Itoa(maxMessageSize)+" bytes"))
+		return
+	}
+	err = json.Unmarshal(body, &appEvent)
+	if err != nil {
+		writeNack(responseWriter, appEvent, event.NewEventError(event.ErrorCodeInvalidEvent, "invalid event: "+err.Error()))
+		return
+	}
+
+	if !event.IsEventType(appEvent.Type) {
+		writeNack(responseWriter, appEvent, event.NewEventError(event.ErrorCodeUnknownType, "unknown event type '"+appEvent.Type+"'"))
+		return
+	}
+
+	err = checkEventScopes(principal, appEvent)
+	if err != nil {
+		writeNack(responseWriter, appEvent, err)
+		return
+	}
+
+	userId, err := store.GetUserIdByLogin(eventDb, principal.Login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	// the request carries the token in its header, the one in the event is not needed
+	err = dispatchEventAndWait(principal.Login, userId, appEvent)
+	if err != nil {
+		writeNack(responseWriter, appEvent, err)
+		return
+	}
+
+	msg, err := event.GetAckMessage(appEvent)
+	if err != nil {
+		http.Error(responseWriter, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(msg)
+}
+
+func writeNack(responseWriter http.ResponseWriter, appEvent event.Event, eventErr error) {
+	msg, err := event.GetNackMessage(appEvent, eventErr)
+	if err != nil {
+		http.Error(responseWriter, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(getEventErrorStatus(eventErr))
+	responseWriter.Write(msg)
+}
+
+func getEventErrorStatus(err error) int {
+	switch event.GetErrorCode(err) {
+	case event.ErrorCodeInvalidEvent, event.ErrorCodeInvalidPayload, event.ErrorCodeUnknownType:
+		return http.StatusBadRequest
+	case event.ErrorCodeUnauthorized:
+		return http.StatusUnauthorized
+	case event.ErrorCodeForbidden:
+		return http.StatusForbidden
+	case event.ErrorCodeNotFound:
+		return http.StatusNotFound
+	case event.ErrorCodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
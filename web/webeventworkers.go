@@ -0,0 +1,150 @@
+package web
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"todopp/event"
+	"todopp/store"
+	"todopp/util"
+)
+
+// events waiting for a worker before the senders are slowed down
+const eventQueueSize = 256
+
+// event to be processed by the worker of its user
+type userEvent struct {
+	login  string
+	userId string
+	event  event.Event
+	client *Client    // connection which sent the event, nil for server side events
+	result chan error // gets the result of the event if set, e.g. for events sent over HTTP
+	queued time.Time
+}
+
+// Processes the events of the users assigned to it one at a time, so the events of a user keep
+// their order while different users proceed in parallel
+type eventWorker struct {
+	queue     chan userEvent
+	processed atomic.Int64
+	maxDepth  atomic.Int64
+	waitNanos atomic.Int64 // total time the processed events spent in the queue
+}
+
+var eventWorkers []*eventWorker
+
+// shared by the workers and the connections resolving the users of their events
+var eventDb *sql.DB
+
+type EventQueueMetrics struct {
+	Worker        int     `json:"worker"`
+	Depth         int     `json:"depth"`
+	MaxDepth      int64   `json:"maxdepth"`
+	Capacity      int     `json:"capacity"`
+	Processed     int64   `json:"processed"`
+	AverageWaitMs float64 `json:"averagewaitms"`
+}
+
+type EventMetrics struct {
+	Depth  int                      `json:"depth"`
+	Queues []EventQueueMetrics      `json:"queues"`
+	Types  []event.EventTypeMetrics `json:"types"`
+}
+
+// Starts the workers, by default one per CPU
+func startEventWorkers() error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	eventDb, err = store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+
+	count := config.EventWorkers
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+
+	eventWorkers = make([]*eventWorker, count)
+	for index := range eventWorkers {
+		worker := &eventWorker{queue: make(chan userEvent, eventQueueSize)}
+		eventWorkers[index] = worker
+		go worker.run()
+	}
+	return nil
+}
+
+// Queues the event on the worker of the user. Blocks while that queue is full
+func dispatchEvent(login string, userId string, appEvent event.Event, client *Client) {
+	queueEvent(userEvent{login: login, userId: userId, event: appEvent, client: client, queued: time.Now()})
+}
+
+// Queues the event like dispatchEvent and waits until it has been processed. Returns why it was rejected
+func dispatchEventAndWait(login string, userId string, appEvent event.Event) error {
+	result := make(chan error, 1)
+	queueEvent(userEvent{login: login, userId: userId, event: appEvent, result: result, queued: time.Now()})
+	return <-result
+}
+
+func queueEvent(userEvent userEvent) {
+	hash := fnv.New32a()
+	hash.Write([]byte(userEvent.userId))
+	worker := eventWorkers[hash.Sum32()%uint32(len(eventWorkers))]
+
+	worker.queue <- userEvent
+
+	depth := int64(len(worker.queue))
+	for {
+		maxDepth := worker.maxDepth.Load()
+		if depth <= maxDepth || worker.maxDepth.CompareAndSwap(maxDepth, depth) {
+			break
+		}
+	}
+}
+
+func (worker *eventWorker) run() {
+	for userEvent := range worker.queue {
+		worker.waitNanos.Add(int64(time.Since(userEvent.queued)))
+		err := handleEvent(eventDb, userEvent.login, userEvent.userId, userEvent.event, userEvent.client)
+		if userEvent.result != nil {
+			userEvent.result <- err
+		}
+		worker.processed.Add(1)
+	}
+}
+
+func getEventMetrics() EventMetrics {
+	metrics := EventMetrics{Queues: []EventQueueMetrics{}, Types: event.GetEventTypeMetrics()}
+	for index, worker := range eventWorkers {
+		queueMetrics := EventQueueMetrics{
+			Worker:    index,
+			Depth:     len(worker.queue),
+			MaxDepth:  worker.maxDepth.Load(),
+			Capacity:  cap(worker.queue),
+			Processed: worker.processed.Load(),
+		}
+		if queueMetrics.Processed > 0 {
+			queueMetrics.AverageWaitMs = float64(worker.waitNanos.Load()) / float64(queueMetrics.Processed) / float64(time.Millisecond)
+		}
+		metrics.Depth += queueMetrics.Depth
+		metrics.Queues = append(metrics.Queues, queueMetrics)
+	}
+	return metrics
+}
+
+// GET returns the depth and throughput of the event queues and the results per event type.
+// Access tokens need the admin scope
+func eventMetricsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(responseWriter, getEventMetrics())
+}
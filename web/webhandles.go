@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"todopp/store"
 	"todopp/util"
@@ -228,3 +229,57 @@ func allDataHandler(responseWriter http.ResponseWriter, request *http.Request) {
 	responseWriter.Write(allUserDataJson)
 
 }
+
+// GET ?since=<revision> returns the projects, groups and tasks changed after the revision, the tombstones of
+// the deleted ones and the revision to pass next. A revision the server doesn't know yet, e.g. after the
+// database was restored from a backup, is answered with 410 and the client fetches the complete data
+func changesHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	since, err := strconv.ParseInt(request.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		http.Error(responseWriter, "Invalid since revision", http.StatusBadRequest)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := store.GetChangesSince(db, userId, since)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve changes", http.StatusInternalServerError)
+		return
+	}
+
+	if since > changes.Revision {
+		http.Error(responseWriter, "The revision is unknown, fetch the complete data", http.StatusGone)
+		return
+	}
+
+	writeJson(responseWriter, changes)
+}
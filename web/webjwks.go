@@ -0,0 +1,24 @@
+package web
+
+import (
+	"net/http"
+	"todopp/auth"
+)
+
+// GET publishes the public keys of the asymmetric signing keys, so other services can verify access tokens
+func jwksHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keySet, err := auth.GetJsonWebKeySet()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read signing keys", http.StatusInternalServerError)
+		return
+	}
+
+	// verifiers refetch the set when they see an unknown kid, so a short cache is enough
+	responseWriter.Header().Set("Cache-Control", "public, max-age=300")
+	writeJson(responseWriter, keySet)
+}
@@ -0,0 +1,220 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"todopp/event"
+	"todopp/mail"
+	"todopp/store"
+	"todopp/util"
+)
+
+const mailTaskMaxLength = 4000
+
+type MailGatewayResponse struct {
+	Address string `json:"address"`
+	Group   string `json:"group"`
+}
+
+type MailGatewayRequest struct {
+	Group      string `json:"group"`
+	Regenerate bool   `json:"regenerate"`
+}
+
+func getMailGatewayDomain(config *util.Config) string {
+	if config.MailGatewayDomain == "" {
+		return config.Domain
+	}
+	return config.MailGatewayDomain
+}
+
+func generateMailGatewayToken() (string, error) {
+	// hex keeps the token intact if a mail server lowercases the local part of the address
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Starts the embedded SMTP listener if mailGatewayAddr is configured
+func startMailGateway() error {
+	config, err := util.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	if config.MailGatewayAddr == "" {
+		return nil
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return err
+	}
+
+	gateway := &mail.Gateway{
+		Domain: getMailGatewayDomain(config),
+		IsValidToken: func(token string) bool {
+			mailGateway, err := store.GetMailGatewayByToken(db, token)
+			if err != nil || mailGateway.TaskGroupId == "" {
+				return false
+			}
+			// the owner may have been disabled since the address was handed out
+			login, err := store.GetUserLoginById(db, mailGateway.UserId)
+			if err != nil || !store.IsUserExistsAndActive(db, login) {
+				return false
+			}
+			// the default group may have been deleted after it was configured
+			groupUserId, err := store.GetTaskGroupUserId(db, mailGateway.TaskGroupId)
+			return err == nil && groupUserId == mailGateway.UserId
+		},
+		OnMessage: func(token string, subject string, body string) error {
+			mailGateway, err := store.GetMailGatewayByToken(db, token)
+			if err != nil {
+				return err
+			}
+
+			login, err := store.GetUserLoginById(db, mailGateway.UserId)
+			if err != nil {
+				return err
+			}
+
+			text := subject
+			if text == "" {
+				text = body
+			} else if body != "" {
+				text += "\n\n" + body
+			}
+			if runes := []rune(text); len(runes) > mailTaskMaxLength {
+				text = string(runes[:mailTaskMaxLength])
+			}
+
+			payload, err := json.Marshal(event.TaskPayload{
+				Id:     util.Uuid(),
+				Text:   text,
+				Group:  mailGateway.TaskGroupId,
+				Status: "1",
+			})
+			if err != nil {
+				return err
+			}
+
+			// processed like a client event, in order with the other events of the user. The sender learns
+			// of a rejection, e.g. of a deleted group, from the reply instead of the task silently missing
+			return dispatchEventAndWait(login, mailGateway.UserId, event.Event{Type: "task-add", Payload: payload})
+		},
+	}
+
+	go func() {
+		defer db.Close()
+		fmt.Println("Mail gateway listening on", config.MailGatewayAddr)
+		err := gateway.ListenAndServe(config.MailGatewayAddr)
+		if err != nil {
+			fmt.Println("Error while running mail gateway: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// GET returns the personal gateway address of the current user, POST sets the default group
+// for incoming tasks and optionally regenerates the address token
+func mailGatewayHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	mailGateway, err := store.GetMailGateway(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve mail gateway", http.StatusInternalServerError)
+		return
+	}
+
+	isChanged := false
+	if mailGateway == nil {
+		mailGateway = &store.MailGateway{UserId: userId}
+		isChanged = true
+	}
+
+	if request.Method == http.MethodPost {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+			return
+		}
+		defer request.Body.Close()
+
+		var mailGatewayRequest MailGatewayRequest
+		err = json.Unmarshal(body, &mailGatewayRequest)
+		if err != nil {
+			http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+			return
+		}
+
+		if mailGatewayRequest.Group != "" {
+			groupUserId, err := store.GetTaskGroupUserId(db, mailGatewayRequest.Group)
+			if err != nil || groupUserId != userId {
+				http.Error(responseWriter, "Group not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		mailGateway.TaskGroupId = mailGatewayRequest.Group
+		if mailGatewayRequest.Regenerate {
+			mailGateway.Token = ""
+		}
+		isChanged = true
+	}
+
+	if mailGateway.Token == "" {
+		mailGateway.Token, err = generateMailGatewayToken()
+		if err != nil {
+			http.Error(responseWriter, "Failed to generate mail gateway token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if isChanged {
+		err = store.UpsertMailGateway(db, *mailGateway)
+		if err != nil {
+			http.Error(responseWriter, "Failed to store mail gateway: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJson(responseWriter, MailGatewayResponse{
+		Address: "task+" + mailGateway.Token + "@" + getMailGatewayDomain(config),
+		Group:   mailGateway.TaskGroupId,
+	})
+}
@@ -0,0 +1,376 @@
+package web
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"todopp/auth"
+	"todopp/store"
+	"todopp/util"
+)
+
+const oidcLoginTtl = 10 * time.Minute
+
+// the login endpoint is public, so the pending logins are limited
+const oidcMaxPendingLogins = 1000
+
+// binds the state to the browser which started the login
+const oidcStateCookieName = "oidcState"
+
+// login flows started by the browser and not yet returned from the identity provider, by state
+type oidcLogin struct {
+	nonce        string
+	codeVerifier string
+	expire       time.Time
+}
+
+var oidcLogins = make(map[string]oidcLogin)
+var oidcLoginsMutex sync.Mutex
+
+var oidcProvider *auth.OidcProvider
+var oidcProviderMutex sync.Mutex
+
+type OidcConfigResponse struct {
+	IsEnabled  bool   `json:"isenabled"`
+	ButtonText string `json:"buttontext"`
+}
+
+// Returns the configured identity provider or nil if single sign-on is not configured
+func getOidcProvider(config *util.Config) *auth.OidcProvider {
+	if config.OidcIssuer == "" || config.OidcClientId == "" {
+		return nil
+	}
+
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+
+	if oidcProvider == nil {
+		redirectUrl := config.OidcRedirectUrl
+		if redirectUrl == "" {
+			redirectUrl = "https://" + config.Domain + "/api/oidc/callback"
+		}
+
+		scopes := config.OidcScopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+
+		oidcProvider = &auth.OidcProvider{
+			Issuer:       config.OidcIssuer,
+			ClientId:     config.OidcClientId,
+			ClientSecret: config.OidcClientSecret,
+			RedirectUrl:  redirectUrl,
+			Scopes:       scopes,
+		}
+	}
+	return oidcProvider
+}
+
+// GET tells the login page whether to show the single sign-on button
+func oidcConfigHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	buttonText := config.OidcButtonText
+	if buttonText == "" {
+		buttonText = "Log in with SSO"
+	}
+
+	writeJson(responseWriter, OidcConfigResponse{IsEnabled: getOidcProvider(config) != nil, ButtonText: buttonText})
+}
+
+// Starts the authorization code flow by redirecting the browser to the identity provider
+func oidcLoginHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	provider := getOidcProvider(config)
+	if provider == nil {
+		http.Error(responseWriter, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	var login oidcLogin
+	state, err := auth.GenerateOidcRandom()
+	if err == nil {
+		login.nonce, err = auth.GenerateOidcRandom()
+	}
+	if err == nil {
+		login.codeVerifier, err = auth.GenerateOidcRandom()
+	}
+	if err != nil {
+		http.Error(responseWriter, "Failed to start single sign-on", http.StatusInternalServerError)
+		return
+	}
+	login.expire = time.Now().Add(oidcLoginTtl)
+
+	authorizationUrl, err := provider.GetAuthorizationUrl(state, login.nonce, login.codeVerifier)
+	if err != nil {
+		fmt.Println("Error starting single sign-on: ", err)
+		redirectToLoginWithError(responseWriter, request, "The identity provider is not available")
+		return
+	}
+
+	oidcLoginsMutex.Lock()
+	for loginState, pendingLogin := range oidcLogins {
+		if time.Now().After(pendingLogin.expire) {
+			delete(oidcLogins, loginState)
+		}
+	}
+	isFull := len(oidcLogins) >= oidcMaxPendingLogins
+	if !isFull {
+		oidcLogins[state] = login
+	}
+	oidcLoginsMutex.Unlock()
+
+	if isFull {
+		http.Error(responseWriter, "Too many single sign-on logins in progress, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// lax, so the cookie is sent with the redirect back from the identity provider
+	http.SetCookie(responseWriter, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/oidc/",
+		Expires:  login.expire,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(responseWriter, request, authorizationUrl, http.StatusFound)
+}
+
+// Completes the flow: exchanges the code, maps the identity onto a user and hands the access token to the browser
+func oidcCallbackHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	state := query.Get("state")
+
+	http.SetCookie(responseWriter, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/api/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// a callback the browser didn't start itself is a login forced on it by another site
+	stateCookie, err := request.Cookie(oidcStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		redirectToLoginWithError(responseWriter, request, "The login attempt was not started in this browser, please try again")
+		return
+	}
+
+	oidcLoginsMutex.Lock()
+	login, ok := oidcLogins[state]
+	delete(oidcLogins, state)
+	oidcLoginsMutex.Unlock()
+
+	if !ok || time.Now().After(login.expire) {
+		redirectToLoginWithError(responseWriter, request, "The login attempt is expired, please try again")
+		return
+	}
+
+	if query.Get("error") != "" {
+		redirectToLoginWithError(responseWriter, request, "The identity provider refused the login: "+query.Get("error"))
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	provider := getOidcProvider(config)
+	if provider == nil {
+		http.Error(responseWriter, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	identity, err := provider.Exchange(query.Get("code"), login.codeVerifier, login.nonce)
+	if err != nil {
+		fmt.Println("Error completing single sign-on: ", err)
+		redirectToLoginWithError(responseWriter, request, "The identity provider login could not be verified")
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userLogin, err := getOidcUserLogin(db, config, *identity)
+	if err != nil {
+		redirectToLoginWithError(responseWriter, request, err.Error())
+		return
+	}
+
+	// the identity provider is responsible for the second factor of single sign-on logins
+	_, err = createSession(responseWriter, request, userLogin, "")
+	if err != nil {
+		http.Error(responseWriter, "Failed to create session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// only the refresh token cookie is set here, the login page renews the access token with it and
+	// stores it like after a password login
+	http.Redirect(responseWriter, request, "/login.html?sso=1", http.StatusFound)
+}
+
+func redirectToLoginWithError(responseWriter http.ResponseWriter, request *http.Request, message string) {
+	http.Redirect(responseWriter, request, "/login.html?sso_error="+url.QueryEscape(message), http.StatusFound)
+}
+
+// Returns the login of the user linked to the identity. An unknown identity is linked to the confirmed user
+// with the same verified email, or a new user is provisioned, each if enabled
+func getOidcUserLogin(db *sql.DB, config *util.Config, identity auth.OidcIdentity) (string, error) {
+	userId, err := store.GetUserIdByIdentity(db, identity.Issuer, identity.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	if userId == "" && config.OidcLinkByEmail && identity.Email != "" && identity.EmailVerified {
+		user, err := store.GetUserByEmail(db, identity.Email)
+		if err != nil && err != store.ErrUserNotFound {
+			return "", err
+		}
+		if user != nil {
+			// the identity provider login must not skip the second factor of the account
+			isTotpEnabled, err := store.IsTotpEnabled(db, user.UserId)
+			if err != nil {
+				return "", err
+			}
+			if isTotpEnabled {
+				return "", errors.New("the account with this email uses two-factor authentication and can't be linked to single sign-on, please log in with the password")
+			}
+
+			// anyone may register an email without confirming it, linking such an account would hand the
+			// identity to whoever knows its password
+			if user.IsActive == 0 {
+				return "", errors.New("an unconfirmed account is registered with this email, please confirm the email or contact the administrator")
+			}
+
+			userId = user.UserId
+			err = store.InsertUserIdentity(db, identity.Issuer, identity.Subject, userId, identity.Email, time.Now().UTC().UnixMilli())
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if userId == "" {
+		if !config.OidcAutoProvision {
+			return "", errors.New("there is no account for this identity, please contact the administrator")
+		}
+
+		userId, err = provisionOidcUser(db, identity)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	login, err := store.GetUserLoginById(db, userId)
+	if err != nil {
+		return "", err
+	}
+	if !store.IsUserExistsAndActive(db, login) {
+		return "", errors.New("the account is not active")
+	}
+	return login, nil
+}
+
+var loginInvalidCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func provisionOidcUser(db *sql.DB, identity auth.OidcIdentity) (string, error) {
+	if identity.Email != "" && !identity.EmailVerified {
+		identity.Email = ""
+	}
+
+	// the login follows the rules of the registration form
+	baseLogin := identity.PreferredUsername
+	if baseLogin == "" {
+		baseLogin, _, _ = strings.Cut(identity.Email, "@")
+	}
+	baseLogin = loginInvalidCharsRegex.ReplaceAllString(baseLogin, "_")
+	if len(baseLogin) < 2 || !isAsciiLetter(baseLogin[0]) {
+		baseLogin = "user_" + baseLogin
+	}
+
+	login := baseLogin
+	for index := 2; ; index++ {
+		exists, err := store.IsLoginExists(db, login)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			break
+		}
+		login = baseLogin + strconv.Itoa(index)
+	}
+
+	// the user can only log in with single sign-on until a password is set with the password reset
+	randomPassword, err := auth.GenerateOidcRandom()
+	if err != nil {
+		return "", err
+	}
+
+	var user store.User
+	user.UserId = util.Uuid()
+	user.Name = identity.Name
+	if user.Name == "" {
+		user.Name = login
+	}
+	user.Login = login
+	user.Email = identity.Email
+	user.PasswordHash, err = util.HashPassword(randomPassword)
+	if err != nil {
+		return "", err
+	}
+	user.IsActive = 1
+
+	err = store.InsertUser(db, user)
+	if err != nil {
+		return "", err
+	}
+
+	err = store.InsertUserIdentity(db, identity.Issuer, identity.Subject, user.UserId, identity.Email, time.Now().UTC().UnixMilli())
+	return user.UserId, err
+}
+
+func isAsciiLetter(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
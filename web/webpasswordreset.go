@@ -0,0 +1,226 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"todopp/mail"
+	"todopp/store"
+	"todopp/util"
+)
+
+type PasswordResetRequest struct {
+	Login   string `json:"login"` // login or email
+	Captcha string `json:"captcha"`
+}
+
+type PasswordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Issues a short-lived reset secret and emails it to the owner of the login or email.
+// The response is the same whether the account exists or not.
+func passwordResetRequestHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	defer request.Body.Close()
+
+	var resetRequest PasswordResetRequest
+	err = json.Unmarshal(body, &resetRequest)
+	if err != nil {
+		http.Error(responseWriter, "Failed to parse body", http.StatusInternalServerError)
+		return
+	}
+
+	if !verifyCaptcha(resetRequest.Captcha, getRequestIp(request)) {
+		http.Error(responseWriter, "Failed Captcha validation", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Error reading config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Error opening db: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	user, err := store.GetActiveUserByLoginOrEmail(db, resetRequest.Login)
+	if err != nil {
+		if err != store.ErrUserNotFound {
+			fmt.Println("Error looking up user for password reset: ", err)
+		}
+		user = nil
+	}
+
+	// the login and the email of an account count as one, unknown names are limited the same way
+	login := resetRequest.Login
+	if user != nil {
+		login = user.Login
+	}
+	ip := getRequestIp(request)
+	if !checkAttemptAllowed(responseWriter, db, attemptResetRequest, ip, login) {
+		return
+	}
+	// every request counts, so a flood of reset mails is slowed down like failed logins
+	err = recordFailedAttempt(db, attemptResetRequest, ip, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to record the request", http.StatusInternalServerError)
+		return
+	}
+
+	if user != nil && user.Email != "" {
+		err = sendPasswordReset(db, *user)
+		if err != nil {
+			fmt.Println("Error sending password reset: ", err)
+		}
+	}
+
+	responseWriter.Header().Set("Content-Type", "text/plain")
+	responseWriter.Write([]byte("If the account exists, a password reset link has been sent to its email address"))
+}
+
+func sendPasswordReset(db *sql.DB, user store.User) error {
+	// only the latest reset link stays valid
+	err := store.DeleteUserSecrets(db, user.UserId, "reset")
+	if err != nil {
+		return err
+	}
+
+	token, err := generateConfirmationToken()
+	if err != nil {
+		return err
+	}
+
+	var userSecret store.UserSecret
+	userSecret.UserId = user.UserId
+	userSecret.Secret = token
+	userSecret.Target = "reset"
+	userSecret.Expire = time.Now().Add(time.Hour).UnixMilli()
+
+	err = store.InsertUserSecret(db, userSecret)
+	if err != nil {
+		return err
+	}
+
+	// the mail must not delay the response, which would tell whether the account exists
+	go func() {
+		err := mail.SendPasswordResetEmail(user.Email, token)
+		if err != nil {
+			fmt.Println("Error sending password reset email: ", err)
+		}
+	}()
+	return nil
+}
+
+// Validates the reset secret, stores the new password and revokes all existing sessions
+func passwordResetConfirmHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	defer request.Body.Close()
+
+	var resetConfirm PasswordResetConfirm
+	err = json.Unmarshal(body, &resetConfirm)
+	if err != nil {
+		http.Error(responseWriter, "Failed to parse body", http.StatusInternalServerError)
+		return
+	}
+
+	err = validatePassword(resetConfirm.Password)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Error reading config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Error opening db: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.CheckSecret(db, resetConfirm.Token, "reset")
+	if err == store.ErrSecretInvalid || err == store.ErrSecretExpired {
+		http.Error(responseWriter, "The password reset link is invalid or expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	passwordHash, err := util.HashPassword(resetConfirm.Password)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = store.UpdateUserPassword(db, userId, passwordHash)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = store.DeleteUserSecrets(db, userId, "reset")
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = store.RevokeUserSessions(db, userId, "")
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// access tokens may have been created by whoever had access to the account
+	_, err = store.RevokeUserAccessTokens(db, userId)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	login, err := store.GetUserLoginById(db, userId)
+	if err == nil {
+		disconnectClients(login)
+		// the owner has proven access to the email, a lockout from failed logins is lifted
+		err = clearFailedAttempts(db, attemptLogin, login)
+		if err != nil {
+			fmt.Println("Error clearing failed logins: ", err)
+		}
+	}
+
+	responseWriter.Header().Set("Content-Type", "text/plain")
+	responseWriter.Write([]byte("Your password has been changed. Please log in with the new password"))
+}
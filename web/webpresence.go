@@ -0,0 +1,179 @@
+package web
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"todopp/event"
+	"todopp/store"
+)
+
+// a client stops counting as a viewer of its project when its heartbeats stop for this long
+const presenceTimeout = 90 * time.Second
+
+// Presence messages. They are not stored and only live as long as the connection
+const (
+	presencePrefix = "presence-"
+	presenceView   = "presence-view"  // client: viewing the project, repeated as heartbeat; an empty project leaves
+	presenceEdit   = "presence-edit"  // client and server: editing the task, an empty task releases it
+	presenceJoin   = "presence-join"  // server: another client started viewing the project
+	presenceLeave  = "presence-leave" // server: another client left the project, its edit is released
+	presenceState  = "presence-state" // server: the other viewers of the project just joined
+)
+
+type PresencePayload struct {
+	Project  string `json:"project"`
+	Task     string `json:"task,omitempty"`
+	Login    string `json:"login,omitempty"`
+	ClientId string `json:"clientid,omitempty"`
+}
+
+type PresenceStatePayload struct {
+	Project string            `json:"project"`
+	Viewers []PresencePayload `json:"viewers"`
+}
+
+type PresenceMessage struct {
+	Type    string `json:"type"`
+	Payload any    `json:"payload"`
+}
+
+// change of the presence of a client, applied by the hub
+type presenceUpdate struct {
+	client  *Client
+	project string
+	task    string
+	isEdit  bool
+}
+
+func isPresenceMessage(appEvent event.Event) bool {
+	return strings.HasPrefix(appEvent.Type, presencePrefix)
+}
+
+// Checks the presence message of a client and passes it to the hub. Presence messages carry no token,
+// the connection has been authenticated when it was opened
+func handlePresenceMessage(client *Client, appEvent event.Event) {
+	var payload PresencePayload
+	err := json.Unmarshal(appEvent.Payload, &payload)
+	if err != nil {
+		sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeInvalidPayload, "invalid payload: "+err.Error()))
+		return
+	}
+
+	userId, err := store.GetUserIdByLogin(eventDb, client.login)
+	if err != nil {
+		sendRejection(client, appEvent, err)
+		return
+	}
+
+	switch appEvent.Type {
+	case presenceView:
+		if payload.Project != "" && !canViewProject(userId, payload.Project) {
+			sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeNotFound, "project '"+payload.Project+"' is not registered"))
+			return
+		}
+		hub.presence <- presenceUpdate{client: client, project: payload.Project}
+	case presenceEdit:
+		if payload.Task != "" && !canViewTask(userId, payload.Task) {
+			sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeNotFound, "task '"+payload.Task+"' is not registered"))
+			return
+		}
+		hub.presence <- presenceUpdate{client: client, task: payload.Task, isEdit: true}
+	default:
+		sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeUnknownType, "unknown presence type '"+appEvent.Type+"'"))
+	}
+}
+
+// Projects are only visible to their owner for now
+func canViewProject(userId string, projectId string) bool {
+	ownerId, err := store.GetProjectUserId(eventDb, projectId)
+	return err == nil && ownerId == userId
+}
+
+func canViewTask(userId string, taskId string) bool {
+	ownerId, err := store.GetTaskUserId(eventDb, taskId)
+	return err == nil && ownerId == userId
+}
+
+func getPresenceMessage(messageType string, payload any) []byte {
+	message, _ := json.Marshal(PresenceMessage{Type: messageType, Payload: payload})
+	return message
+}
+
+func (client *Client) getPresence() PresencePayload {
+	return PresencePayload{Project: client.presenceProject, Task: client.presenceTask, Login: client.login, ClientId: client.id}
+}
+
+// Applies the update on the hub goroutine and tells the other viewers of the project
+func (hub *Hub) updatePresence(update presenceUpdate) {
+	client := update.client
+	if !hub.clients[client] {
+		return // disconnected meanwhile
+	}
+	client.presenceSeen = time.Now()
+
+	if update.isEdit {
+		if client.presenceProject == "" || client.presenceTask == update.task {
+			return
+		}
+		client.presenceTask = update.task
+		hub.broadcastPresence(client, getPresenceMessage(presenceEdit, client.getPresence()))
+		return
+	}
+
+	// the same project again is only a heartbeat
+	if client.presenceProject == update.project {
+		return
+	}
+	hub.leaveProject(client)
+	if update.project == "" {
+		return
+	}
+
+	client.presenceProject = update.project
+	hub.broadcastPresence(client, getPresenceMessage(presenceJoin, client.getPresence()))
+
+	state := PresenceStatePayload{Project: update.project, Viewers: []PresencePayload{}}
+	for other := range hub.clients {
+		if other != client && other.presenceProject == update.project {
+			state.Viewers = append(state.Viewers, other.getPresence())
+		}
+	}
+	hub.deliver(client, getPresenceMessage(presenceState, state))
+}
+
+// Removes the client from the viewers of its project, releasing its edit
+func (hub *Hub) leaveProject(client *Client) {
+	if client.presenceProject == "" {
+		return
+	}
+	presence := client.getPresence()
+	client.presenceProject = ""
+	client.presenceTask = ""
+
+	message := getPresenceMessage(presenceLeave, presence)
+	for other := range hub.clients {
+		if other.presenceProject == presence.Project {
+			hub.deliver(other, message)
+		}
+	}
+}
+
+// Sends the message to the other viewers of the client's project
+func (hub *Hub) broadcastPresence(client *Client, message []byte) {
+	for other := range hub.clients {
+		if other != client && other.presenceProject == client.presenceProject {
+			hub.deliver(other, message)
+		}
+	}
+}
+
+// Lets the viewers of clients which stopped their heartbeats leave
+func (hub *Hub) expirePresence() {
+	expired := time.Now().Add(-presenceTimeout)
+	for client := range hub.clients {
+		if client.presenceProject != "" && client.presenceSeen.Before(expired) {
+			hub.leaveProject(client)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	"todopp/auth"
+	"todopp/store"
+	"todopp/util"
+)
+
+const refreshCookieName = "refreshToken"
+const deviceNameMaxLength = 200
+
+// a refresh token replaced within this period is still accepted, so tabs renewing at the same time are not logged out
+const refreshReuseGracePeriod = time.Minute
+
+type SessionResponse struct {
+	store.Session
+	IsCurrent bool `json:"iscurrent"`
+}
+
+func getRequestIp(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func getDeviceName(request *http.Request, device string) string {
+	if device == "" {
+		device = request.UserAgent()
+	}
+	if runes := []rune(device); len(runes) > deviceNameMaxLength {
+		device = string(runes[:deviceNameMaxLength])
+	}
+	return device
+}
+
+func setRefreshCookie(responseWriter http.ResponseWriter, refreshToken string, expire time.Time) {
+	http.SetCookie(responseWriter, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refreshToken,
+		Path:     "/api/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearRefreshCookie(responseWriter http.ResponseWriter) {
+	http.SetCookie(responseWriter, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    "",
+		Path:     "/api/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Stores a new session for the login and sets its refresh token cookie. Returns the session id
+func createSession(responseWriter http.ResponseWriter, request *http.Request, login string, device string) (string, error) {
+	config, err := util.GetConfig()
+	if err != nil {
+		return "", err
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		return "", err
+	}
+
+	refreshToken, refreshHash, err := auth.CreateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	expire := now.Add(auth.SessionTtl)
+
+	err = store.DeleteExpiredSessions(db, now.UnixMilli())
+	if err != nil {
+		return "", err
+	}
+
+	var session store.Session
+	session.SessionId = util.Uuid()
+	session.UserId = userId
+	session.RefreshHash = refreshHash
+	session.DeviceName = getDeviceName(request, device)
+	session.Ip = getRequestIp(request)
+	session.Created = now.UnixMilli()
+	session.LastSeen = now.UnixMilli()
+	session.Rotated = now.UnixMilli()
+	session.Expire = expire.UnixMilli()
+
+	err = store.InsertSession(db, session)
+	if err != nil {
+		return "", err
+	}
+
+	setRefreshCookie(responseWriter, refreshToken, expire)
+	return session.SessionId, nil
+}
+
+// Exchanges the refresh token cookie for a new access token and rotates the refresh token
+func tokenRenewHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := request.Cookie(refreshCookieName)
+	if err != nil || cookie.Value == "" {
+		http.Error(responseWriter, "The request is missing the refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	refreshHash := auth.HashToken(cookie.Value)
+	now := time.Now().UTC()
+
+	session, err := store.GetSessionByRefreshHash(db, refreshHash)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve session", http.StatusInternalServerError)
+		return
+	}
+	if session == nil || session.IsRevoked != 0 || session.Expire <= now.UnixMilli() {
+		clearRefreshCookie(responseWriter)
+		http.Error(responseWriter, "The session is expired or revoked", http.StatusUnauthorized)
+		return
+	}
+
+	login, err := store.GetUserLoginById(db, session.UserId)
+	if err != nil || !store.IsUserExistsAndActive(db, login) {
+		clearRefreshCookie(responseWriter)
+		http.Error(responseWriter, "The user is not active", http.StatusUnauthorized)
+		return
+	}
+
+	if session.RefreshHash != refreshHash {
+		// an already rotated token is presented again, which outside of the grace period means it was stolen
+		if now.UnixMilli()-session.Rotated > refreshReuseGracePeriod.Milliseconds() {
+			err = store.RevokeSession(db, session.UserId, session.SessionId)
+			if err != nil {
+				fmt.Println("Error revoking session: ", err)
+			}
+			disconnectSession(session.SessionId)
+			clearRefreshCookie(responseWriter)
+			http.Error(responseWriter, "The refresh token was already used", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		refreshToken, newRefreshHash, err := auth.CreateRefreshToken()
+		if err != nil {
+			http.Error(responseWriter, "Failed to create refresh token", http.StatusInternalServerError)
+			return
+		}
+
+		expire := now.Add(auth.SessionTtl)
+		err = store.RotateSession(db, session.SessionId, newRefreshHash, getRequestIp(request), now.UnixMilli(), expire.UnixMilli())
+		if err != nil {
+			http.Error(responseWriter, "Failed to update session", http.StatusInternalServerError)
+			return
+		}
+		setRefreshCookie(responseWriter, refreshToken, expire)
+	}
+
+	jwtKey, err := auth.GetJwtKey()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read jwt key", http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := auth.CreateJWTToken(jwtKey, login, session.SessionId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to create jwt token", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "text/plain")
+	responseWriter.Write([]byte(tokenString))
+}
+
+// Revokes the session of the refresh token cookie
+func logoutHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clearRefreshCookie(responseWriter)
+
+	cookie, err := request.Cookie(refreshCookieName)
+	if err != nil || cookie.Value == "" {
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	session, err := store.GetSessionByRefreshHash(db, auth.HashToken(cookie.Value))
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve session", http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		return
+	}
+
+	err = store.RevokeSession(db, session.UserId, session.SessionId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	disconnectSession(session.SessionId)
+}
+
+// GET lists the active sessions of the current user. DELETE revokes the session given by the id parameter,
+// or all sessions except the current one if no id is given
+func sessionHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodDelete {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal, err := getCurrentPrincipal(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+	login := principal.Login
+	currentSessionId := principal.SessionId
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	if request.Method == http.MethodDelete {
+		err = revokeSessions(db, userId, currentSessionId, request.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(responseWriter, "Failed to revoke session: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		responseWriter.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sessions, err := store.GetUserSessions(db, userId, time.Now().UTC().UnixMilli())
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve sessions", http.StatusInternalServerError)
+		return
+	}
+
+	response := []SessionResponse{}
+	for _, session := range sessions {
+		response = append(response, SessionResponse{Session: session, IsCurrent: session.SessionId == currentSessionId})
+	}
+	writeJson(responseWriter, response)
+}
+
+func revokeSessions(db *sql.DB, userId string, currentSessionId string, sessionId string) error {
+	if sessionId != "" {
+		err := store.RevokeSession(db, userId, sessionId)
+		if err != nil {
+			return err
+		}
+		disconnectSession(sessionId)
+		return nil
+	}
+
+	sessionIds, err := store.RevokeUserSessions(db, userId, currentSessionId)
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		disconnectSession(sessionId)
+	}
+	return nil
+}
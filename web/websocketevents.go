@@ -1,145 +1,350 @@
 package web
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 	"todopp/auth"
 	"todopp/event"
 	"todopp/store"
 	"todopp/util"
+	"todopp/webhook"
 
 	"github.com/gorilla/websocket"
 )
 
-// determines whether a WebSocket connection from a specific origin (domain) should be allowed
+const webSocketProtocol = "todopp"
+
+// a token may be passed as a "bearer.<token>" subprotocol instead of the first message
+const webSocketTokenPrefix = "bearer."
+
+const webSocketAuthTimeout = 10 * time.Second
+
+// close codes of the private range mirroring the HTTP status codes
+const (
+	closeUnauthorized = 4401
+	closeForbidden    = 4403
+)
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  checkWebSocketOrigin,
+	Subprotocols: []string{webSocketProtocol},
+}
+
+// The first message of a connection not authenticated by the subprotocol
+type WebSocketAuth struct {
+	Type  string `json:"type"` // "auth"
+	Token string `json:"token"`
+}
+
+// connections to be closed, e.g. after a password change or a session revocation
+type disconnect struct {
+	login     string // all connections of the login
+	sessionId string // or only the connections of the session
+	tokenId   string // or only the connections of the personal access token
+}
+
+func (disconnect disconnect) matches(login string, sessionId string, tokenId string) bool {
+	return (disconnect.login != "" && login == disconnect.login) ||
+		(disconnect.sessionId != "" && sessionId == disconnect.sessionId) ||
+		(disconnect.tokenId != "" && tokenId == disconnect.tokenId)
+}
+
+// Determines whether a WebSocket connection from the origin should be allowed. Browsers always
+// send an origin; other clients don't and still have to authenticate
+func checkWebSocketOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		return false
+	}
+
+	if len(config.WebSocketOrigins) > 0 {
+		return slices.Contains(config.WebSocketOrigins, origin)
+	}
+
+	// by default only the pages of the server itself may connect
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originUrl.Host, request.Host) || (config.Domain != "" && strings.EqualFold(originUrl.Host, config.Domain))
 }
 
-type Client struct {
-	conn  *websocket.Conn
-	send  chan []byte
-	login string
+func getWebSocketProtocolToken(request *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(request) {
+		if strings.HasPrefix(protocol, webSocketTokenPrefix) {
+			return strings.TrimPrefix(protocol, webSocketTokenPrefix)
+		}
+	}
+	return ""
 }
 
-var clients = make(map[*Client]bool)
+// Waits for the auth message which has to be sent right after the connection is opened
+func readWebSocketAuth(webSocket *websocket.Conn) (string, error) {
+	webSocket.SetReadDeadline(time.Now().Add(webSocketAuthTimeout))
+	_, msg, err := webSocket.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	webSocket.SetReadDeadline(time.Time{})
+
+	var authMessage WebSocketAuth
+	err = json.Unmarshal(msg, &authMessage)
+	if err != nil || authMessage.Type != "auth" || authMessage.Token == "" {
+		return "", errors.New("the first message has to be an auth message")
+	}
+	return authMessage.Token, nil
+}
 
-var broadcast = make(chan []byte)
+// Sends a close frame with the code and reason. Connection errors are ignored, the connection is closed anyway
+func closeWebSocket(webSocket *websocket.Conn, code int, reason string) {
+	// control frames are limited to 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	webSocket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	webSocket.Close()
+}
 
 func handleEventConnections(responseWriter http.ResponseWriter, request *http.Request) {
 	webSocket, err := upgrader.Upgrade(responseWriter, request, nil)
 	if err != nil {
-		http.Error(responseWriter, "Failed to upgrade HTTP connection to WebSocket protocol", http.StatusInternalServerError)
+		// the upgrader has already replied with an HTTP error
+		fmt.Println("Failed to upgrade HTTP connection to WebSocket protocol: ", err)
 		return
 	}
-	defer webSocket.Close()
 
-	jwt := request.URL.Query().Get("token")
+	token := getWebSocketProtocolToken(request)
+	if token == "" {
+		token, err = readWebSocketAuth(webSocket)
+		if err != nil {
+			closeWebSocket(webSocket, closeUnauthorized, "Authentication required")
+			return
+		}
+	}
+
+	principal, err := auth.Authenticate(token)
+	if err != nil {
+		closeWebSocket(webSocket, closeUnauthorized, err.Error())
+		return
+	}
 
-	if jwt == "" {
-		http.Error(responseWriter, "Failed to read JWT", http.StatusInternalServerError)
+	if !principal.HasScope(auth.ScopeRead) {
+		closeWebSocket(webSocket, closeForbidden, "The access token scopes do not allow this request")
 		return
 	}
 
-	login, err := auth.VerifyJwtAndGetLogin(jwt)
+	client := &Client{
+		id:        util.Uuid(),
+		token:     token,
+		expire:    principal.Expire,
+		conn:      webSocket,
+		send:      make(chan []byte, clientSendBuffer),
+		login:     principal.Login,
+		sessionId: principal.SessionId,
+		tokenId:   principal.TokenId,
+	}
+	hub.register <- client
+
+	go client.writePump()
+	client.readPump()
+}
+
+// Authenticates a message of a client and queues it for processing. Runs on the connection's
+// goroutine, so the token checks of different connections don't wait for each other
+func handleClientMessage(client *Client, msg []byte) {
+	var appEvent event.Event
+
+	err := json.Unmarshal(msg, &appEvent)
 	if err != nil {
-		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeInvalidEvent, "invalid event: "+err.Error()))
 		return
 	}
 
-	client := &Client{conn: webSocket, send: make(chan []byte), login: login}
-	clients[client] = true
+	if appEvent.Type == "auth" {
+		handleTokenRefresh(client, msg)
+		return
+	}
 
-	for {
-		_, msg, err := webSocket.ReadMessage()
-		if err != nil {
-			delete(clients, client)
-			break
-		}
-		broadcast <- msg
+	if isPresenceMessage(appEvent) {
+		handlePresenceMessage(client, appEvent)
+		return
 	}
-}
 
-func handleEventMessages() {
+	// unknown types are rejected before they take a place in the queues
+	if !event.IsEventType(appEvent.Type) {
+		sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeUnknownType, "unknown event type '"+appEvent.Type+"'"))
+		return
+	}
 
-	config, err := util.GetConfig()
+	principal, err := auth.Authenticate(appEvent.Jwt)
 	if err != nil {
 		fmt.Println(err)
-		log.Fatal(err)
+		sendRejection(client, appEvent, event.NewEventError(event.ErrorCodeUnauthorized, err.Error()))
+		return
 	}
 
-	db, err := store.OpenDb(config.DbPath)
+	err = checkEventScopes(principal, appEvent)
 	if err != nil {
 		fmt.Println(err)
-		log.Fatal(err)
+		sendRejection(client, appEvent, err)
+		return
 	}
 
-	for {
-		msg := <-broadcast
+	userId, err := store.GetUserIdByLogin(eventDb, principal.Login)
+	if err != nil {
+		fmt.Println(err)
+		sendRejection(client, appEvent, err)
+		return
+	}
 
-		var appEvent event.Event
+	dispatchEvent(principal.Login, userId, appEvent, client)
+}
 
-		err = json.Unmarshal(msg, &appEvent)
-		if err != nil {
-			continue
+// Checks the event against the scopes of the token. A batch is allowed if all of its events are
+func checkEventScopes(principal *auth.Principal, appEvent event.Event) error {
+	batchEvents, err := event.GetBatchEvents(appEvent)
+	if err != nil {
+		return err
+	}
+	for _, batchEvent := range batchEvents {
+		if !principal.CanSendEvent(batchEvent.Type) {
+			return event.NewEventError(event.ErrorCodeForbidden, "event '"+batchEvent.Type+"' is not allowed by the access token scopes")
 		}
+	}
+	return nil
+}
 
-		responce := msg
+// Tells the client which sent the event that it has been applied. Events without a request id are not answered
+func sendAck(client *Client, appEvent event.Event) {
+	if client == nil || appEvent.RequestId == "" {
+		return
+	}
+	msg, err := event.GetAckMessage(appEvent)
+	if err != nil {
+		return
+	}
+	hub.sendToClient(client, msg)
+}
 
-		login, err := auth.VerifyJwtAndGetLogin(appEvent.Jwt)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
+// Tells the client which sent the event why it has been rejected, so it can roll its change back.
+// Events with a request id get a nack, others an error event
+func sendRejection(client *Client, appEvent event.Event, eventErr error) {
+	if client == nil {
+		return
+	}
+	var msg []byte
+	var err error
+	if appEvent.RequestId != "" {
+		msg, err = event.GetNackMessage(appEvent, eventErr)
+	} else {
+		msg, err = event.GetRejectionMessage(appEvent, eventErr)
+	}
+	if err != nil {
+		return
+	}
+	hub.sendToClient(client, msg)
+}
 
-		userId, err := store.GetUserIdByLogin(db, login)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
+// Processes the event, stores it and delivers the result to all clients of the login.
+// The client which sent the event additionally gets an ack or nack for its request id.
+// Returns why the event was rejected; failures after it has been applied are not reported
+func handleEvent(db *sql.DB, login string, userId string, appEvent event.Event, client *Client) error {
+	var eventStore store.Event
+	eventStore.EventId = util.Uuid()
+	eventStore.Payload = string(appEvent.Payload)
+	eventStore.UserId = userId
+	eventStore.UtcTime = time.Now().UTC().UnixMilli()
 
-		err = json.Unmarshal(msg, &appEvent)
+	// process events
+	processErr := event.ProcessUserEvent(db, userId, appEvent)
+	if processErr != nil {
+		sendRejection(client, appEvent, processErr)
+		responce, err := event.GetRejectionMessage(appEvent, processErr)
 		if err != nil {
-			continue // ignore invalid messages
+			return processErr
 		}
+		eventStore.IsError = 1
+		eventStore.Responce = string(responce)
+		store.InsertEvent(db, eventStore)
+		return processErr
+	}
 
-		var eventStore store.Event
-		eventStore.EventId = util.Uuid()
-		eventStore.Payload = string(appEvent.Payload)
-		eventStore.UserId = userId
-		eventStore.UtcTime = time.Now().UTC().UnixMilli()
+	sendAck(client, appEvent)
 
-		// process events
-		err = event.ProcessEvent(appEvent)
-		if err != nil {
-			responce, err = event.GetErrorMessage(err.Error(), appEvent.Instance)
-			if err != nil {
-				continue
-			}
-			eventStore.IsError = 1
-			eventStore.Responce = string(responce)
-			store.InsertEvent(db, eventStore)
-			continue
-		}
+	//exclude jwt and request ids from responce, the other clients only see the change
+	appEvent, err := event.GetBroadcastEvent(appEvent)
+	if err != nil {
+		return nil
+	}
+	responce, err := json.Marshal(appEvent)
+	if err != nil {
+		return nil
+	}
 
-		//exclude jwt from responce
-		appEvent.Jwt = ""
-		responce, err = json.Marshal(appEvent)
-		if err != nil {
-			continue
-		}
+	eventStore.IsError = 0
+	eventStore.Responce = string(responce)
+	store.InsertEvent(db, eventStore)
 
-		eventStore.IsError = 0
-		eventStore.Responce = string(responce)
-		store.InsertEvent(db, eventStore)
+	hub.sendToLogin(login, responce)
 
-		for client := range clients {
-			if client.login == login {
-				client.conn.WriteMessage(websocket.TextMessage, responce)
-			}
-		}
+	// webhooks are subscribed to the changes, so the events of a batch are delivered one by one
+	batchEvents, err := event.GetBatchEvents(appEvent)
+	if err != nil {
+		return nil
+	}
+	for _, batchEvent := range batchEvents {
+		webhook.Dispatch(userId, batchEvent.Type, batchEvent.Payload)
 	}
+	return nil
+}
+
+// Closes all websocket connections of the login
+func disconnectClients(login string) {
+	hub.disconnect <- disconnect{login: login}
+}
+
+// Closes all websocket connections authenticated with the session
+func disconnectSession(sessionId string) {
+	hub.disconnect <- disconnect{sessionId: sessionId}
+}
+
+// Closes all websocket connections authenticated with the personal access token
+func disconnectAccessToken(tokenId string) {
+	hub.disconnect <- disconnect{tokenId: tokenId}
+}
+
+// Stores a server side event and delivers it to all clients of the login
+func publishEvent(db *sql.DB, login string, userId string, appEvent event.Event) error {
+	msg, err := json.Marshal(appEvent)
+	if err != nil {
+		return err
+	}
+
+	var eventStore store.Event
+	eventStore.EventId = util.Uuid()
+	eventStore.Payload = string(appEvent.Payload)
+	eventStore.UserId = userId
+	eventStore.UtcTime = time.Now().UTC().UnixMilli()
+	eventStore.IsError = 0
+	eventStore.Responce = string(msg)
+	err = store.InsertEvent(db, eventStore)
+	if err != nil {
+		return err
+	}
+
+	hub.sendToLogin(login, msg)
+	webhook.Dispatch(userId, appEvent.Type, appEvent.Payload)
+	return nil
 }
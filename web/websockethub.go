@@ -0,0 +1,229 @@
+package web
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// time allowed to write a message to the client
+	writeWait = 10 * time.Second
+	// largest event accepted from a client
+	maxMessageSize = 1 << 20
+	// messages queued for a client before it is evicted as too slow
+	clientSendBuffer = 256
+)
+
+// variables, so the tests can shorten them
+var (
+	// time allowed to read the next pong from the client
+	pongWait = 60 * time.Second
+	// pings are sent before the pong wait runs out
+	pingPeriod = pongWait * 9 / 10
+)
+
+type Client struct {
+	id           string
+	conn         *websocket.Conn
+	send         chan []byte
+	closeMessage []byte // close frame written when the hub closes send
+	login        string
+
+	// authentication, only touched by the hub goroutine once the client is registered
+	token     string
+	expire    int64 // expiry of the token in UnixMilli, 0 if it doesn't expire
+	sessionId string
+	tokenId   string
+
+	// presence, only touched by the hub goroutine
+	presenceProject string
+	presenceTask    string
+	presenceSeen    time.Time
+}
+
+// message to be written to all connections of a login, or only to the client if set
+type delivery struct {
+	login   string
+	client  *Client
+	message []byte
+}
+
+// Owns the connected clients. Only the hub goroutine touches the client set, connections and
+// the rest of the server talk to it through channels
+type Hub struct {
+	clients    map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	deliveries chan delivery
+	disconnect chan disconnect
+	presence   chan presenceUpdate
+	reauth     chan reauthentication
+	revoke     chan revocation
+
+	// streams and long polls waiting for the changes of their login
+	listeners map[*listener]bool
+	listen    chan *listener
+	unlisten  chan *listener
+}
+
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		deliveries: make(chan delivery, 256),
+		disconnect: make(chan disconnect, 16),
+		presence:   make(chan presenceUpdate, 256),
+		reauth:     make(chan reauthentication, 16),
+		revoke:     make(chan revocation, 16),
+		listeners:  make(map[*listener]bool),
+		listen:     make(chan *listener),
+		unlisten:   make(chan *listener),
+	}
+}
+
+func (hub *Hub) run() {
+	presenceTicker := time.NewTicker(presenceTimeout / 3)
+	defer presenceTicker.Stop()
+	expiryTicker := time.NewTicker(webSocketExpiryPeriod)
+	defer expiryTicker.Stop()
+	reverifyTicker := time.NewTicker(webSocketReverifyPeriod)
+	defer reverifyTicker.Stop()
+
+	for {
+		select {
+		case client := <-hub.register:
+			hub.clients[client] = true
+		case client := <-hub.unregister:
+			if hub.clients[client] {
+				delete(hub.clients, client)
+				close(client.send)
+				hub.leaveProject(client)
+			}
+		case delivery := <-hub.deliveries:
+			for client := range hub.clients {
+				if client.login != delivery.login || (delivery.client != nil && client != delivery.client) {
+					continue
+				}
+				hub.deliver(client, delivery.message)
+			}
+			if delivery.client == nil {
+				hub.notifyListeners(delivery.login)
+			}
+		case listener := <-hub.listen:
+			hub.listeners[listener] = true
+		case listener := <-hub.unlisten:
+			delete(hub.listeners, listener)
+		case update := <-hub.presence:
+			hub.updatePresence(update)
+		case <-presenceTicker.C:
+			hub.expirePresence()
+		case reauth := <-hub.reauth:
+			hub.refreshToken(reauth)
+		case revocation := <-hub.revoke:
+			hub.revokeToken(revocation)
+		case <-expiryTicker.C:
+			hub.expireTokens()
+		case <-reverifyTicker.C:
+			hub.reverifyTokens()
+		case disconnect := <-hub.disconnect:
+			for client := range hub.clients {
+				if disconnect.matches(client.login, client.sessionId, client.tokenId) {
+					hub.evict(client, closeUnauthorized, "The access has been revoked")
+				}
+			}
+			hub.revokeListeners(disconnect)
+		}
+	}
+}
+
+// Queues the message for the client without blocking the hub
+func (hub *Hub) deliver(client *Client, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		// the client reconnects and fetches the complete data, so no event is lost for good
+		hub.evict(client, websocket.CloseTryAgainLater, "The connection is too slow")
+	}
+}
+
+// Removes the client; its write pump sends the close frame and closes the connection
+func (hub *Hub) evict(client *Client, code int, reason string) {
+	delete(hub.clients, client)
+	// control frames are limited to 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	client.closeMessage = websocket.FormatCloseMessage(code, reason)
+	close(client.send)
+	hub.leaveProject(client)
+}
+
+// Queues the message for all connections of the login
+func (hub *Hub) sendToLogin(login string, message []byte) {
+	hub.deliveries <- delivery{login: login, message: message}
+}
+
+// Queues the message for the client only. It is dropped if the client has disconnected meanwhile
+func (hub *Hub) sendToClient(client *Client, message []byte) {
+	hub.deliveries <- delivery{login: client.login, client: client, message: message}
+}
+
+// Writes the queued messages and the keepalive pings. It is the only writer of the connection
+func (client *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				closeMessage := client.closeMessage
+				if closeMessage == nil {
+					closeMessage = websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				}
+				client.conn.WriteMessage(websocket.CloseMessage, closeMessage)
+				return
+			}
+			err := client.conn.WriteMessage(websocket.TextMessage, message)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := client.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Passes the messages of the client to the event workers until the connection fails or misses the pongs
+func (client *Client) readPump() {
+	defer func() {
+		hub.unregister <- client
+		client.conn.Close()
+	}()
+
+	client.conn.SetReadLimit(maxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := client.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		handleClientMessage(client, message)
+	}
+}
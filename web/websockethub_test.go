@@ -0,0 +1,216 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	pongWait = 300 * time.Millisecond
+	pingPeriod = pongWait * 9 / 10
+	go hub.run()
+	os.Exit(m.Run())
+}
+
+func newTestClient(login string, buffer int) *Client {
+	return &Client{id: login + "-" + strconv.Itoa(buffer), login: login, send: make(chan []byte, buffer)}
+}
+
+// Waits for the next message queued for the client, failing the test if none arrives
+func receive(t *testing.T, client *Client) string {
+	t.Helper()
+	select {
+	case message, ok := <-client.send:
+		if !ok {
+			t.Fatalf("send channel of %s closed, a message was expected", client.login)
+		}
+		return string(message)
+	case <-time.After(time.Second):
+		t.Fatalf("no message for %s", client.login)
+	}
+	return ""
+}
+
+// Waits until the hub has handled everything sent to it so far. The hub handles its channels one
+// at a time, so a marker delivered to another login arrives once the earlier messages are processed
+func waitForHub(t *testing.T) {
+	t.Helper()
+	marker := newTestClient("marker", 1)
+	hub.register <- marker
+	hub.sendToLogin(marker.login, []byte("marker"))
+	receive(t, marker)
+	hub.unregister <- marker
+}
+
+// Checks that nothing is queued for the client
+func expectNothing(t *testing.T, client *Client) {
+	t.Helper()
+	waitForHub(t)
+
+	select {
+	case message, ok := <-client.send:
+		if ok {
+			t.Fatalf("unexpected message for %s: %s", client.login, message)
+		}
+		t.Fatalf("send channel of %s closed unexpectedly", client.login)
+	default:
+	}
+}
+
+func expectClosed(t *testing.T, client *Client) {
+	t.Helper()
+	select {
+	case message, ok := <-client.send:
+		if ok {
+			t.Fatalf("unexpected message for %s: %s", client.login, message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("send channel of %s was not closed", client.login)
+	}
+}
+
+func TestHubRegisterUnregister(t *testing.T) {
+	client := newTestClient("register", 4)
+	hub.register <- client
+	hub.sendToLogin("register", []byte("hello"))
+	if message := receive(t, client); message != "hello" {
+		t.Fatalf("got %q", message)
+	}
+
+	hub.unregister <- client
+	expectClosed(t, client)
+
+	// unregistering twice must not close the channel again, and nothing is delivered to it anymore
+	hub.unregister <- client
+	hub.sendToLogin("register", []byte("after"))
+	waitForHub(t)
+}
+
+func TestHubDeliversToTargetOnly(t *testing.T) {
+	first := newTestClient("alice", 4)
+	second := newTestClient("alice", 5)
+	other := newTestClient("bob", 4)
+	for _, client := range []*Client{first, second, other} {
+		hub.register <- client
+		defer func(client *Client) { hub.unregister <- client }(client)
+	}
+
+	hub.sendToLogin("alice", []byte("to alice"))
+	if receive(t, first) != "to alice" || receive(t, second) != "to alice" {
+		t.Fatal("the connections of the login did not get the message")
+	}
+	expectNothing(t, other)
+
+	hub.sendToClient(second, []byte("to second"))
+	if message := receive(t, second); message != "to second" {
+		t.Fatalf("got %q", message)
+	}
+	expectNothing(t, first)
+	expectNothing(t, other)
+}
+
+// A client which doesn't read its messages is evicted once its buffer is full. Its write pump
+// writes the queued messages and then the close frame
+func TestHubEvictsSlowClient(t *testing.T) {
+	clients := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(responseWriter, request, nil)
+		if err != nil {
+			return
+		}
+		client := newTestClient("slow", 1)
+		client.conn = conn
+		hub.register <- client
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-clients
+
+	hub.sendToLogin("slow", []byte("first"))
+	hub.sendToLogin("slow", []byte("overflow"))
+	waitForHub(t)
+
+	// the write pump starts only now, so the buffer was full when the second message arrived
+	go client.writePump()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil || string(message) != "first" {
+		t.Fatalf("got %q, %v", message, err)
+	}
+	_, message, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("expected a close frame with code %d, got %q, %v", websocket.CloseTryAgainLater, message, err)
+	}
+}
+
+// The hub closes a connection which doesn't answer the pings
+func TestHubClosesConnectionMissingPong(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(responseWriter, request, nil)
+		if err != nil {
+			return
+		}
+		client := newTestClient("silent", clientSendBuffer)
+		client.conn = conn
+		hub.register <- client
+		go client.writePump()
+		client.readPump()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client answers pings only while reading, so it misses them until the pong wait has run out
+	time.Sleep(pongWait * 2)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestHubConcurrentDeliveries(t *testing.T) {
+	var waitGroup sync.WaitGroup
+	for index := 0; index < 20; index++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			client := newTestClient("concurrent", clientSendBuffer)
+			drained := make(chan struct{})
+			go func() {
+				for range client.send {
+				}
+				close(drained)
+			}()
+
+			hub.register <- client
+			for message := 0; message < 50; message++ {
+				hub.sendToLogin("concurrent", []byte("message"))
+			}
+			hub.unregister <- client
+			<-drained
+		}()
+	}
+	waitGroup.Wait()
+}
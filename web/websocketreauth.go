@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"time"
+	"todopp/auth"
+	"todopp/event"
+)
+
+// how often connections are checked for expired tokens
+const webSocketExpiryPeriod = 5 * time.Second
+
+// how often the tokens of open connections are verified again, e.g. to close the connections of
+// sessions revoked or users deactivated from the command line
+const webSocketReverifyPeriod = time.Minute
+
+// Reply to an in-band token refresh
+type WebSocketAuthResult struct {
+	Type    string              `json:"type"` // "auth-ok"
+	Payload WebSocketAuthExpire `json:"payload"`
+}
+
+type WebSocketAuthExpire struct {
+	Expire int64 `json:"expire"` // UnixMilli, 0 if the token doesn't expire
+}
+
+// token refreshed in-band by a client
+type reauthentication struct {
+	client    *Client
+	token     string
+	principal *auth.Principal
+}
+
+// token of a client which failed the verification
+type revocation struct {
+	client *Client
+	token  string
+	reason string
+}
+
+// Verifies a token sent on an open connection and passes it to the hub. A rejected token doesn't
+// close the connection, it is closed once its current token expires
+func handleTokenRefresh(client *Client, msg []byte) {
+	var authMessage WebSocketAuth
+	err := json.Unmarshal(msg, &authMessage)
+	if err != nil || authMessage.Token == "" {
+		sendRejection(client, event.Event{Type: "auth"}, event.NewEventError(event.ErrorCodeInvalidEvent, "the auth message has no token"))
+		return
+	}
+
+	principal, err := auth.Authenticate(authMessage.Token)
+	if err != nil {
+		sendRejection(client, event.Event{Type: "auth"}, event.NewEventError(event.ErrorCodeUnauthorized, err.Error()))
+		return
+	}
+
+	// the connection stays with its user, another user has to open its own
+	if principal.Login != client.login || !principal.HasScope(auth.ScopeRead) {
+		sendRejection(client, event.Event{Type: "auth"}, event.NewEventError(event.ErrorCodeForbidden, "the token is not valid for this connection"))
+		return
+	}
+
+	hub.reauth <- reauthentication{client: client, token: authMessage.Token, principal: principal}
+}
+
+// Replaces the token of the client on the hub goroutine
+func (hub *Hub) refreshToken(reauth reauthentication) {
+	client := reauth.client
+	if !hub.clients[client] {
+		return
+	}
+	client.token = reauth.token
+	client.expire = reauth.principal.Expire
+	client.sessionId = reauth.principal.SessionId
+	client.tokenId = reauth.principal.TokenId
+
+	message, _ := json.Marshal(WebSocketAuthResult{Type: "auth-ok", Payload: WebSocketAuthExpire{Expire: client.expire}})
+	hub.deliver(client, message)
+}
+
+// Closes the connections whose token has expired
+func (hub *Hub) expireTokens() {
+	now := time.Now().UTC().UnixMilli()
+	for client := range hub.clients {
+		if client.expire != 0 && client.expire <= now {
+			hub.evict(client, closeUnauthorized, "The access token has expired")
+		}
+	}
+}
+
+// Verifies the tokens of all connections again. The verification needs the database, so it runs
+// on its own goroutine and reports the failures back to the hub
+func (hub *Hub) reverifyTokens() {
+	clients := make([]revocation, 0, len(hub.clients))
+	for client := range hub.clients {
+		clients = append(clients, revocation{client: client, token: client.token})
+	}
+
+	go func() {
+		for _, client := range clients {
+			_, err := auth.Authenticate(client.token)
+			if err != nil {
+				client.reason = err.Error()
+				hub.revoke <- client
+			}
+		}
+	}()
+}
+
+// Closes the connection unless the client has refreshed its token meanwhile
+func (hub *Hub) revokeToken(revocation revocation) {
+	if hub.clients[revocation.client] && revocation.client.token == revocation.token {
+		hub.evict(revocation.client, closeUnauthorized, revocation.reason)
+	}
+}
@@ -3,7 +3,10 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"todopp/auth"
+	"todopp/mail"
 	"todopp/util"
+	"todopp/webhook"
 )
 
 // Initializes and starts the HTTP server
@@ -23,22 +26,65 @@ func StartServer(port string, cert string, certKey string) error {
 	mux.HandleFunc("/", getMainHandler) // index.html
 	mux.Handle("/html/", http.StripPrefix("/html/", http.FileServer(http.Dir(util.GetExecDir()+"html"))))
 
+	mux.HandleFunc("/.well-known/jwks.json", jwksHandler)
+
 	mux.HandleFunc("/api/task_list", taskListHandler)
+	mux.HandleFunc("/api/captcha", captchaHandler)
 	mux.HandleFunc("/api/login", loginHandler)
+	mux.HandleFunc("/api/login/2fa", loginTwoFactorHandler)
+	mux.HandleFunc("/api/oidc/config", oidcConfigHandler)
+	mux.HandleFunc("/api/oidc/login", oidcLoginHandler)
+	mux.HandleFunc("/api/oidc/callback", oidcCallbackHandler)
 	mux.HandleFunc("/api/token_renew", tokenRenewHandler)
+	mux.HandleFunc("/api/logout", logoutHandler)
+	mux.HandleFunc("/api/sessions", sessionHandler)
+	mux.HandleFunc("/api/tokens", accessTokenHandler)
+	mux.HandleFunc("/api/totp", totpHandler)
+	mux.HandleFunc("/api/totp/enroll", totpEnrollHandler)
+	mux.HandleFunc("/api/totp/confirm", totpConfirmHandler)
+	mux.HandleFunc("/api/totp/recovery_codes", totpRecoveryCodesHandler)
+	mux.HandleFunc("/api/totp/disable", totpDisableHandler)
 	mux.HandleFunc("/api/projects", projectHandler)
 	mux.HandleFunc("/api/all_user_data", allDataHandler)
+	mux.HandleFunc("/api/changes", changesHandler)
 	mux.HandleFunc("/api/register", registerHandler)
 	mux.HandleFunc("/api/confirm_email", emailConfirmationHandler)
+	mux.HandleFunc("/api/password_reset/request", passwordResetRequestHandler)
+	mux.HandleFunc("/api/password_reset/confirm", passwordResetConfirmHandler)
+	mux.HandleFunc("/api/attachments", attachmentHandler)
+	mux.HandleFunc("/api/digest", digestHandler)
+	mux.HandleFunc("/api/webhooks", webhookHandler)
+	mux.HandleFunc("/api/webhook_deliveries", webhookDeliveriesHandler)
+	mux.HandleFunc("/api/mail_gateway", mailGatewayHandler)
+	mux.HandleFunc("/api/event_metrics", eventMetricsHandler)
+	mux.HandleFunc("/api/events", eventSubmitHandler)
+	mux.HandleFunc("/api/events/stream", eventStreamHandler)
+	mux.HandleFunc("/api/events/poll", eventPollHandler)
 
 	mux.HandleFunc("/ws", handleEventConnections)
 	//mux.HandleFunc("/ws", handleEventConnections)
 
-	go handleEventMessages()
+	go hub.run()
+
+	err := startEventWorkers()
+	if err != nil {
+		return err
+	}
+
+	mail.StartDigestScheduler()
+	auth.StartJwtKeyRotationScheduler()
+	webhook.Start(4)
+
+	startOrphanedAttachmentsScheduler()
+
+	err = startMailGateway()
+	if err != nil {
+		fmt.Println("Error while starting mail gateway: ", err)
+	}
 
 	fmt.Println("Server listening on port", port)
 
-	err := http.ListenAndServeTLS(port, cert, certKey, bearerAuth(mux))
+	err = http.ListenAndServeTLS(port, cert, certKey, bearerAuth(mux))
 	if err != nil {
 		return err
 	}
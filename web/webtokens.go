@@ -0,0 +1,138 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"todopp/auth"
+	"todopp/store"
+	"todopp/util"
+)
+
+const accessTokenNameMaxLength = 100
+
+type AccessTokenRequest struct {
+	Name      string `json:"name"`
+	Scopes    string `json:"scopes"`    // comma separated: read, tasks:write, admin
+	ExpiresIn int    `json:"expiresin"` // days, 0 for a token which never expires
+}
+
+type AccessTokenResponse struct {
+	store.AccessToken
+	Token string `json:"token"` // shown only once when the token is created
+}
+
+// GET lists the personal access tokens of the current user, POST creates a new one,
+// DELETE ?token_id= revokes a token
+func accessTokenHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost && request.Method != http.MethodDelete {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		accessTokens, err := store.GetUserAccessTokens(db, userId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to retrieve access tokens", http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(responseWriter, accessTokens)
+	case http.MethodPost:
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+			return
+		}
+		defer request.Body.Close()
+
+		var tokenRequest AccessTokenRequest
+		err = json.Unmarshal(body, &tokenRequest)
+		if err != nil {
+			http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+			return
+		}
+
+		tokenRequest.Name = strings.TrimSpace(tokenRequest.Name)
+		if tokenRequest.Name == "" || len([]rune(tokenRequest.Name)) > accessTokenNameMaxLength {
+			http.Error(responseWriter, "Token name must be between 1 and 100 characters long", http.StatusBadRequest)
+			return
+		}
+
+		scopes, err := auth.ParseScopes(tokenRequest.Scopes)
+		if err != nil {
+			http.Error(responseWriter, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if tokenRequest.ExpiresIn < 0 {
+			http.Error(responseWriter, "Token expiry must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		token, tokenHash, err := auth.CreateAccessToken()
+		if err != nil {
+			http.Error(responseWriter, "Failed to create access token", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC()
+
+		var accessToken store.AccessToken
+		accessToken.TokenId = util.Uuid()
+		accessToken.UserId = userId
+		accessToken.Name = tokenRequest.Name
+		accessToken.TokenHash = tokenHash
+		accessToken.Scopes = strings.Join(scopes, ",")
+		accessToken.Created = now.UnixMilli()
+		if tokenRequest.ExpiresIn > 0 {
+			accessToken.Expire = now.AddDate(0, 0, tokenRequest.ExpiresIn).UnixMilli()
+		}
+
+		err = store.InsertAccessToken(db, accessToken)
+		if err != nil {
+			http.Error(responseWriter, "Failed to store access token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(responseWriter, AccessTokenResponse{AccessToken: accessToken, Token: token})
+	case http.MethodDelete:
+		tokenId := request.URL.Query().Get("token_id")
+		err = store.RevokeAccessToken(db, userId, tokenId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to revoke access token: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		disconnectAccessToken(tokenId)
+
+		responseWriter.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,499 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"todopp/auth"
+	"todopp/store"
+	"todopp/util"
+)
+
+const twoFactorChallengeTtl = 5 * time.Minute
+const twoFactorMaxAttempts = 5
+
+type twoFactorFailures struct {
+	count  int
+	expire time.Time
+}
+
+// failed code attempts per login challenge, forgotten once the challenge has expired
+var twoFactorAttempts = make(map[string]*twoFactorFailures)
+var twoFactorAttemptsMutex sync.Mutex
+
+// Counts a wrong code for the challenge and returns the wrong codes so far
+func countTwoFactorFailure(challenge string) int {
+	twoFactorAttemptsMutex.Lock()
+	defer twoFactorAttemptsMutex.Unlock()
+
+	// challenges which are never completed would stay in the map otherwise
+	now := time.Now()
+	for key, failures := range twoFactorAttempts {
+		if now.After(failures.expire) {
+			delete(twoFactorAttempts, key)
+		}
+	}
+
+	failures, ok := twoFactorAttempts[challenge]
+	if !ok {
+		// the challenge was created before its first wrong code, so it has expired by then
+		failures = &twoFactorFailures{expire: now.Add(twoFactorChallengeTtl)}
+		twoFactorAttempts[challenge] = failures
+	}
+	failures.count++
+	if failures.count >= twoFactorMaxAttempts {
+		delete(twoFactorAttempts, challenge)
+	}
+	return failures.count
+}
+
+type TwoFactorChallenge struct {
+	TwoFactor bool   `json:"twofactor"`
+	Challenge string `json:"challenge"`
+}
+
+type TwoFactorPrompt struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // TOTP code or recovery code
+	Device    string `json:"device"`
+}
+
+type TotpStatus struct {
+	IsEnabled         bool `json:"isenabled"`
+	RecoveryCodesLeft int  `json:"recoverycodesleft"`
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"` // otpauth:// provisioning URI to be rendered as a QR code
+}
+
+type TotpRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+type TotpRecoveryCodes struct {
+	RecoveryCodes []string `json:"recoverycodes"`
+}
+
+// Creates a short-lived challenge for a login whose password is verified but which still has to submit a second factor
+func createTwoFactorChallenge(db *sql.DB, userId string) (string, error) {
+	challenge, err := generateConfirmationToken()
+	if err != nil {
+		return "", err
+	}
+
+	var userSecret store.UserSecret
+	userSecret.UserId = userId
+	userSecret.Secret = challenge
+	userSecret.Target = "login-2fa"
+	userSecret.Expire = time.Now().Add(twoFactorChallengeTtl).UnixMilli()
+
+	err = store.InsertUserSecret(db, userSecret)
+	return challenge, err
+}
+
+// Checks a TOTP code, or a recovery code which is consumed on success
+func verifySecondFactor(db *sql.DB, userId string, code string) (bool, error) {
+	userTotp, err := store.GetUserTotp(db, userId)
+	if err != nil || userTotp == nil || userTotp.IsEnabled != 1 {
+		return false, err
+	}
+
+	if !auth.IsTotpCode(code) {
+		return store.UseRecoveryCode(db, userId, auth.HashRecoveryCode(code))
+	}
+
+	step, ok := auth.VerifyTotpCode(userTotp.Secret, code, userTotp.LastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return store.SetTotpLastStep(db, userId, step)
+}
+
+// Second login step: exchanges the challenge and a valid code for an access token
+func loginTwoFactorHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	defer request.Body.Close()
+
+	var prompt TwoFactorPrompt
+	err = json.Unmarshal(body, &prompt)
+	if err != nil {
+		http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.CheckSecret(db, prompt.Challenge, "login-2fa")
+	if err == store.ErrSecretInvalid || err == store.ErrSecretExpired {
+		http.Error(responseWriter, "The login attempt is expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	login, err := store.GetUserLoginById(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user login", http.StatusInternalServerError)
+		return
+	}
+
+	// wrong codes count as failed logins of the account
+	ip := getRequestIp(request)
+	if !checkAttemptAllowed(responseWriter, db, attemptLogin, ip, login) {
+		return
+	}
+
+	isValid, err := verifySecondFactor(db, userId, prompt.Code)
+	if err != nil {
+		http.Error(responseWriter, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	if !isValid {
+		err = recordFailedAttempt(db, attemptLogin, ip, login)
+		if err != nil {
+			fmt.Println("Error recording failed login: ", err)
+		}
+
+		if countTwoFactorFailure(prompt.Challenge) >= twoFactorMaxAttempts {
+			store.DeleteSecret(db, prompt.Challenge)
+			http.Error(responseWriter, "Too many invalid codes, please log in again", http.StatusUnauthorized)
+			return
+		}
+		http.Error(responseWriter, "Invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+	twoFactorAttemptsMutex.Lock()
+	delete(twoFactorAttempts, prompt.Challenge)
+	twoFactorAttemptsMutex.Unlock()
+
+	err = store.DeleteSecret(db, prompt.Challenge)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = clearFailedAttempts(db, attemptLogin, login)
+	if err != nil {
+		fmt.Println("Error clearing failed logins: ", err)
+	}
+
+	writeAccessToken(responseWriter, request, login, prompt.Device)
+}
+
+// Creates the session and writes the access token as the response of a successful login
+func writeAccessToken(responseWriter http.ResponseWriter, request *http.Request, login string, device string) {
+	sessionId, err := createSession(responseWriter, request, login, device)
+	if err != nil {
+		http.Error(responseWriter, "Failed to create session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jwtKey, err := auth.GetJwtKey()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read jwt key", http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := auth.CreateJWTToken(jwtKey, login, sessionId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to create jwt token", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "text/plain")
+	responseWriter.Write([]byte(tokenString))
+}
+
+// GET returns whether TOTP is enabled for the current user
+func totpHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db, userId, _, ok := openTotpRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+	defer db.Close()
+
+	var status TotpStatus
+	var err error
+	status.IsEnabled, err = store.IsTotpEnabled(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve TOTP status", http.StatusInternalServerError)
+		return
+	}
+
+	if status.IsEnabled {
+		status.RecoveryCodesLeft, err = store.GetUnusedRecoveryCodeCount(db, userId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to retrieve recovery codes", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJson(responseWriter, status)
+}
+
+// Generates a new, not yet enabled, TOTP secret and returns its provisioning URI
+func totpEnrollHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db, userId, login, ok := openTotpRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+	defer db.Close()
+
+	isEnabled, err := store.IsTotpEnabled(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve TOTP status", http.StatusInternalServerError)
+		return
+	}
+	if isEnabled {
+		http.Error(responseWriter, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.GenerateTotpSecret()
+	if err != nil {
+		http.Error(responseWriter, "Failed to generate TOTP secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = store.UpsertUserTotp(db, store.UserTotp{
+		UserId:    userId,
+		Secret:    secret,
+		IsEnabled: 0,
+		UtcTime:   time.Now().UTC().UnixMilli(),
+	})
+	if err != nil {
+		http.Error(responseWriter, "Failed to store TOTP secret", http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(responseWriter, TotpEnrollment{Secret: secret, Uri: auth.GetTotpProvisioningUri(secret, login)})
+}
+
+// Enables TOTP once the first code from the authenticator app is confirmed and returns the recovery codes
+func totpConfirmHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var totpRequest TotpRequest
+	if !readTotpRequest(responseWriter, request, &totpRequest) {
+		return
+	}
+
+	db, userId, _, ok := openTotpRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+	defer db.Close()
+
+	userTotp, err := store.GetUserTotp(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve TOTP secret", http.StatusInternalServerError)
+		return
+	}
+	if userTotp == nil {
+		http.Error(responseWriter, "Two-factor authentication enrollment is not started", http.StatusBadRequest)
+		return
+	}
+	if userTotp.IsEnabled == 1 {
+		http.Error(responseWriter, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	step, ok := auth.VerifyTotpCode(userTotp.Secret, totpRequest.Code, userTotp.LastStep, time.Now())
+	if !ok {
+		http.Error(responseWriter, "Invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	userTotp.IsEnabled = 1
+	userTotp.LastStep = step
+	err = store.UpsertUserTotp(db, *userTotp)
+	if err != nil {
+		http.Error(responseWriter, "Failed to enable TOTP", http.StatusInternalServerError)
+		return
+	}
+
+	writeRecoveryCodes(responseWriter, db, userId)
+}
+
+// Replaces the recovery codes, requires a valid TOTP code
+func totpRecoveryCodesHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var totpRequest TotpRequest
+	if !readTotpRequest(responseWriter, request, &totpRequest) {
+		return
+	}
+
+	db, userId, _, ok := openTotpRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+	defer db.Close()
+
+	isValid, err := verifySecondFactor(db, userId, totpRequest.Code)
+	if err != nil {
+		http.Error(responseWriter, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !isValid {
+		http.Error(responseWriter, "Invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	writeRecoveryCodes(responseWriter, db, userId)
+}
+
+// Disables TOTP, requires the password and a valid TOTP or recovery code
+func totpDisableHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var totpRequest TotpRequest
+	if !readTotpRequest(responseWriter, request, &totpRequest) {
+		return
+	}
+
+	db, userId, login, ok := openTotpRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+	defer db.Close()
+
+	if !checkCredentials(login, totpRequest.Password, true) {
+		http.Error(responseWriter, "Invalid password", http.StatusBadRequest)
+		return
+	}
+
+	isValid, err := verifySecondFactor(db, userId, totpRequest.Code)
+	if err != nil {
+		http.Error(responseWriter, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !isValid {
+		http.Error(responseWriter, "Invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	err = store.DeleteUserTotp(db, userId)
+	if err != nil {
+		http.Error(responseWriter, "Failed to disable TOTP", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func writeRecoveryCodes(responseWriter http.ResponseWriter, db *sql.DB, userId string) {
+	codes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		http.Error(responseWriter, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	var codeHashes []string
+	for _, code := range codes {
+		codeHashes = append(codeHashes, auth.HashRecoveryCode(code))
+	}
+
+	err = store.ReplaceRecoveryCodes(db, userId, codeHashes)
+	if err != nil {
+		http.Error(responseWriter, "Failed to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(responseWriter, TotpRecoveryCodes{RecoveryCodes: codes})
+}
+
+func readTotpRequest(responseWriter http.ResponseWriter, request *http.Request, totpRequest *TotpRequest) bool {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+		return false
+	}
+	defer request.Body.Close()
+
+	err = json.Unmarshal(body, totpRequest)
+	if err != nil {
+		http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Opens the database and resolves the current user. The caller has to close the database if ok is true
+func openTotpRequest(responseWriter http.ResponseWriter, request *http.Request) (db *sql.DB, userId string, login string, ok bool) {
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+
+	db, err = store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+
+	userId, err = store.GetUserIdByLogin(db, login)
+	if err != nil {
+		db.Close()
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return nil, "", "", false
+	}
+
+	return db, userId, login, true
+}
@@ -0,0 +1,216 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	"todopp/store"
+	"todopp/util"
+)
+
+type WebhookRequest struct {
+	Id         string `json:"id"`
+	Url        string `json:"url"`
+	EventTypes string `json:"eventtypes"`
+	IsActive   *int   `json:"isactive"`
+}
+
+// GET lists the webhooks of the current user, POST registers a new webhook or updates an existing one
+// (id provided), DELETE ?webhook_id= removes a webhook
+func webhookHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost && request.Method != http.MethodDelete {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		webhooks, err := store.GetWebhooks(db, userId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to retrieve webhooks", http.StatusInternalServerError)
+			return
+		}
+
+		// the secret is shown only once when the webhook is registered
+		for index := range webhooks {
+			webhooks[index].Secret = ""
+		}
+
+		writeJson(responseWriter, webhooks)
+	case http.MethodPost:
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(responseWriter, "Failed to read body", http.StatusInternalServerError)
+			return
+		}
+		defer request.Body.Close()
+
+		var webhookRequest WebhookRequest
+		err = json.Unmarshal(body, &webhookRequest)
+		if err != nil {
+			http.Error(responseWriter, "Failed to parse body", http.StatusBadRequest)
+			return
+		}
+
+		webhookUrl, err := url.Parse(webhookRequest.Url)
+		if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+			http.Error(responseWriter, "Webhook url must be an absolute http or https url", http.StatusBadRequest)
+			return
+		}
+
+		if webhookRequest.Id != "" {
+			webhook, err := store.GetWebhook(db, webhookRequest.Id)
+			if err != nil || webhook.UserId != userId {
+				http.Error(responseWriter, "Webhook not found", http.StatusNotFound)
+				return
+			}
+
+			webhook.Url = webhookRequest.Url
+			webhook.EventTypes = webhookRequest.EventTypes
+			if webhookRequest.IsActive != nil {
+				webhook.IsActive = *webhookRequest.IsActive
+			}
+			// re-enabling a webhook starts counting failures from scratch
+			if webhook.IsActive == 1 {
+				webhook.FailureCount = 0
+			}
+
+			err = store.UpdateWebhook(db, *webhook)
+			if err != nil {
+				http.Error(responseWriter, "Failed to update webhook: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			webhook.Secret = ""
+			writeJson(responseWriter, webhook)
+			return
+		}
+
+		secret, err := generateConfirmationToken()
+		if err != nil {
+			http.Error(responseWriter, "Failed to generate webhook secret", http.StatusInternalServerError)
+			return
+		}
+
+		var webhook store.Webhook
+		webhook.WebhookId = util.Uuid()
+		webhook.UserId = userId
+		webhook.Url = webhookRequest.Url
+		webhook.Secret = secret
+		webhook.EventTypes = webhookRequest.EventTypes
+		webhook.IsActive = 1
+		webhook.UtcTime = time.Now().UTC().UnixMilli()
+
+		err = store.InsertWebhook(db, webhook)
+		if err != nil {
+			http.Error(responseWriter, "Failed to store webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJson(responseWriter, webhook)
+	case http.MethodDelete:
+		webhookId := request.URL.Query().Get("webhook_id")
+
+		webhook, err := store.GetWebhook(db, webhookId)
+		if err != nil || webhook.UserId != userId {
+			http.Error(responseWriter, "Webhook not found", http.StatusNotFound)
+			return
+		}
+
+		err = store.DeleteWebhook(db, webhookId)
+		if err != nil {
+			http.Error(responseWriter, "Failed to delete webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		responseWriter.WriteHeader(http.StatusOK)
+	}
+}
+
+// GET ?webhook_id= returns the latest delivery attempts of the webhook
+func webhookDeliveriesHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	login, err := getCurrentLogin(*request)
+	if err != nil {
+		http.Error(responseWriter, "Failed to extract current login", http.StatusInternalServerError)
+		return
+	}
+
+	config, err := util.GetConfig()
+	if err != nil {
+		http.Error(responseWriter, "Failed to read config", http.StatusInternalServerError)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		http.Error(responseWriter, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userId, err := store.GetUserIdByLogin(db, login)
+	if err != nil {
+		http.Error(responseWriter, "Failed to get user id", http.StatusInternalServerError)
+		return
+	}
+
+	webhookId := request.URL.Query().Get("webhook_id")
+
+	webhook, err := store.GetWebhook(db, webhookId)
+	if err != nil || webhook.UserId != userId {
+		http.Error(responseWriter, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := store.GetWebhookDeliveries(db, webhookId, 100)
+	if err != nil {
+		http.Error(responseWriter, "Failed to retrieve webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(responseWriter, deliveries)
+}
+
+func writeJson(responseWriter http.ResponseWriter, value any) {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		http.Error(responseWriter, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(valueJson)
+}
@@ -0,0 +1,294 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"todopp/store"
+	"todopp/util"
+)
+
+const maxAttempts = 5
+const defaultMaxFailures = 10
+const firstRetryDelay = 2 * time.Second
+
+// deliveries kept per webhook for the delivery log, and at most for maxDeliveryAge
+const maxStoredDeliveries = 200
+const maxDeliveryAge = 30 * 24 * time.Hour
+
+// Event processed by the server which has to be delivered to the matching webhooks of the user
+type dispatchedEvent struct {
+	userId    string
+	eventType string
+	payload   []byte
+}
+
+// Single delivery attempt of an event to a webhook. The webhook is read again before every attempt,
+// so a retry follows the changes made to it meanwhile
+type delivery struct {
+	webhookId  string
+	deliveryId string
+	eventType  string
+	body       []byte
+	attempt    int
+}
+
+type webhookMessage struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	UtcTime int64           `json:"utctime"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+var events = make(chan dispatchedEvent, 1024)
+var deliveries = make(chan delivery, 1024)
+
+var httpClient = newHttpClient(false)
+
+var errPrivateNetwork = errors.New("webhooks to loopback, link-local and private addresses are not allowed")
+
+// Returns the client delivering the webhooks. The target is checked when connecting, after the name has been
+// resolved, and redirects are not followed, so a webhook can't reach the network of the server
+func newHttpClient(allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivateNetworks {
+		dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateAddress(ip) {
+				return errPrivateNetwork
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		// no proxy, the dialer would check the address of the proxy instead of the target
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// Starts the goroutines which match processed events against webhooks and deliver them
+func Start(workers int) {
+	config, err := util.GetConfig()
+	if err != nil {
+		fmt.Println("Error reading config: ", err)
+		return
+	}
+	httpClient = newHttpClient(config.WebhookAllowPrivateNetworks)
+
+	go matchEvents()
+	for i := 0; i < workers; i++ {
+		go deliverEvents()
+	}
+}
+
+// Queues an event for delivery to the webhooks of the user without blocking the caller
+func Dispatch(userId string, eventType string, payload []byte) {
+	select {
+	case events <- dispatchedEvent{userId: userId, eventType: eventType, payload: payload}:
+	default:
+		fmt.Println("Webhook queue is full, event dropped: ", eventType)
+	}
+}
+
+// Checks whether the event type matches the comma separated filter, "task-*" style prefixes are allowed
+func IsEventTypeMatch(eventTypes string, eventType string) bool {
+	if strings.TrimSpace(eventTypes) == "" {
+		return true
+	}
+	for _, filter := range strings.Split(eventTypes, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == eventType || filter == "*" {
+			return true
+		}
+		if strings.HasSuffix(filter, "*") && strings.HasPrefix(eventType, strings.TrimSuffix(filter, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the hex encoded HMAC-SHA256 signature of "timestamp.body"
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func matchEvents() {
+	config, err := util.GetConfig()
+	if err != nil {
+		fmt.Println("Error reading config: ", err)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		fmt.Println("Error opening db: ", err)
+		return
+	}
+	defer db.Close()
+
+	for dispatched := range events {
+		webhooks, err := store.GetActiveWebhooks(db, dispatched.userId)
+		if err != nil {
+			fmt.Println("Error reading webhooks: ", err)
+			continue
+		}
+
+		for _, webhook := range webhooks {
+			if !IsEventTypeMatch(webhook.EventTypes, dispatched.eventType) {
+				continue
+			}
+
+			deliveryId := util.Uuid()
+			body, err := json.Marshal(webhookMessage{
+				Id:      deliveryId,
+				Type:    dispatched.eventType,
+				UtcTime: time.Now().UTC().UnixMilli(),
+				Payload: dispatched.payload,
+			})
+			if err != nil {
+				fmt.Println("Error serializing webhook message: ", err)
+				continue
+			}
+
+			deliveries <- delivery{webhookId: webhook.WebhookId, deliveryId: deliveryId, eventType: dispatched.eventType, body: body, attempt: 1}
+		}
+	}
+}
+
+func deliverEvents() {
+	config, err := util.GetConfig()
+	if err != nil {
+		fmt.Println("Error reading config: ", err)
+		return
+	}
+
+	db, err := store.OpenDb(config.DbPath)
+	if err != nil {
+		fmt.Println("Error opening db: ", err)
+		return
+	}
+	defer db.Close()
+
+	maxFailures := config.WebhookMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxFailures
+	}
+
+	for delivery := range deliveries {
+		// a webhook deleted or disabled since the event was queued gets no more attempts
+		webhook, err := store.GetWebhook(db, delivery.webhookId)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if webhook.IsActive == 0 {
+			continue
+		}
+
+		statusCode, err := post(*webhook, delivery)
+
+		var deliveryLog store.WebhookDelivery
+		deliveryLog.DeliveryId = delivery.deliveryId
+		deliveryLog.WebhookId = webhook.WebhookId
+		deliveryLog.EventType = delivery.eventType
+		deliveryLog.Payload = string(delivery.body)
+		deliveryLog.Attempt = delivery.attempt
+		deliveryLog.StatusCode = statusCode
+		deliveryLog.UtcTime = time.Now().UTC().UnixMilli()
+		if err == nil {
+			deliveryLog.IsSuccess = 1
+		} else {
+			deliveryLog.Error = err.Error()
+		}
+
+		if logErr := store.InsertWebhookDelivery(db, deliveryLog); logErr != nil {
+			fmt.Println("Error storing webhook delivery: ", logErr)
+		}
+		logError(store.DeleteOldWebhookDeliveries(db, webhook.WebhookId, maxStoredDeliveries, time.Now().Add(-maxDeliveryAge).UTC().UnixMilli()))
+
+		if err == nil {
+			if webhook.FailureCount > 0 {
+				logError(store.ResetWebhookFailures(db, webhook.WebhookId))
+			}
+			continue
+		}
+
+		if delivery.attempt < maxAttempts {
+			scheduleRetry(delivery)
+			continue
+		}
+
+		logError(store.IncrementWebhookFailures(db, webhook.WebhookId, maxFailures))
+	}
+}
+
+// Requeues the delivery with exponential backoff: 2s, 4s, 8s, 16s
+func scheduleRetry(retry delivery) {
+	delay := firstRetryDelay << (retry.attempt - 1)
+	retry.attempt++
+	time.AfterFunc(delay, func() {
+		deliveries <- retry
+	})
+}
+
+func post(webhook store.Webhook, delivery delivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "ToDo++ Webhook")
+	request.Header.Set("X-Todopp-Event", delivery.eventType)
+	request.Header.Set("X-Todopp-Delivery", delivery.deliveryId)
+	request.Header.Set("X-Todopp-Timestamp", timestamp)
+	request.Header.Set("X-Todopp-Signature", "sha256="+Sign(webhook.Secret, timestamp, delivery.body))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func logError(err error) {
+	if err != nil {
+		fmt.Println("Webhook error: ", err)
+	}
+}
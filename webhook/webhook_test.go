@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"todopp/store"
+)
+
+func TestPostToLocalListener(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		received <- request
+	}))
+	defer server.Close()
+
+	webhook := store.Webhook{WebhookId: "webhook", Url: server.URL, Secret: "secret"}
+	delivery := delivery{webhookId: "webhook", deliveryId: "delivery", eventType: "task-add", body: []byte(`{}`), attempt: 1}
+
+	// loopback targets are refused unless private networks are allowed
+	httpClient = newHttpClient(false)
+	_, err := post(webhook, delivery)
+	if !errors.Is(err, errPrivateNetwork) {
+		t.Fatalf("expected the local listener to be refused, got %v", err)
+	}
+
+	httpClient = newHttpClient(true)
+	statusCode, err := post(webhook, delivery)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("got %d, %v", statusCode, err)
+	}
+	request := <-received
+	if request.Header.Get("X-Todopp-Signature") != "sha256="+Sign("secret", request.Header.Get("X-Todopp-Timestamp"), []byte(`{}`)) {
+		t.Fatal("the delivery is not signed")
+	}
+}
+
+func TestPostDoesNotFollowRedirects(t *testing.T) {
+	redirected := false
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/target" {
+			redirected = true
+			return
+		}
+		http.Redirect(responseWriter, request, "/target", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	httpClient = newHttpClient(true)
+	statusCode, err := post(store.Webhook{Url: server.URL}, delivery{body: []byte(`{}`)})
+	if err == nil || statusCode != http.StatusTemporaryRedirect || redirected {
+		t.Fatalf("expected the redirect to fail the delivery, got %d, %v", statusCode, err)
+	}
+}